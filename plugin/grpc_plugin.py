@@ -1,6 +1,8 @@
 import base64
+import hashlib
 import os
 import pwd
+import shlex
 import sys
 
 import paramiko
@@ -21,6 +23,14 @@ from ansible.utils.display import Display
 display = Display()
 
 
+class TransferError(AnsibleConnectionFailure):
+    """ A transfer the server reported as failed, code is its grpc.StatusCode """
+
+    def __init__(self, message, code):
+        super(TransferError, self).__init__(message)
+        self.code = code
+
+
 class AuthInterceptor(UnaryUnaryClientInterceptor, StreamStreamClientInterceptor):
     def __init__(self, user, password, private_key_path) -> None:
         super().__init__()
@@ -94,6 +104,13 @@ class Connection(ConnectionBase):
         self.user = self._play_context.remote_user or "root"
         self.password = self._play_context.password
         self.private_key_path = self._play_context.private_key_file
+        self.compression = self._grpc_compression(os.environ.get('ANSIBLE_GRPC_COMPRESSION', 'none'))
+        self.chunk_size = int(os.environ.get('ANSIBLE_GRPC_CHUNK_SIZE', 1024 * 1024))  # 1MB
+        self.rate_limit = int(os.environ.get('ANSIBLE_GRPC_RATE_LIMIT', 0))  # bytes per second, 0 is unlimited
+        self._content_store = os.environ.get('ANSIBLE_GRPC_CONTENT_STORE', 'true').lower() not in ('0', 'false', 'no')
+        self.progress_interval = int(os.environ.get('ANSIBLE_GRPC_PROGRESS_INTERVAL', 0))  # milliseconds, 0 is off
+        self._inherit_xattrs = os.environ.get('ANSIBLE_GRPC_INHERIT_XATTRS', 'false').lower() in ('1', 'true', 'yes')
+        self._filesystem_service = os.environ.get('ANSIBLE_GRPC_FILESYSTEM_SERVICE', 'true').lower() not in ('0', 'false', 'no')
         self._connected = False
 
         if not self.host or not self.port:
@@ -143,11 +160,13 @@ class Connection(ConnectionBase):
                 intercepted_channel = intercept_channel(channel, auth_interceptor)
                 # Create the stub with the intercepted channel
                 self.stub = connect_pb2_grpc.ConnectionServiceStub(intercepted_channel)
+                self.fs_stub = connect_pb2_grpc.FileSystemServiceStub(intercepted_channel)
                 # Attempt to connect
                 request = connect_pb2.ConnectRequest()
                 response = self.stub.Connect(request)
                 if response.success:
                     successful_key_path = key_path
+                    self._apply_transfer_limits(response)
                     display.vvv(f"Successfully connected using key {key_path}")
                     break
                 display.vvv(f"Key {key_path} failed: {response.message}")
@@ -171,10 +190,52 @@ class Connection(ConnectionBase):
         display.vvv(f"Exec command: {cmd}")
         if not self._connected:
             raise AnsibleConnectionFailure("Not connected")
+        remove = self._parse_remove_command(cmd)
+        if remove is not None and self._remove(*remove):
+            return 0, b'', b''
         request = connect_pb2.CommandRequest(command=cmd)
-        response = self.stub.ExecCommand(request)
+        response = self.stub.ExecCommand(request, compression=self.compression)
         return response.exit_code, response.stdout, response.stderr
 
+    @staticmethod
+    def _parse_remove_command(cmd):
+        """ Return path and recursive of the rm commands Ansible uses to clean up, None for any other command """
+        try:
+            args = shlex.split(cmd)
+            # Ansible wraps commands into the shell of the become or executable settings
+            if len(args) == 3 and os.path.basename(args[0]) in ('sh', 'bash') and args[1] == '-c':
+                args = shlex.split(args[2])
+        except ValueError:
+            return None
+        # Ansible's shell plugin appends a trailing sleep and removes with rm -f [-r] 'path' > /dev/null 2>&1
+        if args[-3:] == ['&&', 'sleep', '0']:
+            args = args[:-3]
+        if args[-3:] != ['>', '/dev/null', '2>&1'] or args[:2] != ['rm', '-f']:
+            return None
+        args = args[2:-3]
+        recursive = args[:1] == ['-r']
+        if recursive:
+            args = args[1:]
+        if len(args) != 1 or not os.path.isabs(args[0]):
+            return None
+        return args[0], recursive
+
+    def _remove(self, path, recursive):
+        """ Remove path with FileSystemService, False when the server cannot and the command has to run instead """
+        if not self._filesystem_service:
+            return False
+        try:
+            response = self.fs_stub.Remove(connect_pb2.RemoveRequest(path=path, recursive=recursive))
+        except grpc.RpcError as e:
+            if e.code() == grpc.StatusCode.UNIMPLEMENTED:
+                display.vvv("Server has no filesystem service")
+                self._filesystem_service = False
+            else:
+                display.vvv(f"Failed to remove {path}: {e.details()} (code: {e.code()})")
+            return False
+        display.vvv(f"Removed {path}: {response.removed}")
+        return True
+
     @ensure_connect
     def put_file(self, in_path, out_path):
         """ Transfer a file from local to remote using TransferFile """
@@ -183,21 +244,59 @@ class Connection(ConnectionBase):
             raise AnsibleConnectionFailure(f"Local file {in_path} does not exist")
 
         file_size = os.path.getsize(in_path)
-        chunk_size = 1024 * 1024  # 1MB
+        checksum = self._file_checksum(in_path, self.chunk_size)
+
+        try:
+            # Content the server already stored for us is placed without sending it again
+            if self._have_content(f"sha256:{checksum}"):
+                try:
+                    self._upload(in_path, out_path, file_size, checksum, from_store=True)
+                    display.vvv(f"Successfully put file to {out_path} from the server's content store")
+                    return
+                except TransferError as e:
+                    if e.code != grpc.StatusCode.NOT_FOUND:
+                        raise
+                    display.vvv(f"Content was evicted from the server's content store: {e}")
+                except grpc.RpcError as e:
+                    if e.code() != grpc.StatusCode.NOT_FOUND:
+                        raise
+                    display.vvv(f"Content was evicted from the server's content store: {e.details()}")
+            self._upload(in_path, out_path, file_size, checksum, from_store=False)
+            display.vvv(f"Successfully put file to {out_path}")
+        except grpc.RpcError as e:
+            raise AnsibleConnectionFailure(f"Failed to put file: {e.details()} (code: {e.code()})")
+
+    def _upload(self, in_path, out_path, file_size, checksum, from_store):
+        """ Upload a file with TransferFile, from_store places the content stored on the server instead """
+        chunk_size = self.chunk_size
 
         def request_generator():
             # Step 1: Send ControlMessage to initiate upload
+            info = connect_pb2.FileInfo(
+                local_path=in_path,
+                remote_path=out_path,
+                file_size=file_size,
+                checksum_algorithm=connect_pb2.FileInfo.SHA256,
+                checksum=checksum,
+                chunk_size=chunk_size,
+                rate_limit=self.rate_limit,
+                progress_interval_ms=self.progress_interval
+            )
+            if self._inherit_xattrs:
+                info.xattr_mode = connect_pb2.FileInfo.XATTRS_INHERIT
+            if from_store:
+                info.content_digest = f"sha256:{checksum}"
+            elif self._content_store:
+                info.store_content = True
             control_msg = connect_pb2.FileTransferMessage(
                 control=connect_pb2.ControlMessage(
                     operation=connect_pb2.ControlMessage.UPLOAD,
-                    info=connect_pb2.FileInfo(
-                        local_path=in_path,
-                        remote_path=out_path,
-                        file_size=file_size
-                    )
+                    info=info
                 )
             )
             yield control_msg
+            if from_store:
+                return
 
             # Step 2: Stream file data
             with open(in_path, 'rb') as f:
@@ -210,27 +309,44 @@ class Connection(ConnectionBase):
                     )
                     yield file_data_msg
 
+        responses = self.stub.TransferFile(request_generator(), compression=self.compression)
+        for response in responses:
+            payload = response.WhichOneof("payload")
+            if payload == "control":
+                if response.control.operation == connect_pb2.ControlMessage.ERROR:
+                    self._raise_transfer_error("Failed to upload file", response.control)
+                elif response.control.operation == connect_pb2.ControlMessage.PROGRESS:
+                    self._display_progress(out_path, response.control.progress)
+                elif response.control.operation == connect_pb2.ControlMessage.COMPLETE and response.control.HasField("info"):
+                    display.vvv(f"Upload acknowledged: {response.control.info.remote_path}")
+                    if response.control.info.checksum and response.control.info.checksum != checksum:
+                        raise AnsibleConnectionFailure(
+                            f"Checksum mismatch after upload: local {checksum}, remote {response.control.info.checksum}")
+                else:
+                    display.vvv(f"Server control message: {response.control}")
+            elif payload == "data":
+                # Handle any data from server if needed
+                display.vvv("Received data chunk from server during upload")
+
+    def _have_content(self, digest):
+        """ Ask the server whether it stored the content with digest for us """
+        if not self._content_store:
+            return False
         try:
-            responses = self.stub.TransferFile(request_generator())
-            for response in responses:
-                if response.control:
-                    if response.control.operation == connect_pb2.ControlMessage.UPLOAD and response.control.info:
-                        display.vvv(f"Upload initiated: {response.control.info.remote_path}")
-                    else:
-                        display.vvv(f"Server control message: {response.control}")
-                elif response.data:
-                    # Handle any data from server if needed
-                    display.vvv("Received data chunk from server during upload")
-            display.vvv(f"Successfully put file to {out_path}")
+            response = self.stub.HaveContent(connect_pb2.HaveContentRequest(digests=[digest]))
         except grpc.RpcError as e:
-            raise AnsibleConnectionFailure(f"Failed to put file: {e.details()} (code: {e.code()})")
+            if e.code() != grpc.StatusCode.UNIMPLEMENTED:
+                raise
+            display.vvv("Server has no content store")
+            self._content_store = False
+            return False
+        return digest in response.present
 
     @ensure_connect
     def fetch_file(self, in_path, out_path):
         ''' Transfer a file from remote to local using TransferFile '''
         display.vvv(f"Fetching file from {in_path} to {out_path}")
-        file_size = 0  # If known, set the file size; otherwise, set to 0 or remove
-        chunk_size = 1024 * 1024  # 1MB
+        chunk_size = self.chunk_size
 
         def request_generator():
             # Step 1: Send ControlMessage to initiate download
@@ -238,7 +354,10 @@ class Connection(ConnectionBase):
                 control=connect_pb2.ControlMessage(
                     operation=connect_pb2.ControlMessage.DOWNLOAD,
                     info=connect_pb2.FileInfo(
-                        remote_path=in_path
+                        remote_path=in_path,
+                        chunk_size=chunk_size,
+                        rate_limit=self.rate_limit,
+                        progress_interval_ms=self.progress_interval
                     )
                 )
             )
@@ -246,25 +365,89 @@ class Connection(ConnectionBase):
             # No further messages needed for download
 
         try:
-            responses = self.stub.TransferFile(request_generator())
+            responses = self.stub.TransferFile(request_generator(), compression=self.compression)
+            digest = hashlib.sha256()
+            remote_checksum = None
             with open(out_path, 'wb') as f:
                 for response in responses:
-                    if response.control:
-                        if response.control.operation == connect_pb2.ControlMessage.DOWNLOAD and response.control.info:
+                    payload = response.WhichOneof("payload")
+                    if payload == "control":
+                        if response.control.operation == connect_pb2.ControlMessage.ERROR:
+                            self._raise_transfer_error("Failed to fetch file", response.control)
+                        elif response.control.operation == connect_pb2.ControlMessage.PROGRESS:
+                            self._display_progress(in_path, response.control.progress)
+                        elif response.control.operation == connect_pb2.ControlMessage.COMPLETE:
+                            remote_checksum = response.control.info.checksum
+                        elif response.control.operation == connect_pb2.ControlMessage.DOWNLOAD:
                             display.vvv(f"Download initiated: {response.control.info.remote_path}")
                         else:
                             display.vvv(f"Server control message: {response.control}")
-                    elif response.data:
+                    elif payload == "data":
                         f.write(response.data.data)
+                        digest.update(response.data.data)
                         display.vvv(f"Received {len(response.data.data)} bytes")
+            if remote_checksum and remote_checksum != digest.hexdigest():
+                raise AnsibleConnectionFailure(
+                    f"Checksum mismatch after download: remote {remote_checksum}, local {digest.hexdigest()}")
             display.vvv(f"Successfully fetched file to {out_path}")
         except grpc.RpcError as e:
             raise AnsibleConnectionFailure(f"Failed to fetch file: {e.details()} (code: {e.code()})")
 
+    @staticmethod
+    def _display_progress(path, progress):
+        """ Show a PROGRESS report of a running transfer """
+        total = f"/{progress.bytes_total}" if progress.bytes_total else ""
+        display.vvv(f"{path}: {progress.bytes_done}{total} bytes at {progress.bytes_per_second} bytes/s")
+
+    @staticmethod
+    def _raise_transfer_error(message, control):
+        """ Raise the error of a failed transfer reported in an ERROR control message """
+        detail = connect_pb2.TransferErrorDetail()
+        for any_detail in control.status.details:
+            if any_detail.Unpack(detail):
+                message += f" at {detail.path}"
+                if detail.errno_name:
+                    message += f" ({detail.errno_name})"
+                break
+        code = grpc.StatusCode.UNKNOWN
+        for status_code in grpc.StatusCode:
+            if status_code.value[0] == control.status.code:
+                code = status_code
+        raise TransferError(f"{message}: {control.status.message} (code: {code})", code)
+
+    def _apply_transfer_limits(self, response):
+        """ Keep the chunk size within the bounds advertised by the server """
+        if not response.HasField("transfer_limits"):
+            return
+        limits = response.transfer_limits
+        chunk_size = min(max(self.chunk_size, limits.min_chunk_size), limits.max_chunk_size)
+        if chunk_size != self.chunk_size:
+            display.vvv(f"Using chunk size {chunk_size} within server limits [{limits.min_chunk_size}, {limits.max_chunk_size}]")
+        self.chunk_size = chunk_size
+
+    @staticmethod
+    def _grpc_compression(name):
+        compressions = {
+            'none': grpc.Compression.NoCompression,
+            'gzip': grpc.Compression.Gzip,
+        }
+        if name.lower() not in compressions:
+            raise AnsibleConnectionFailure(f"Unsupported gRPC compression {name}, expected one of {', '.join(compressions)}")
+        return compressions[name.lower()]
+
+    @staticmethod
+    def _file_checksum(path, chunk_size):
+        digest = hashlib.sha256()
+        with open(path, 'rb') as f:
+            for chunk in iter(lambda: f.read(chunk_size), b''):
+                digest.update(chunk)
+        return digest.hexdigest()
+
     def close(self):
         ''' Terminate the connection '''
         if self._connected:
             display.vvv("Closing gRPC connection to host")
             self.stub = None
+            self.fs_stub = None
             self._channel.close()
             self._connected = False
@@ -1,20 +1,30 @@
 package cmd
 
 import (
+	"context"
 	goflag "flag"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/audit"
 	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/authenicate"
 	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/contentstore"
 	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/implement"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/metrics"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/policy"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/throttle"
 	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/version/verflag"
 
 	"github.com/spf13/pflag"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 	"k8s.io/klog/v2"
 )
 
@@ -23,11 +33,38 @@ type Config struct {
 	WhiteList             []string
 	Address               string
 	AuthenticatorFilePath string
+	AuthLimiter           authenicate.LimiterConfig
+	DisableAuthLimiter    bool
+	PamService            string
+	PamAccountCheck       bool
+	PamSessions           bool
+	AuditLog              string
+	AuditMaxSizeMB        int64
+	AuditMaxBackups       int
+	AuditRedact           []string
+	MetricsAddress        string
+	Reflection            bool
+	ShutdownDelay         time.Duration
+	PathPolicy            string
+	ChunkSizes            implement.ChunkSizes
+	MaxRecvMsgSize        int
+	MaxSendMsgSize        int
+	Throttle              throttle.Config
+	ContentStoreDir       string
+	ContentStoreSize      int64
+	PartialFileTTL        time.Duration
+	EnableLegacyRPCs      bool
+	LegacyRPCMaxSize      int64
 }
 
 // Execute initializes and starts the gRPC server
 func Execute() {
 
+	// The daemon runs itself to hold the PAM sessions of commands
+	if len(os.Args) > 1 && os.Args[1] == implement.PamSessionHelperArg {
+		os.Exit(implement.RunPamSessionHelper())
+	}
+
 	var cfg Config
 
 	// Initialize flags
@@ -37,10 +74,46 @@ func Execute() {
 	pflag.StringSliceVarP(&cfg.WhiteList, "whiteList", "w", []string{}, "Whitelist IPs to allow connection")
 	pflag.StringVarP(&cfg.Address, "listen", "l", ":50051", "Address to listen on")
 	pflag.StringVarP(&cfg.AuthenticatorFilePath, "authfile", "a", "", "SSH authenticator file path")
+	pflag.StringVar(&cfg.PamService, "pam-service", authenicate.DefaultPamService, "PAM service used for password authentication, account checks and sessions")
+	pflag.BoolVar(&cfg.PamAccountCheck, "pam-account-check", true, "Reject users whose account is refused by the PAM account stack (expired, locked)")
+	pflag.BoolVar(&cfg.PamSessions, "pam-session", false, "Open a PAM session around every executed command")
+	pflag.StringVar(&cfg.PathPolicy, "path-policy", "", "JSON file confining file operations per user or group and chrooting their commands, empty leaves them unrestricted")
+	pflag.IntVar(&cfg.ChunkSizes.Min, "min-chunk-size", implement.DefaultChunkSizes.Min, "Smallest data chunk in bytes a client may request for file transfers")
+	pflag.IntVar(&cfg.ChunkSizes.Max, "max-chunk-size", implement.DefaultChunkSizes.Max, "Largest data chunk in bytes a client may request for file transfers")
+	pflag.IntVar(&cfg.ChunkSizes.Default, "default-chunk-size", implement.DefaultChunkSizes.Default, "Data chunk size in bytes of file transfers not requesting one")
+	pflag.IntVar(&cfg.MaxRecvMsgSize, "max-recv-msg-size", implement.DefaultMaxRecvMsgSize, "Largest gRPC message in bytes the server accepts")
+	pflag.IntVar(&cfg.MaxSendMsgSize, "max-send-msg-size", implement.DefaultMaxSendMsgSize, "Largest gRPC message in bytes the server sends")
+	pflag.Int64Var(&cfg.Throttle.Global, "rate-limit", 0, "Bytes per second shared by all file transfers, 0 means unlimited")
+	pflag.Int64Var(&cfg.Throttle.PerUser, "user-rate-limit", 0, "Bytes per second shared by the file transfers of each user, 0 means unlimited")
+	pflag.StringToInt64Var(&cfg.Throttle.Users, "user-rate-limits", nil, "Per-user overrides of --user-rate-limit as user=bytes per second, 0 means unlimited")
+	pflag.StringVar(&cfg.ContentStoreDir, "content-store-dir", "", "Directory of the content store used to skip uploads of content the server already has, empty disables it")
+	pflag.Int64Var(&cfg.ContentStoreSize, "content-store-size", 1<<30, "Size in bytes after which the least recently used contents are evicted from the content store")
+	pflag.DurationVar(&cfg.PartialFileTTL, "partial-file-ttl", implement.DefaultPartialFileTTL, "Time after which the partial data of an abandoned resumable upload is removed, 0 keeps it")
+	pflag.BoolVar(&cfg.EnableLegacyRPCs, "enable-legacy-rpcs", false, "Serve the deprecated unary PutFile and FetchFile RPCs")
+	pflag.Int64Var(&cfg.LegacyRPCMaxSize, "legacy-rpc-max-size", implement.DefaultLegacyRPCMaxSize, "Largest file in bytes PutFile and FetchFile transfer")
+	pflag.BoolVar(&cfg.Reflection, "reflection", false, "Register the gRPC server reflection service")
+	pflag.DurationVar(&cfg.ShutdownDelay, "shutdown-delay", 0, "Time to report NOT_SERVING on the health service before draining connections on shutdown")
+	pflag.StringVar(&cfg.MetricsAddress, "metrics-listen", "", "Address to expose Prometheus metrics on, empty disables the metrics listener")
+	pflag.StringVar(&cfg.AuditLog, "audit-log", "", "Audit log destination: a file path, \"syslog\" or \"journald\"; empty disables auditing")
+	pflag.Int64Var(&cfg.AuditMaxSizeMB, "audit-max-size", 100, "Size in megabytes after which the audit log file is rotated, 0 disables rotation")
+	pflag.IntVar(&cfg.AuditMaxBackups, "audit-max-backups", 5, "Number of rotated audit log files to keep")
+	pflag.StringSliceVar(&cfg.AuditRedact, "audit-redact", audit.DefaultRedactPatterns, "Regular expressions whose matches (or capture groups) are masked in audited command lines")
+	pflag.BoolVar(&cfg.DisableAuthLimiter, "disable-auth-limiter", false, "Disable throttling of clients with failed authentication attempts")
+	pflag.IntVar(&cfg.AuthLimiter.MaxIPFailures, "auth-max-ip-failures", 10, "Failed attempts from one IP before it is banned, 0 disables IP bans")
+	pflag.IntVar(&cfg.AuthLimiter.MaxUserFailures, "auth-max-user-failures", 5, "Failed attempts for one user from one IP before that IP is banned for the user, 0 disables user bans")
+	pflag.DurationVar(&cfg.AuthLimiter.BaseBackoff, "auth-backoff", time.Second, "Delay enforced after a failed attempt, doubled on each further failure")
+	pflag.DurationVar(&cfg.AuthLimiter.MaxBackoff, "auth-max-backoff", time.Minute, "Upper bound of the authentication backoff")
+	pflag.DurationVar(&cfg.AuthLimiter.BanDuration, "auth-ban-duration", 15*time.Minute, "How long a banned IP or user is rejected")
+	pflag.DurationVar(&cfg.AuthLimiter.ResetAfter, "auth-failure-reset", 10*time.Minute, "Forget failures of a source after this much time without new failures")
 	pflag.Parse()
 
 	defer klog.Flush()
 
+	// Every chunk must fit into a message in both directions
+	if err := cfg.ChunkSizes.Validate(min(cfg.MaxRecvMsgSize, cfg.MaxSendMsgSize)); err != nil {
+		klog.Fatalf("Invalid transfer sizes: %v", err)
+	}
+
 	// Listen on the specified address
 	lis, err := net.Listen("tcp", cfg.Address)
 	if err != nil {
@@ -54,24 +127,109 @@ func Execute() {
 		whiteMap[ip] = true
 	}
 
-	// Initialize SSH Authenticator
+	// Initialize SSH Authenticator, the server keeps running without it but reports
+	// itself as not serving on the health service
+	healthServer := health.NewServer()
 	sshAuthenticator, err := authenicate.NewSSHAuthenticator(cfg.AuthenticatorFilePath)
 	if err != nil {
-		klog.Fatalf("Failed to initialize SSH authenticator: %v", err)
+		klog.ErrorS(err, "Failed to initialize SSH authenticator, SSH key authentication is disabled")
+	} else {
+		defer sshAuthenticator.Close()
 	}
-	defer sshAuthenticator.Close()
 
 	// Create server instance
-	serverInstance := implement.NewServer(whiteMap, sshAuthenticator)
+	pamAuthenticator := authenicate.NewPamAuthenticator(cfg.PamService, cfg.PamAccountCheck)
+
+	serverInstance := implement.NewServer(whiteMap, sshAuthenticator, pamAuthenticator)
+	serverInstance.PamSessions = cfg.PamSessions
+	serverInstance.ChunkSizes = cfg.ChunkSizes
+	serverInstance.MaxRecvMsgSize = cfg.MaxRecvMsgSize
+	serverInstance.MaxSendMsgSize = cfg.MaxSendMsgSize
+	serverInstance.PartialFileTTL = cfg.PartialFileTTL
+	if cfg.Throttle.Global > 0 || cfg.Throttle.PerUser > 0 || len(cfg.Throttle.Users) > 0 {
+		serverInstance.Throttle = throttle.NewLimiter(cfg.Throttle)
+	}
+	if cfg.EnableLegacyRPCs {
+		if cfg.LegacyRPCMaxSize <= 0 {
+			klog.Fatalf("Invalid legacy RPC size limit %d", cfg.LegacyRPCMaxSize)
+		}
+		serverInstance.LegacyRPCMaxSize = cfg.LegacyRPCMaxSize
+	}
+	if !cfg.DisableAuthLimiter {
+		serverInstance.AuthLimiter = authenicate.NewFailureLimiter(cfg.AuthLimiter)
+	}
+
+	// Load the path policy
+	if cfg.PathPolicy != "" {
+		pathPolicy, err := policy.Load(cfg.PathPolicy)
+		if err != nil {
+			klog.Fatalf("Failed to load path policy: %v", err)
+		}
+		if err := policy.Supported(); err != nil {
+			klog.Fatalf("Path policy unusable: %v", err)
+		}
+		serverInstance.Policy = pathPolicy
+	}
+
+	// Open the content store
+	if cfg.ContentStoreDir != "" {
+		store, err := contentstore.Open(cfg.ContentStoreDir, cfg.ContentStoreSize)
+		if err != nil {
+			klog.Fatalf("Failed to open content store: %v", err)
+		}
+		serverInstance.Store = store
+	}
 
-	// Set up gRPC server options with both unary and streaming interceptors
+	// Initialize audit log
+	if cfg.AuditLog != "" {
+		sink, err := audit.Open(cfg.AuditLog, audit.FileOptions{
+			MaxSize:    cfg.AuditMaxSizeMB << 20,
+			MaxBackups: cfg.AuditMaxBackups,
+		})
+		if err != nil {
+			klog.Fatalf("Failed to open audit log: %v", err)
+		}
+		auditLogger, err := audit.NewLogger(sink, cfg.AuditRedact)
+		if err != nil {
+			klog.Fatalf("Failed to initialize audit log: %v", err)
+		}
+		defer auditLogger.Close()
+		serverInstance.Audit = auditLogger
+	}
+
+	// Serve metrics
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if cfg.MetricsAddress != "" {
+		go metrics.Serve(ctx, cfg.MetricsAddress, metrics.NewRegistry())
+	}
+
+	// Set up gRPC server options with both unary and streaming interceptors,
+	// metrics come first so rejected requests are counted as well
 	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(serverInstance.AuthenticateUnary),
-		grpc.StreamInterceptor(serverInstance.AuthenticateStream),
+		grpc.ChainUnaryInterceptor(metrics.UnaryServerInterceptor, serverInstance.AuthenticateUnary),
+		grpc.ChainStreamInterceptor(metrics.StreamServerInterceptor, serverInstance.AuthenticateStream),
+		grpc.MaxRecvMsgSize(cfg.MaxRecvMsgSize),
+		grpc.MaxSendMsgSize(cfg.MaxSendMsgSize),
 	}
 
 	grpcServer := grpc.NewServer(opts...)
 	pb.RegisterConnectionServiceServer(grpcServer, serverInstance)
+	pb.RegisterAdminServiceServer(grpcServer, implement.NewAdminServer(serverInstance))
+	pb.RegisterFileSystemServiceServer(grpcServer, implement.NewFileSystemServer(serverInstance))
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	if cfg.Reflection {
+		reflection.Register(grpcServer)
+	}
+
+	servingStatus := healthpb.HealthCheckResponse_SERVING
+	if sshAuthenticator == nil {
+		servingStatus = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	for service := range grpcServer.GetServiceInfo() {
+		healthServer.SetServingStatus(service, servingStatus)
+	}
+	healthServer.SetServingStatus("", servingStatus)
 
 	// Handle graceful shutdown
 	go func() {
@@ -85,6 +243,11 @@ func Execute() {
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 	<-stop
 	klog.Info("Shutting down the server gracefully...")
+	healthServer.Shutdown()
+	if cfg.ShutdownDelay > 0 {
+		klog.Infof("Waiting %s for clients to notice the server is draining", cfg.ShutdownDelay)
+		time.Sleep(cfg.ShutdownDelay)
+	}
 	grpcServer.GracefulStop()
 	fmt.Println("Server stopped.")
 }
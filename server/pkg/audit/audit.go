@@ -0,0 +1,151 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// Event types
+const (
+	EventAuth       = "auth"
+	EventExec       = "exec"
+	EventTransfer   = "transfer"
+	EventFileSystem = "filesystem"
+)
+
+// DefaultRedactPatterns masks the value of common secret-carrying arguments
+var DefaultRedactPatterns = []string{
+	`(?i)(?:password|passwd|pass|token|secret|api[_-]?key)=(\S+)`,
+}
+
+const redacted = "***"
+
+// Event is a single audit record, written as one JSON line
+type Event struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	User       string    `json:"user,omitempty"`
+	ClientIP   string    `json:"client_ip,omitempty"`
+	Method     string    `json:"method,omitempty"`
+	AuthMethod string    `json:"auth_method,omitempty"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+	Argv       []string  `json:"argv,omitempty"`
+	Cwd        string    `json:"cwd,omitempty"`
+	ExitCode   *int      `json:"exit_code,omitempty"`
+	Duration   float64   `json:"duration_seconds,omitempty"`
+	Operation  string    `json:"operation,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	Bytes      int64     `json:"bytes,omitempty"`
+	Checksum   string    `json:"checksum,omitempty"`
+}
+
+// Sink receives encoded audit records
+type Sink interface {
+	Write(line []byte) error
+	Close() error
+}
+
+// Logger writes audit events to a Sink. A nil *Logger discards everything, so callers
+// do not need to check whether auditing is enabled.
+type Logger struct {
+	mu     sync.Mutex
+	sink   Sink
+	redact []*regexp.Regexp
+}
+
+// NewLogger creates a Logger writing to sink. Matches of redactPatterns in command lines are
+// masked, when a pattern has capture groups only the groups are masked.
+func NewLogger(sink Sink, redactPatterns []string) (*Logger, error) {
+	l := &Logger{sink: sink}
+	for _, p := range redactPatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact pattern %q: %w", p, err)
+		}
+		l.redact = append(l.redact, re)
+	}
+	return l, nil
+}
+
+// Log records e, filling in its time when unset
+func (l *Logger) Log(e *Event) {
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if len(e.Argv) > 0 {
+		argv := make([]string, len(e.Argv))
+		for i, arg := range e.Argv {
+			argv[i] = l.Redact(arg)
+		}
+		e.Argv = argv
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		klog.ErrorS(err, "Failed to encode audit event", "type", e.Type)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.sink.Write(line); err != nil {
+		klog.ErrorS(err, "Failed to write audit event", "type", e.Type)
+	}
+}
+
+// Redact masks the secrets found in s
+func (l *Logger) Redact(s string) string {
+	if l == nil {
+		return s
+	}
+	for _, re := range l.redact {
+		s = redactMatches(re, s)
+	}
+	return s
+}
+
+func redactMatches(re *regexp.Regexp, s string) string {
+	matches := re.FindAllStringSubmatchIndex(s, -1)
+	if matches == nil {
+		return s
+	}
+	var out []byte
+	last := 0
+	for _, m := range matches {
+		if len(m) == 2 {
+			out = append(out, s[last:m[0]]...)
+			out = append(out, redacted...)
+			last = m[1]
+			continue
+		}
+		for g := 2; g < len(m); g += 2 {
+			if m[g] < 0 || m[g] < last {
+				continue
+			}
+			out = append(out, s[last:m[g]]...)
+			out = append(out, redacted...)
+			last = m[g+1]
+		}
+	}
+	out = append(out, s[last:]...)
+	return string(out)
+}
+
+// Close closes the underlying sink
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sink.Close()
+}
@@ -0,0 +1,157 @@
+package audit
+
+import (
+	"bytes"
+	"fmt"
+	"log/syslog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	syslogTag          = "ansible-grpc-connection-server"
+	journaldSocketPath = "/run/systemd/journal/socket"
+)
+
+// FileOptions controls the rotation of file sinks
+type FileOptions struct {
+	// MaxSize is the size in bytes after which the file is rotated, 0 disables rotation
+	MaxSize int64
+	// MaxBackups is the number of rotated files kept next to the active one
+	MaxBackups int
+}
+
+// Open creates the sink described by dest: "syslog", "journald", or a file path
+// optionally prefixed with "file:"
+func Open(dest string, opts FileOptions) (Sink, error) {
+	switch {
+	case dest == "syslog":
+		return newSyslogSink()
+	case dest == "journald":
+		return newJournaldSink(journaldSocketPath)
+	case strings.HasPrefix(dest, "file:"):
+		return newFileSink(strings.TrimPrefix(dest, "file:"), opts)
+	default:
+		return newFileSink(dest, opts)
+	}
+}
+
+// fileSink appends records to a file, rotating it once it grows past MaxSize
+type fileSink struct {
+	path string
+	opts FileOptions
+	file *os.File
+	size int64
+}
+
+func newFileSink(path string, opts FileOptions) (*fileSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("empty audit log path")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, fmt.Errorf("error creating audit log directory: %w", err)
+	}
+	s := &fileSink{path: path, opts: opts}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening audit log %q: %w", s.path, err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("error stating audit log %q: %w", s.path, err)
+	}
+	s.file = f
+	s.size = st.Size()
+	return nil
+}
+
+func (s *fileSink) Write(line []byte) error {
+	if s.opts.MaxSize > 0 && s.size > 0 && s.size+int64(len(line))+1 > s.opts.MaxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(append(line, '\n'))
+	s.size += int64(n)
+	return err
+}
+
+// rotate shifts path.N to path.N+1, dropping the oldest backup, and starts a new file
+func (s *fileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("error closing audit log %q: %w", s.path, err)
+	}
+	if s.opts.MaxBackups > 0 {
+		for i := s.opts.MaxBackups - 1; i > 0; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		}
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return fmt.Errorf("error rotating audit log %q: %w", s.path, err)
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return fmt.Errorf("error rotating audit log %q: %w", s.path, err)
+	}
+	return s.open()
+}
+
+func (s *fileSink) Close() error {
+	return s.file.Close()
+}
+
+// syslogSink sends records to the local syslog daemon under the authpriv facility
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink() (*syslogSink, error) {
+	w, err := syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_INFO, syslogTag)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to syslog: %w", err)
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) Write(line []byte) error {
+	return s.w.Info(string(line))
+}
+
+func (s *syslogSink) Close() error {
+	return s.w.Close()
+}
+
+// journaldSink speaks the native journald protocol over its datagram socket
+type journaldSink struct {
+	conn *net.UnixConn
+}
+
+func newJournaldSink(socket string) (*journaldSink, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to journald socket %q: %w", socket, err)
+	}
+	return &journaldSink{conn: conn}, nil
+}
+
+func (s *journaldSink) Write(line []byte) error {
+	var b bytes.Buffer
+	// json.Marshal never emits raw newlines, so the simple KEY=VALUE form is safe
+	b.WriteString("MESSAGE=")
+	b.Write(line)
+	b.WriteString("\nPRIORITY=6\nSYSLOG_FACILITY=10\nSYSLOG_IDENTIFIER=" + syslogTag + "\n")
+	_, err := s.conn.Write(b.Bytes())
+	return err
+}
+
+func (s *journaldSink) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,200 @@
+package authenicate
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SourceIP marks a failure record keyed by client IP
+	SourceIP = "ip"
+	// SourceUser marks a failure record keyed by user name and client IP
+	SourceUser = "user"
+
+	pruneInterval = time.Minute
+)
+
+// LimiterConfig holds the thresholds used by FailureLimiter
+type LimiterConfig struct {
+	// MaxIPFailures is the number of failures from one IP before it is banned, 0 disables IP bans
+	MaxIPFailures int
+	// MaxUserFailures is the number of failures for one user from one IP before the IP is banned
+	// for that user, 0 disables user bans
+	MaxUserFailures int
+	// BaseBackoff is the delay enforced after the first failure, doubled on every following failure
+	BaseBackoff time.Duration
+	// MaxBackoff caps the exponential backoff
+	MaxBackoff time.Duration
+	// BanDuration is how long a source stays banned once a threshold is reached
+	BanDuration time.Duration
+	// ResetAfter forgets the failures of a source that stayed quiet for this long
+	ResetAfter time.Duration
+}
+
+// BannedSource describes a client IP, or a user at a client IP, that is currently banned
+type BannedSource struct {
+	Kind     string
+	Source   string
+	Failures int
+	Until    time.Time
+}
+
+type failureRecord struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+	banned       bool
+}
+
+// FailureLimiter counts failed authentication attempts per client IP and per user at each
+// client IP, enforcing an exponential backoff between attempts and temporary bans once the
+// configured thresholds are reached. User failures are never counted across IPs, otherwise
+// any client could lock an account out by failing to log in to it.
+type FailureLimiter struct {
+	cfg       LimiterConfig
+	mu        sync.Mutex
+	records   map[string]*failureRecord
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+func NewFailureLimiter(cfg LimiterConfig) *FailureLimiter {
+	return &FailureLimiter{
+		cfg:     cfg,
+		records: make(map[string]*failureRecord),
+		now:     time.Now,
+	}
+}
+
+func recordKey(kind, source string) string {
+	return kind + "/" + source
+}
+
+// userSource identifies the attempts for user from ip
+func userSource(ip, user string) string {
+	return user + "@" + ip
+}
+
+// Check reports whether an attempt from ip for user may proceed. When it may not,
+// the returned duration tells how long the client has to wait.
+func (l *FailureLimiter) Check(ip, user string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	var wait time.Duration
+	for _, key := range []string{recordKey(SourceIP, ip), recordKey(SourceUser, userSource(ip, user))} {
+		r, ok := l.records[key]
+		if !ok {
+			continue
+		}
+		if d := r.blockedUntil.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait, wait <= 0
+}
+
+// RecordFailure registers a failed attempt. An empty user only counts against the IP,
+// which keeps made-up user names from growing the table.
+func (l *FailureLimiter) RecordFailure(ip, user string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.pruneLocked(now)
+	l.failLocked(recordKey(SourceIP, ip), l.cfg.MaxIPFailures, now)
+	if user != "" {
+		l.failLocked(recordKey(SourceUser, userSource(ip, user)), l.cfg.MaxUserFailures, now)
+	}
+}
+
+// RecordSuccess clears the backoff of user at ip after a successful login. Bans are left
+// to expire on their own and IP counters are kept, so one valid account cannot be
+// used to reset the budget of a brute-forcing client.
+func (l *FailureLimiter) RecordSuccess(ip, user string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := recordKey(SourceUser, userSource(ip, user))
+	if r, ok := l.records[key]; ok && !r.banned {
+		delete(l.records, key)
+	}
+}
+
+// Banned lists the sources that are banned at the moment
+func (l *FailureLimiter) Banned() []BannedSource {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	var banned []BannedSource
+	for key, r := range l.records {
+		if !r.banned || !r.blockedUntil.After(now) {
+			continue
+		}
+		kind, source := splitRecordKey(key)
+		banned = append(banned, BannedSource{
+			Kind:     kind,
+			Source:   source,
+			Failures: r.failures,
+			Until:    r.blockedUntil,
+		})
+	}
+	sort.Slice(banned, func(i, j int) bool {
+		return banned[i].Until.Before(banned[j].Until)
+	})
+	return banned
+}
+
+func (l *FailureLimiter) failLocked(key string, threshold int, now time.Time) {
+	r, ok := l.records[key]
+	if !ok || l.expired(r, now) {
+		r = &failureRecord{}
+		l.records[key] = r
+	}
+	r.failures++
+	r.lastFailure = now
+
+	if threshold > 0 && r.failures >= threshold {
+		r.banned = true
+		r.blockedUntil = now.Add(l.cfg.BanDuration)
+		return
+	}
+	r.blockedUntil = now.Add(l.backoff(r.failures))
+}
+
+func (l *FailureLimiter) backoff(failures int) time.Duration {
+	d := l.cfg.BaseBackoff
+	for i := 1; i < failures && d < l.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	if l.cfg.MaxBackoff > 0 && d > l.cfg.MaxBackoff {
+		d = l.cfg.MaxBackoff
+	}
+	return d
+}
+
+// expired reports whether a record is no longer blocking and has been quiet long enough to be forgotten
+func (l *FailureLimiter) expired(r *failureRecord, now time.Time) bool {
+	return !r.blockedUntil.After(now) && now.Sub(r.lastFailure) >= l.cfg.ResetAfter
+}
+
+func (l *FailureLimiter) pruneLocked(now time.Time) {
+	if now.Sub(l.lastPrune) < pruneInterval {
+		return
+	}
+	l.lastPrune = now
+	for key, r := range l.records {
+		if l.expired(r, now) {
+			delete(l.records, key)
+		}
+	}
+}
+
+func splitRecordKey(key string) (string, string) {
+	kind, source, _ := strings.Cut(key, "/")
+	return kind, source
+}
@@ -2,30 +2,175 @@ package authenicate
 
 import (
 	"errors"
+	"fmt"
+	"sort"
 
 	"github.com/msteinert/pam/v2"
 	"k8s.io/klog/v2"
 )
 
-func PamAuthenticate(user, password string) (bool, error) {
-	tx, err := pam.StartFunc("login", user, func(s pam.Style, msg string) (string, error) {
-		switch s {
-		case pam.ErrorMsg:
-			klog.ErrorS(errors.New(msg), "get a error msg from pam")
-			return "", errors.New(msg)
-		default:
-			return password, nil
+// DefaultPamService is the PAM service used when none is configured
+const DefaultPamService = "login"
+
+// PamAuthenticator runs the auth, account and session stacks of a PAM service
+type PamAuthenticator struct {
+	service      string
+	checkAccount bool
+}
+
+// NewPamAuthenticator creates a PamAuthenticator for service, when checkAccount is set the
+// account stack is consulted after every successful authentication
+func NewPamAuthenticator(service string, checkAccount bool) *PamAuthenticator {
+	if service == "" {
+		service = DefaultPamService
+	}
+	return &PamAuthenticator{
+		service:      service,
+		checkAccount: checkAccount,
+	}
+}
+
+// Service returns the name of the PAM service in use
+func (p *PamAuthenticator) Service() string {
+	return p.service
+}
+
+// conversation answers PAM prompts on behalf of a non-interactive client. The password is
+// handed out for the first secret prompt only, any further prompt (one-time codes, password
+// change requests) cannot be answered and aborts the conversation.
+type conversation struct {
+	user     string
+	password string
+	answered bool
+}
+
+func (c *conversation) RespondPAM(s pam.Style, msg string) (string, error) {
+	switch s {
+	case pam.PromptEchoOff:
+		if c.password == "" || c.answered {
+			return "", fmt.Errorf("unsupported secret prompt %q", msg)
 		}
-	})
+		c.answered = true
+		return c.password, nil
+	case pam.PromptEchoOn:
+		return "", fmt.Errorf("unsupported interactive prompt %q", msg)
+	case pam.ErrorMsg:
+		klog.V(3).ErrorS(errors.New(msg), "get a error msg from pam", "user", c.user)
+		return "", nil
+	case pam.TextInfo:
+		klog.V(3).InfoS("get a info msg from pam", "user", c.user, "msg", msg)
+		return "", nil
+	default:
+		return "", fmt.Errorf("unsupported pam message style %d", s)
+	}
+}
+
+func (p *PamAuthenticator) start(user, password, rhost string) (*pam.Transaction, error) {
+	tx, err := pam.Start(p.service, user, &conversation{user: user, password: password})
+	if err != nil {
+		return nil, err
+	}
+	if rhost != "" {
+		if err := tx.SetItem(pam.Rhost, rhost); err != nil {
+			_ = tx.End()
+			return nil, err
+		}
+	}
+	return tx, nil
+}
+
+// Authenticate checks password for user, followed by the account stack when enabled
+func (p *PamAuthenticator) Authenticate(user, password, rhost string) (bool, error) {
+	tx, err := p.start(user, password, rhost)
 	if err != nil {
-		klog.V(3).ErrorS(err, "pam exec failed", "user", user)
+		klog.V(3).ErrorS(err, "pam exec failed", "user", user, "service", p.service)
 		return false, err
 	}
+	defer endTransaction(tx, user)
 
-	if err := tx.Authenticate(0); err != nil {
-		klog.V(3).ErrorS(err, "pam auth failed", "user", user)
+	if err := tx.Authenticate(pam.DisallowNullAuthtok); err != nil {
+		klog.V(3).ErrorS(err, "pam auth failed", "user", user, "service", p.service)
 		return false, nil
 	}
 
-	return true, nil
+	return p.acctMgmt(tx, user), nil
+}
+
+// CheckAccount runs only the account stack for user, it is used for clients that
+// authenticated by other means than a password
+func (p *PamAuthenticator) CheckAccount(user, rhost string) (bool, error) {
+	if !p.checkAccount {
+		return true, nil
+	}
+	tx, err := p.start(user, "", rhost)
+	if err != nil {
+		klog.V(3).ErrorS(err, "pam exec failed", "user", user, "service", p.service)
+		return false, err
+	}
+	defer endTransaction(tx, user)
+
+	return p.acctMgmt(tx, user), nil
+}
+
+func (p *PamAuthenticator) acctMgmt(tx *pam.Transaction, user string) bool {
+	if !p.checkAccount {
+		return true
+	}
+	if err := tx.AcctMgmt(pam.DisallowNullAuthtok); err != nil {
+		// An expired password (ErrNewAuthtokReqd) also ends up here, it cannot be
+		// changed over a non-interactive connection.
+		klog.V(3).ErrorS(err, "pam account check failed", "user", user, "service", p.service)
+		return false
+	}
+	return true
+}
+
+// PamSession is an open PAM session
+type PamSession struct {
+	tx   *pam.Transaction
+	user string
+	// Env holds the variables set by the session modules, in KEY=VALUE form
+	Env []string
+}
+
+// OpenSession establishes credentials and opens a session for user
+func (p *PamAuthenticator) OpenSession(user, rhost string) (*PamSession, error) {
+	tx, err := p.start(user, "", rhost)
+	if err != nil {
+		return nil, fmt.Errorf("error starting pam transaction: %w", err)
+	}
+	if err := tx.SetCred(pam.EstablishCred); err != nil {
+		klog.V(3).ErrorS(err, "pam setcred failed", "user", user, "service", p.service)
+	}
+	if err := tx.OpenSession(0); err != nil {
+		endTransaction(tx, user)
+		return nil, fmt.Errorf("error opening pam session: %w", err)
+	}
+
+	session := &PamSession{tx: tx, user: user}
+	envs, err := tx.GetEnvList()
+	if err != nil {
+		klog.V(3).ErrorS(err, "failed to get pam environment", "user", user)
+	}
+	for k, v := range envs {
+		session.Env = append(session.Env, k+"="+v)
+	}
+	sort.Strings(session.Env)
+	return session, nil
+}
+
+// Close closes the session and deletes the credentials established for it
+func (s *PamSession) Close() error {
+	defer endTransaction(s.tx, s.user)
+	err := s.tx.CloseSession(0)
+	if cerr := s.tx.SetCred(pam.DeleteCred); cerr != nil {
+		klog.V(3).ErrorS(cerr, "pam delete credentials failed", "user", s.user)
+	}
+	return err
+}
+
+func endTransaction(tx *pam.Transaction, user string) {
+	if err := tx.End(); err != nil {
+		klog.V(3).ErrorS(err, "pam end failed", "user", user)
+	}
 }
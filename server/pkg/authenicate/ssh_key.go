@@ -8,6 +8,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/metrics"
 	"github.com/fsnotify/fsnotify"
 	"golang.org/x/crypto/ssh"
 	"k8s.io/klog/v2"
@@ -17,7 +18,8 @@ type SSHAuthenticator struct {
 	authorizedKeys     sync.Map // map[string]sync.Map map[string]ssh.PublicKey
 	authorizedFilePath string
 	watcher            *fsnotify.Watcher
-	subWriteEventChans map[string]chan fsnotify.Op
+	reloadTimersMu     sync.Mutex
+	reloadTimers       map[string]*time.Timer
 }
 
 func NewSSHAuthenticator(authorizedFilePath string) (*SSHAuthenticator, error) {
@@ -30,7 +32,7 @@ func NewSSHAuthenticator(authorizedFilePath string) (*SSHAuthenticator, error) {
 		authorizedKeys:     sync.Map{},
 		authorizedFilePath: authorizedFilePath,
 		watcher:            w,
-		subWriteEventChans: make(map[string]chan fsnotify.Op),
+		reloadTimers:       make(map[string]*time.Timer),
 	}
 	if authorizedFilePath != "" {
 		if err = w.Add(authorizedFilePath); err != nil {
@@ -42,11 +44,7 @@ func NewSSHAuthenticator(authorizedFilePath string) (*SSHAuthenticator, error) {
 	}
 
 	go authenicator.watchFile()
-	return &SSHAuthenticator{
-		authorizedKeys:     sync.Map{},
-		authorizedFilePath: authorizedFilePath,
-		watcher:            w,
-	}, nil
+	return authenicator, nil
 }
 
 func (s *SSHAuthenticator) watchFile() {
@@ -71,30 +69,29 @@ func (s *SSHAuthenticator) watchFile() {
 	}
 }
 
+// writeEventHandler reloads a file once writes to it have settled for a second
 func (s *SSHAuthenticator) writeEventHandler(event fsnotify.Event) {
-	ch, ok := s.subWriteEventChans[event.Name]
-	if !ok {
-		ch = make(chan fsnotify.Op)
-		s.subWriteEventChans[event.Name] = ch
-		go func() {
-			filePath := event.Name
-			timer := time.NewTimer(time.Second)
-			for {
-				select {
-				case op := <-ch:
-					if !timer.Reset(time.Second) {
-						klog.V(5).ErrorS(fmt.Errorf("timer expired"), "key", event.Name, "op", op)
-					}
-				case <-timer.C:
-					if err := s.loadAuthenticateKeysFromFile(filePath); err != nil {
-						klog.ErrorS(err, "failed to load authenticate keys from file", "file", filePath)
-					}
-					return
-				}
-			}
-		}()
+	s.reloadTimersMu.Lock()
+	defer s.reloadTimersMu.Unlock()
+
+	filePath := event.Name
+	if timer, ok := s.reloadTimers[filePath]; ok {
+		timer.Reset(time.Second)
+		return
 	}
-	ch <- fsnotify.Write
+	s.reloadTimers[filePath] = time.AfterFunc(time.Second, func() {
+		s.reloadTimersMu.Lock()
+		delete(s.reloadTimers, filePath)
+		s.reloadTimersMu.Unlock()
+
+		if err := s.loadAuthenticateKeysFromFile(filePath); err != nil {
+			klog.ErrorS(err, "failed to load authenticate keys from file", "file", filePath)
+			metrics.AuthorizedKeysReloads.WithLabelValues("failure").Inc()
+			return
+		}
+		klog.V(3).InfoS("reloaded authenticate keys", "file", filePath)
+		metrics.AuthorizedKeysReloads.WithLabelValues("success").Inc()
+	})
 }
 
 func (s *SSHAuthenticator) loadAuthenticateKeysFromFile(f string) error {
@@ -0,0 +1,120 @@
+// Package compression registers the gRPC compressors accepted by the server besides identity,
+// gzip and zstd, and recognises content that is not worth compressing again.
+package compression
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/grpc/encoding"
+	_ "google.golang.org/grpc/encoding/gzip" // registers the gzip compressor
+)
+
+// Zstd is the name of the zstd compressor, as sent in the grpc-encoding header
+const Zstd = "zstd"
+
+func init() {
+	encoding.RegisterCompressor(&zstdCompressor{})
+}
+
+// zstdCompressor implements encoding.Compressor, encoders and decoders are pooled as they
+// are expensive to create
+type zstdCompressor struct {
+	encoders sync.Pool
+	decoders sync.Pool
+}
+
+func (c *zstdCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	enc, ok := c.encoders.Get().(*zstd.Encoder)
+	if !ok {
+		var err error
+		enc, err = zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		enc.Reset(w)
+	}
+	return &zstdWriter{Encoder: enc, pool: &c.encoders}, nil
+}
+
+func (c *zstdCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	dec, ok := c.decoders.Get().(*zstd.Decoder)
+	if !ok {
+		var err error
+		dec, err = zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+	} else if err := dec.Reset(r); err != nil {
+		c.decoders.Put(dec)
+		return nil, err
+	}
+	return &zstdReader{Decoder: dec, pool: &c.decoders}, nil
+}
+
+func (c *zstdCompressor) Name() string {
+	return Zstd
+}
+
+type zstdWriter struct {
+	*zstd.Encoder
+	pool *sync.Pool
+}
+
+func (w *zstdWriter) Close() error {
+	defer w.pool.Put(w.Encoder)
+	return w.Encoder.Close()
+}
+
+// zstdReader returns its decoder to the pool once the message has been read
+type zstdReader struct {
+	*zstd.Decoder
+	pool *sync.Pool
+}
+
+func (r *zstdReader) Read(p []byte) (int, error) {
+	if r.Decoder == nil {
+		return 0, io.EOF
+	}
+	n, err := r.Decoder.Read(p)
+	if err == io.EOF {
+		r.pool.Put(r.Decoder)
+		r.Decoder = nil
+	}
+	return n, err
+}
+
+// magics are the leading bytes of common compressed formats
+var magics = [][]byte{
+	{0x1f, 0x8b},                        // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},            // zstd
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},    // xz
+	{'B', 'Z', 'h'},                     // bzip2
+	{0x04, 0x22, 0x4d, 0x18},            // lz4
+	{'P', 'K', 0x03, 0x04},              // zip, jar, docx
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c},  // 7z
+	{'R', 'a', 'r', '!', 0x1a, 0x07},    // rar
+	{0x89, 'P', 'N', 'G', '\r', '\n'},   // png
+	{0xff, 0xd8, 0xff},                  // jpeg
+	{'G', 'I', 'F', '8'},                // gif
+	{'%', 'P', 'D', 'F', '-'},           // pdf, usually deflated streams
+	{0xed, 0xab, 0xee, 0xdb},            // rpm, payload is compressed
+	{'!', '<', 'a', 'r', 'c', 'h', '>'}, // deb
+}
+
+// MagicSize is the number of leading bytes IsCompressed needs to recognise every format
+const MagicSize = 8
+
+// IsCompressed reports whether data starting with head is already compressed, so that
+// compressing it again would only cost CPU time
+func IsCompressed(head []byte) bool {
+	for _, magic := range magics {
+		if bytes.HasPrefix(head, magic) {
+			return true
+		}
+	}
+	return false
+}
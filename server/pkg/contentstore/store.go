@@ -0,0 +1,238 @@
+// Package contentstore keeps uploaded file contents by SHA-256 digest so that repeated
+// uploads of the same content can skip sending the data. Contents are kept per owner, a user
+// can only place content it uploaded itself, and the least recently used contents are evicted
+// once the store grows beyond its size limit.
+package contentstore
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DigestPrefix is the prefix of the digests handled by the store
+const DigestPrefix = "sha256:"
+
+var (
+	// ErrNotFound is returned for contents not in the store
+	ErrNotFound = errors.New("content not in store")
+	// ErrTooLarge is returned for contents larger than the whole store
+	ErrTooLarge = errors.New("content larger than the store")
+)
+
+type key struct {
+	owner  string
+	digest string
+}
+
+type entry struct {
+	key
+	size int64
+}
+
+// Store is a size bounded content store in a directory owned by the daemon
+type Store struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // Most recently used first
+	entries map[key]*list.Element
+}
+
+// Open opens the store in dir, creating it when missing, and indexes the contents already in
+// it by their modification time
+func Open(dir string, maxSize int64) (*Store, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("invalid content store size %d", maxSize)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create content store: %w", err)
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to restrict content store: %w", err)
+	}
+
+	s := &Store{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[key]*list.Element),
+	}
+
+	type found struct {
+		entry
+		mtime time.Time
+	}
+	var contents []found
+	owners, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read content store: %w", err)
+	}
+	for _, owner := range owners {
+		if !owner.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(dir, owner.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read content store: %w", err)
+		}
+		for _, f := range files {
+			path := filepath.Join(dir, owner.Name(), f.Name())
+			if _, err := parseHex(f.Name()); err != nil || !f.Type().IsRegular() {
+				// Left over from an interrupted Add
+				os.Remove(path)
+				continue
+			}
+			st, err := f.Info()
+			if err != nil {
+				continue
+			}
+			contents = append(contents, found{
+				entry: entry{key: key{owner: owner.Name(), digest: f.Name()}, size: st.Size()},
+				mtime: st.ModTime(),
+			})
+		}
+	}
+	sort.Slice(contents, func(i, j int) bool { return contents[i].mtime.After(contents[j].mtime) })
+	for _, c := range contents {
+		s.entries[c.key] = s.lru.PushBack(&c.entry)
+		s.size += c.size
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict()
+	return s, nil
+}
+
+// ParseDigest returns the hex SHA-256 digest of a "sha256:<hex>" digest
+func ParseDigest(digest string) (string, error) {
+	hexDigest, ok := strings.CutPrefix(digest, DigestPrefix)
+	if !ok {
+		return "", fmt.Errorf("unsupported digest %q, expected %s<hex>", digest, DigestPrefix)
+	}
+	return parseHex(strings.ToLower(hexDigest))
+}
+
+func parseHex(hexDigest string) (string, error) {
+	if b, err := hex.DecodeString(hexDigest); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("invalid SHA-256 digest %q", hexDigest)
+	}
+	return hexDigest, nil
+}
+
+// Has reports whether owner stored the content with the hex digest
+func (s *Store) Has(owner, digest string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.touch(key{owner: owner, digest: digest})
+	return ok
+}
+
+// Open opens the content with the hex digest stored by owner. Contents evicted while open
+// stay readable.
+func (s *Store) Open(owner, digest string) (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.touch(key{owner: owner, digest: digest})
+	if !ok {
+		return nil, ErrNotFound
+	}
+	f, err := os.Open(s.path(e.key))
+	if errors.Is(err, os.ErrNotExist) {
+		// Removed behind the store's back
+		s.remove(s.entries[e.key])
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// Add stores size bytes read from r as content of owner with the hex digest, failing when
+// they do not match the digest
+func (s *Store) Add(owner, digest string, r io.Reader, size int64) error {
+	if size > s.maxSize {
+		return ErrTooLarge
+	}
+	if s.Has(owner, digest) {
+		return nil
+	}
+
+	k := key{owner: owner, digest: digest}
+	if err := os.MkdirAll(filepath.Dir(s.path(k)), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path(k)), ".add-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(r, size))
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("content is %d bytes, expected %d", n, size)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != digest {
+		return fmt.Errorf("content digest %s does not match %s", got, digest)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path(k)); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[k]; !ok {
+		s.entries[k] = s.lru.PushFront(&entry{key: k, size: size})
+		s.size += size
+	}
+	s.evict()
+	return nil
+}
+
+func (s *Store) path(k key) string {
+	return filepath.Join(s.dir, k.owner, k.digest)
+}
+
+// touch marks k as most recently used, also on disk so the order survives restarts
+func (s *Store) touch(k key) (*entry, bool) {
+	el, ok := s.entries[k]
+	if !ok {
+		return nil, false
+	}
+	s.lru.MoveToFront(el)
+	now := time.Now()
+	_ = os.Chtimes(s.path(k), now, now)
+	return el.Value.(*entry), true
+}
+
+func (s *Store) remove(el *list.Element) {
+	e := s.lru.Remove(el).(*entry)
+	delete(s.entries, e.key)
+	s.size -= e.size
+	_ = os.Remove(s.path(e.key))
+}
+
+// evict removes the least recently used contents until the store fits its size
+func (s *Store) evict() {
+	for s.size > s.maxSize {
+		s.remove(s.lru.Back())
+	}
+}
@@ -0,0 +1,242 @@
+package contentstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func digestOf(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func add(t *testing.T, s *Store, owner, content string) string {
+	t.Helper()
+	digest := digestOf(content)
+	if err := s.Add(owner, digest, strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("Add(%q, %q): %v", owner, content, err)
+	}
+	return digest
+}
+
+func read(t *testing.T, s *Store, owner, digest string) (string, error) {
+	t.Helper()
+	f, err := s.Open(owner, digest)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	return string(data), err
+}
+
+func TestParseDigest(t *testing.T) {
+	digest := digestOf("x")
+	tests := []struct {
+		digest  string
+		want    string
+		wantErr bool
+	}{
+		{digest: "sha256:" + digest, want: digest},
+		{digest: "sha256:" + strings.ToUpper(digest), want: digest},
+		{digest: digest, wantErr: true},
+		{digest: "md5:" + digest, wantErr: true},
+		{digest: "sha256:" + digest[:10], wantErr: true},
+		{digest: "sha256:" + digest[:62] + "zz", wantErr: true},
+		{digest: "sha256:../" + digest[3:], wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseDigest(tt.digest)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseDigest(%q) = %q, %v, want %q, error %v", tt.digest, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestAdd(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "store"), 100)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		digest  string
+		content string
+		size    int64
+		stored  bool
+		wantErr error
+	}{
+		{name: "stored", digest: digestOf("hello"), content: "hello", size: 5, stored: true},
+		{name: "stored again", digest: digestOf("hello"), content: "hello", size: 5, stored: true},
+		{name: "digest mismatch", digest: digestOf("other"), content: "hello", size: 5},
+		{name: "short content", digest: digestOf("world"), content: "worl", size: 5},
+		{name: "read up to size", digest: digestOf("hell"), content: "hello", size: 4, stored: true},
+		{name: "too large", digest: digestOf(strings.Repeat("x", 101)), content: strings.Repeat("x", 101), size: 101, wantErr: ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.Add("alice", tt.digest, strings.NewReader(tt.content), tt.size)
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Add error %v, want %v", err, tt.wantErr)
+				}
+			case tt.stored && err != nil:
+				t.Fatalf("Add: %v", err)
+			case !tt.stored && err == nil:
+				t.Fatalf("Add of mismatching content succeeded")
+			}
+			if s.Has("alice", tt.digest) != tt.stored {
+				t.Errorf("content stored %v, want %v", !tt.stored, tt.stored)
+			}
+		})
+	}
+
+	if got, err := read(t, s, "alice", digestOf("hello")); err != nil || got != "hello" {
+		t.Errorf("Open = %q, %v, want hello", got, err)
+	}
+	// Nothing is left behind by the failed adds
+	files, err := os.ReadDir(filepath.Join(s.dir, "alice"))
+	if err != nil || len(files) != 2 || s.size != 9 {
+		t.Errorf("store holds %v, %v, size %d, want the two contents", files, err, s.size)
+	}
+}
+
+func TestOwners(t *testing.T) {
+	s, err := Open(t.TempDir(), 100)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	digest := add(t, s, "alice", "secret")
+
+	if s.Has("bob", digest) {
+		t.Errorf("bob has alice's content")
+	}
+	if _, err := s.Open("bob", digest); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open of alice's content by bob: %v, want %v", err, ErrNotFound)
+	}
+	if _, err := s.Open("alice", digestOf("missing")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open of missing content: %v, want %v", err, ErrNotFound)
+	}
+
+	// The same content is kept per owner
+	add(t, s, "bob", "secret")
+	if s.size != 12 {
+		t.Errorf("store size %d, want 12", s.size)
+	}
+	if !s.Has("alice", digest) || !s.Has("bob", digest) {
+		t.Errorf("content missing for one of its owners")
+	}
+}
+
+func TestEviction(t *testing.T) {
+	s, err := Open(t.TempDir(), 10)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	a := add(t, s, "alice", "aaaa")
+	b := add(t, s, "alice", "bbbb")
+	// Using a makes b the least recently used content
+	if !s.Has("alice", a) {
+		t.Fatalf("content a missing")
+	}
+	c := add(t, s, "bob", "cccc")
+
+	want := map[string]bool{a: true, b: false, c: true}
+	for digest, present := range want {
+		owner := "alice"
+		if digest == c {
+			owner = "bob"
+		}
+		if s.Has(owner, digest) != present {
+			t.Errorf("content %s present %v, want %v", digest[:8], !present, present)
+		}
+		if _, err := os.Stat(s.path(key{owner: owner, digest: digest})); (err == nil) != present {
+			t.Errorf("file of content %s: %v, want present %v", digest[:8], err, present)
+		}
+	}
+	if s.size != 8 {
+		t.Errorf("store size %d, want 8", s.size)
+	}
+
+	// Contents removed behind the store's back are dropped on Open
+	if err := os.Remove(s.path(key{owner: "alice", digest: a})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Open("alice", a); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open of removed content: %v, want %v", err, ErrNotFound)
+	}
+	if s.Has("alice", a) || s.size != 4 {
+		t.Errorf("removed content still indexed, store size %d", s.size)
+	}
+}
+
+func TestOpenIndexesContents(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 100)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	old := add(t, s, "alice", "old content")
+	recent := add(t, s, "alice", "recent content")
+	now := time.Now()
+	if err := os.Chtimes(s.path(key{owner: "alice", digest: old}), now.Add(-time.Hour), now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	// Leftovers of an interrupted Add
+	leftover := filepath.Join(dir, "alice", ".add-123")
+	if err := os.WriteFile(leftover, []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopened too small for both, the older content is evicted
+	s, err = Open(dir, int64(len("recent content")))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if s.Has("alice", old) || !s.Has("alice", recent) {
+		t.Errorf("reopened store has old %v, recent %v, want only the recent content", s.Has("alice", old), s.Has("alice", recent))
+	}
+	if got, err := read(t, s, "alice", recent); err != nil || got != "recent content" {
+		t.Errorf("Open = %q, %v", got, err)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("leftover of an interrupted Add kept: %v", err)
+	}
+	if st, err := os.Stat(dir); err != nil || st.Mode().Perm() != 0700 {
+		t.Errorf("store directory %v, %v, want mode 0700", st, err)
+	}
+
+	if _, err := Open(dir, 0); err == nil {
+		t.Errorf("Open with size 0 succeeded")
+	}
+}
+
+func TestOpenWhileEvicted(t *testing.T) {
+	s, err := Open(t.TempDir(), 4)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	a := add(t, s, "alice", "aaaa")
+	f, err := s.Open("alice", a)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	add(t, s, "alice", "bbbb")
+	if s.Has("alice", a) {
+		t.Fatalf("content a not evicted")
+	}
+	if data, err := io.ReadAll(f); err != nil || !bytes.Equal(data, []byte("aaaa")) {
+		t.Errorf("evicted open content reads %q, %v", data, err)
+	}
+}
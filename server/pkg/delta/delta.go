@@ -0,0 +1,272 @@
+// Package delta implements rsync-style delta transfers: the receiver describes the file it
+// already has by per-block signatures, the sender expresses the new file as copies of
+// matching blocks and literal data, and the receiver rebuilds it from both.
+package delta
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// MinBlockSize and MaxBlockSize bound the block sizes accepted for signatures
+	MinBlockSize = 512
+	MaxBlockSize = 1 << 20
+
+	// maxLiteral bounds the literal data carried by a single Op
+	maxLiteral = 256 * 1024
+)
+
+// Block is the signature of one block of the base file
+type Block struct {
+	Weak   uint32
+	Strong []byte
+}
+
+// Op is one instruction to rebuild the new file: either Literal data, or Count blocks of the
+// base file starting at block Index
+type Op struct {
+	Index   int64
+	Count   int64
+	Literal []byte
+}
+
+// BlockSize picks a block size for a base file of size bytes: the power of two closest above
+// its square root, so the number of blocks and the block size grow together
+func BlockSize(size int64) int {
+	bs := int64(MinBlockSize)
+	for bs*bs < size && bs < MaxBlockSize {
+		bs *= 2
+	}
+	return int(bs)
+}
+
+// ValidBlockSize checks that bs is within the accepted bounds
+func ValidBlockSize(bs int) error {
+	if bs < MinBlockSize || bs > MaxBlockSize {
+		return fmt.Errorf("block size %d is outside of [%d, %d]", bs, MinBlockSize, MaxBlockSize)
+	}
+	return nil
+}
+
+// strongSum returns the strong checksum of a block
+func strongSum(block []byte) []byte {
+	sum := sha256.Sum256(block)
+	return sum[:]
+}
+
+// Signatures reads the base file from r and calls fn with the signature of every block of
+// blockSize bytes, the last block may be shorter
+func Signatures(r io.Reader, blockSize int, fn func(Block) error) error {
+	if err := ValidBlockSize(blockSize); err != nil {
+		return err
+	}
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := fn(Block{Weak: newRolling(buf[:n]).Sum(), Strong: strongSum(buf[:n])}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Diff reads the new file from r and calls emit with the operations rebuilding it from a
+// base file with the given block signatures. Literal data passed to emit is only valid
+// during the call.
+func Diff(r io.Reader, blockSize int, blocks []Block, emit func(Op) error) error {
+	if err := ValidBlockSize(blockSize); err != nil {
+		return err
+	}
+	index := make(map[uint32][]int64, len(blocks))
+	for i, b := range blocks {
+		index[b.Weak] = append(index[b.Weak], int64(i))
+	}
+
+	var (
+		d     = &differ{emit: emit}
+		buf   = make([]byte, 0, 4*blockSize)
+		start int // start of the window in buf
+		eof   bool
+	)
+	// fill reads ahead until buf holds a whole window after start, or the input ends
+	fill := func() error {
+		for len(buf)-start < blockSize && !eof {
+			if cap(buf)-len(buf) < blockSize {
+				n := copy(buf, buf[start:])
+				buf, start = buf[:n], 0
+			}
+			n, err := r.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	window := func() []byte {
+		return buf[start:min(len(buf), start+blockSize)]
+	}
+
+	if err := fill(); err != nil {
+		return err
+	}
+	roll := newRolling(window())
+	for start < len(buf) {
+		if match, ok := findBlock(index, blocks, roll.Sum(), window()); ok {
+			if err := d.copyBlock(match); err != nil {
+				return err
+			}
+			// Start over with a fresh window after the matched block
+			start += len(window())
+			if err := fill(); err != nil {
+				return err
+			}
+			roll = newRolling(window())
+			continue
+		}
+
+		// No match, the first byte of the window becomes literal data
+		out := buf[start]
+		if err := d.literalByte(out); err != nil {
+			return err
+		}
+		start++
+		if err := fill(); err != nil {
+			return err
+		}
+		if start+blockSize <= len(buf) {
+			roll.Roll(out, buf[start+blockSize-1])
+		} else {
+			// Near the end the window shrinks, so a short last block can still match
+			roll.RollOut(out)
+		}
+	}
+	return d.flush()
+}
+
+func findBlock(index map[uint32][]int64, blocks []Block, weak uint32, window []byte) (int64, bool) {
+	candidates, ok := index[weak]
+	if !ok {
+		return 0, false
+	}
+	strong := strongSum(window)
+	for _, i := range candidates {
+		if bytes.Equal(blocks[i].Strong, strong) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// differ merges consecutive block copies and literal bytes into as few operations as possible
+type differ struct {
+	emit    func(Op) error
+	literal []byte
+	copyOp  *Op
+}
+
+func (d *differ) copyBlock(i int64) error {
+	if err := d.flushLiteral(); err != nil {
+		return err
+	}
+	if d.copyOp != nil && d.copyOp.Index+d.copyOp.Count == i {
+		d.copyOp.Count++
+		return nil
+	}
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	d.copyOp = &Op{Index: i, Count: 1}
+	return nil
+}
+
+func (d *differ) literalByte(c byte) error {
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	d.literal = append(d.literal, c)
+	if len(d.literal) >= maxLiteral {
+		return d.flushLiteral()
+	}
+	return nil
+}
+
+func (d *differ) flushCopy() error {
+	if d.copyOp == nil {
+		return nil
+	}
+	op := *d.copyOp
+	d.copyOp = nil
+	return d.emit(op)
+}
+
+func (d *differ) flushLiteral() error {
+	if len(d.literal) == 0 {
+		return nil
+	}
+	err := d.emit(Op{Literal: d.literal})
+	d.literal = d.literal[:0]
+	return err
+}
+
+func (d *differ) flush() error {
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	return d.flushLiteral()
+}
+
+// Patcher rebuilds a file from a base file and a sequence of operations
+type Patcher struct {
+	base      io.ReaderAt
+	baseSize  int64
+	blockSize int64
+	buf       []byte
+}
+
+// NewPatcher returns a Patcher copying blocks of blockSize bytes from base, which holds
+// baseSize bytes
+func NewPatcher(base io.ReaderAt, baseSize int64, blockSize int) (*Patcher, error) {
+	if err := ValidBlockSize(blockSize); err != nil {
+		return nil, err
+	}
+	return &Patcher{base: base, baseSize: baseSize, blockSize: int64(blockSize), buf: make([]byte, blockSize)}, nil
+}
+
+// Apply writes the data described by op to w and returns the number of bytes written
+func (p *Patcher) Apply(w io.Writer, op Op) (int64, error) {
+	if len(op.Literal) > 0 {
+		n, err := w.Write(op.Literal)
+		return int64(n), err
+	}
+	if op.Index < 0 || op.Count <= 0 {
+		return 0, fmt.Errorf("invalid block range %d+%d", op.Index, op.Count)
+	}
+	start := op.Index * p.blockSize
+	end := (op.Index + op.Count) * p.blockSize
+	if end > p.baseSize {
+		// Only the last block of the base file may be short
+		if end-p.blockSize >= p.baseSize {
+			return 0, fmt.Errorf("block range %d+%d is outside of the base file", op.Index, op.Count)
+		}
+		end = p.baseSize
+	}
+	n, err := io.CopyBuffer(w, io.NewSectionReader(p.base, start, end-start), p.buf)
+	if err == nil && n != end-start {
+		err = errors.New("base file changed while patching")
+	}
+	return n, err
+}
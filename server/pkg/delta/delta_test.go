@@ -0,0 +1,247 @@
+package delta
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+const testBlockSize = MinBlockSize
+
+func randomBytes(seed int64, n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// roundTrip diffs newData against the signatures of base, rebuilds it with a Patcher and
+// returns the result along with the number of literal bytes sent
+func roundTrip(t *testing.T, base, newData []byte, blockSize int) ([]byte, int) {
+	t.Helper()
+	var blocks []Block
+	err := Signatures(bytes.NewReader(base), blockSize, func(b Block) error {
+		blocks = append(blocks, b)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Signatures: %v", err)
+	}
+
+	p, err := NewPatcher(bytes.NewReader(base), int64(len(base)), blockSize)
+	if err != nil {
+		t.Fatalf("NewPatcher: %v", err)
+	}
+	var out bytes.Buffer
+	literal := 0
+	err = Diff(bytes.NewReader(newData), blockSize, blocks, func(op Op) error {
+		literal += len(op.Literal)
+		n, err := p.Apply(&out, op)
+		if err != nil {
+			return err
+		}
+		if op.Literal != nil && n != int64(len(op.Literal)) {
+			t.Errorf("Apply wrote %d of %d literal bytes", n, len(op.Literal))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+	return out.Bytes(), literal
+}
+
+func TestRoundTrip(t *testing.T) {
+	bs := testBlockSize
+	base := randomBytes(1, 8*bs)
+	short := randomBytes(2, 5*bs+100)
+	insert := randomBytes(3, 10)
+
+	tests := []struct {
+		name    string
+		base    []byte
+		newData []byte
+		// maxLiteral bounds the literal bytes a good diff needs
+		maxLiteral int
+	}{
+		{name: "identical", base: base, newData: base, maxLiteral: 0},
+		{name: "empty base", base: nil, newData: base, maxLiteral: len(base)},
+		{name: "empty new file", base: base, newData: nil, maxLiteral: 0},
+		{name: "both empty", base: nil, newData: nil, maxLiteral: 0},
+		{name: "append", base: base, newData: concat(base, insert), maxLiteral: len(insert)},
+		{name: "prepend", base: base, newData: concat(insert, base), maxLiteral: len(insert)},
+		{name: "insert at block boundary", base: base, newData: concat(base[:3*bs], insert, base[3*bs:]), maxLiteral: len(insert)},
+		{name: "insert before block boundary", base: base, newData: concat(base[:3*bs-1], insert, base[3*bs-1:]), maxLiteral: bs + len(insert)},
+		{name: "insert after block boundary", base: base, newData: concat(base[:3*bs+1], insert, base[3*bs+1:]), maxLiteral: bs + len(insert)},
+		{name: "delete block at boundary", base: base, newData: concat(base[:2*bs], base[3*bs:]), maxLiteral: 0},
+		{name: "delete across boundary", base: base, newData: concat(base[:2*bs+7], base[3*bs+7:]), maxLiteral: 2 * bs},
+		{name: "change last byte of block", base: base, newData: concat(base[:bs-1], []byte{^base[bs-1]}, base[bs:]), maxLiteral: bs},
+		{name: "change first byte of block", base: base, newData: concat(base[:bs], []byte{^base[bs]}, base[bs+1:]), maxLiteral: bs},
+		{name: "swap blocks", base: base, newData: concat(base[4*bs:], base[:4*bs]), maxLiteral: 0},
+		{name: "repeat block", base: base, newData: concat(base[:bs], base[:bs], base[:bs]), maxLiteral: 0},
+		{name: "short last block unchanged", base: short, newData: short, maxLiteral: 0},
+		// The short block only matches at the end of the new file, where the window shrinks
+		{name: "short last block moved", base: short, newData: concat(short[5*bs:], short[:5*bs]), maxLiteral: 100},
+		{name: "truncate mid block", base: base, newData: base[:5*bs+200], maxLiteral: 200},
+		{name: "smaller than a block", base: base[:100], newData: base[:100], maxLiteral: 0},
+		{name: "unrelated", base: base, newData: randomBytes(4, 3*bs+17), maxLiteral: 3*bs + 17},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, literal := roundTrip(t, tt.base, tt.newData, bs)
+			if !bytes.Equal(got, tt.newData) {
+				t.Fatalf("rebuilt %d bytes differing from the %d bytes of the new file", len(got), len(tt.newData))
+			}
+			if literal > tt.maxLiteral {
+				t.Errorf("sent %d literal bytes, want at most %d", literal, tt.maxLiteral)
+			}
+		})
+	}
+}
+
+func TestRoundTripLargeLiteral(t *testing.T) {
+	// Literal runs longer than maxLiteral are split over several operations
+	newData := randomBytes(5, 2*maxLiteral+3)
+	var ops int
+	err := Diff(bytes.NewReader(newData), testBlockSize, nil, func(op Op) error {
+		if len(op.Literal) > maxLiteral {
+			t.Errorf("literal of %d bytes exceeds %d", len(op.Literal), maxLiteral)
+		}
+		ops++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+	if ops != 3 {
+		t.Errorf("got %d operations, want 3", ops)
+	}
+	if got, _ := roundTrip(t, nil, newData, testBlockSize); !bytes.Equal(got, newData) {
+		t.Errorf("rebuilt data differs")
+	}
+}
+
+func TestRolling(t *testing.T) {
+	data := randomBytes(6, 300)
+	const window = 64
+
+	r := newRolling(data[:window])
+	for i := 1; i+window <= len(data); i++ {
+		r.Roll(data[i-1], data[i+window-1])
+		if want := newRolling(data[i : i+window]).Sum(); r.Sum() != want {
+			t.Fatalf("rolled sum at %d is %08x, want %08x", i, r.Sum(), want)
+		}
+	}
+	// Shrinking the window at the end of the data
+	for i := len(data) - window + 1; i < len(data); i++ {
+		r.RollOut(data[i-1])
+		if want := newRolling(data[i:]).Sum(); r.Sum() != want {
+			t.Fatalf("shrunk sum at %d is %08x, want %08x", i, r.Sum(), want)
+		}
+	}
+}
+
+func TestPatcherApply(t *testing.T) {
+	bs := testBlockSize
+	base := randomBytes(7, 3*bs+10)
+
+	tests := []struct {
+		name    string
+		op      Op
+		want    []byte
+		wantErr bool
+	}{
+		{name: "first block", op: Op{Index: 0, Count: 1}, want: base[:bs]},
+		{name: "block range", op: Op{Index: 1, Count: 2}, want: base[bs : 3*bs]},
+		{name: "short last block", op: Op{Index: 3, Count: 1}, want: base[3*bs:]},
+		{name: "range ending in short block", op: Op{Index: 2, Count: 2}, want: base[2*bs:]},
+		{name: "literal", op: Op{Literal: []byte("abc")}, want: []byte("abc")},
+		{name: "negative index", op: Op{Index: -1, Count: 1}, wantErr: true},
+		{name: "zero count", op: Op{Index: 0, Count: 0}, wantErr: true},
+		{name: "block past the end", op: Op{Index: 4, Count: 1}, wantErr: true},
+		{name: "range past the end", op: Op{Index: 2, Count: 3}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPatcher(bytes.NewReader(base), int64(len(base)), bs)
+			if err != nil {
+				t.Fatalf("NewPatcher: %v", err)
+			}
+			var out bytes.Buffer
+			n, err := p.Apply(&out, tt.op)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Apply(%+v) succeeded, want an error", tt.op)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply(%+v): %v", tt.op, err)
+			}
+			if n != int64(len(tt.want)) || !bytes.Equal(out.Bytes(), tt.want) {
+				t.Errorf("Apply(%+v) wrote %d bytes, want %d", tt.op, n, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestPatcherBaseChanged(t *testing.T) {
+	bs := testBlockSize
+	base := randomBytes(8, 2*bs)
+	// The base shrank after its size was taken
+	p, err := NewPatcher(bytes.NewReader(base[:bs+10]), int64(len(base)), bs)
+	if err != nil {
+		t.Fatalf("NewPatcher: %v", err)
+	}
+	if _, err := p.Apply(&bytes.Buffer{}, Op{Index: 1, Count: 1}); err == nil {
+		t.Errorf("Apply on a shrunk base succeeded")
+	}
+}
+
+func TestBlockSize(t *testing.T) {
+	tests := []struct {
+		size int64
+		want int
+	}{
+		{size: 0, want: MinBlockSize},
+		{size: MinBlockSize * MinBlockSize, want: MinBlockSize},
+		{size: MinBlockSize*MinBlockSize + 1, want: 2 * MinBlockSize},
+		{size: 1 << 30, want: 1 << 15},
+		{size: 1 << 50, want: MaxBlockSize},
+	}
+	for _, tt := range tests {
+		if got := BlockSize(tt.size); got != tt.want {
+			t.Errorf("BlockSize(%d) = %d, want %d", tt.size, got, tt.want)
+		}
+		if err := ValidBlockSize(BlockSize(tt.size)); err != nil {
+			t.Errorf("BlockSize(%d) is invalid: %v", tt.size, err)
+		}
+	}
+}
+
+func TestValidBlockSize(t *testing.T) {
+	tests := []struct {
+		bs    int
+		valid bool
+	}{
+		{bs: MinBlockSize - 1, valid: false},
+		{bs: MinBlockSize, valid: true},
+		{bs: 4096, valid: true},
+		{bs: MaxBlockSize, valid: true},
+		{bs: MaxBlockSize + 1, valid: false},
+	}
+	for _, tt := range tests {
+		if err := ValidBlockSize(tt.bs); (err == nil) != tt.valid {
+			t.Errorf("ValidBlockSize(%d) = %v, want valid %v", tt.bs, err, tt.valid)
+		}
+	}
+	if err := Signatures(bytes.NewReader(nil), 1, func(Block) error { return nil }); err == nil {
+		t.Errorf("Signatures accepted block size 1")
+	}
+	if err := Diff(bytes.NewReader(nil), 1, nil, func(Op) error { return nil }); err == nil {
+		t.Errorf("Diff accepted block size 1")
+	}
+}
@@ -0,0 +1,35 @@
+package delta
+
+// rolling is the weak checksum of rsync, an Adler-32 variant that can be moved along the
+// data one byte at a time
+type rolling struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRolling(block []byte) *rolling {
+	r := &rolling{n: uint32(len(block))}
+	for i, c := range block {
+		r.a += uint32(c)
+		r.b += uint32(len(block)-i) * uint32(c)
+	}
+	return r
+}
+
+// Roll moves the window by one byte, dropping out and appending in
+func (r *rolling) Roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+// RollOut shrinks the window by dropping its first byte out
+func (r *rolling) RollOut(out byte) {
+	r.a -= uint32(out)
+	r.b -= r.n * uint32(out)
+	r.n--
+}
+
+// Sum returns the checksum of the current window
+func (r *rolling) Sum() uint32 {
+	return (r.b&0xffff)<<16 | r.a&0xffff
+}
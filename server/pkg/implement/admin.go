@@ -0,0 +1,71 @@
+package implement
+
+import (
+	"context"
+	"os/user"
+
+	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"k8s.io/klog/v2"
+)
+
+// AdminServer implements pb.AdminServiceServer on top of a Server
+type AdminServer struct {
+	pb.UnimplementedAdminServiceServer
+	server *Server
+}
+
+// NewAdminServer creates the administrative service for s
+func NewAdminServer(s *Server) *AdminServer {
+	return &AdminServer{server: s}
+}
+
+// ListBannedClients returns the sources currently banned by the authentication limiter
+func (a *AdminServer) ListBannedClients(ctx context.Context, req *pb.ListBannedClientsRequest) (*pb.ListBannedClientsResponse, error) {
+	if err := requireRoot(ctx); err != nil {
+		return nil, err
+	}
+
+	resp := &pb.ListBannedClientsResponse{}
+	if a.server.AuthLimiter == nil {
+		return resp, nil
+	}
+	for _, b := range a.server.AuthLimiter.Banned() {
+		resp.Clients = append(resp.Clients, &pb.BannedClient{
+			Kind:        b.Kind,
+			Source:      b.Source,
+			Failures:    int32(b.Failures),
+			BannedUntil: timestamppb.New(b.Until),
+		})
+	}
+	klog.V(5).InfoS("Listed banned clients", "count", len(resp.Clients))
+	return resp, nil
+}
+
+// ListTransfers returns the file transfers currently running
+func (a *AdminServer) ListTransfers(ctx context.Context, req *pb.ListTransfersRequest) (*pb.ListTransfersResponse, error) {
+	if err := requireRoot(ctx); err != nil {
+		return nil, err
+	}
+	resp := &pb.ListTransfersResponse{Transfers: a.server.transfers.list()}
+	klog.V(5).InfoS("Listed running transfers", "count", len(resp.Transfers))
+	return resp, nil
+}
+
+// requireRoot rejects callers that are not authenticated as uid 0
+func requireRoot(ctx context.Context) error {
+	auth, err := GetAuthInfoFromContext(ctx)
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "invalid auth info: %v", err)
+	}
+	u, err := user.Lookup(auth.User)
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "user lookup failed: %v", err)
+	}
+	if u.Uid != "0" {
+		return status.Errorf(codes.PermissionDenied, "admin service requires root")
+	}
+	return nil
+}
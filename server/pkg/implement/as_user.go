@@ -0,0 +1,136 @@
+package implement
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/policy"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/utils"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"k8s.io/klog/v2"
+)
+
+// fsIdentity is the filesystem identity of a thread: fsuid, fsgid and supplementary groups
+type fsIdentity struct {
+	uid, gid int
+	groups   []int
+}
+
+// userIdentity returns the filesystem identity of username
+func userIdentity(username string) (fsIdentity, error) {
+	u, err := utils.LookupUser(username)
+	if err != nil {
+		return fsIdentity{}, fmt.Errorf("user lookup failed: %w", err)
+	}
+	id := fsIdentity{}
+	if id.uid, err = strconv.Atoi(u.Uid); err != nil {
+		return fsIdentity{}, fmt.Errorf("invalid uid: %w", err)
+	}
+	if id.gid, err = strconv.Atoi(u.Gid); err != nil {
+		return fsIdentity{}, fmt.Errorf("invalid gid: %w", err)
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return fsIdentity{}, fmt.Errorf("failed to lookup groups of %q: %w", username, err)
+	}
+	for _, g := range gids {
+		gid, err := strconv.Atoi(g)
+		if err != nil {
+			return fsIdentity{}, fmt.Errorf("invalid gid %q: %w", g, err)
+		}
+		id.groups = append(id.groups, gid)
+	}
+	return id, nil
+}
+
+// runAsUser runs fn with the filesystem permissions of username. The daemon keeps its own
+// identity, only the thread running fn switches its fsuid, fsgid and supplementary groups,
+// which also drops root's file capabilities for the duration of fn. fn must not start
+// goroutines doing file I/O on the user's behalf, they would run with the daemon's identity.
+func runAsUser(username string, fn func() error) error {
+	id, err := userIdentity(username)
+	if err != nil {
+		return err
+	}
+	if id.uid == os.Geteuid() {
+		return fn()
+	}
+
+	runtime.LockOSThread()
+	saved, err := currentFSIdentity()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	if err := setFSIdentity(id); err != nil {
+		if rerr := setFSIdentity(saved); rerr != nil {
+			// Leave the thread locked, the runtime discards it when this goroutine ends
+			klog.ErrorS(rerr, "Failed to restore thread identity", "uid", saved.uid)
+			return err
+		}
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to switch to user %q: %w", username, err)
+	}
+	defer func() {
+		if err := setFSIdentity(saved); err != nil {
+			klog.ErrorS(err, "Failed to restore thread identity", "uid", saved.uid)
+			return
+		}
+		runtime.UnlockOSThread()
+	}()
+	return fn()
+}
+
+// fileErrorCode maps the error of a file operation done as the user to a status code,
+// permission and existence errors keep their meaning, special files and missing filesystem
+// support fail the precondition, full filesystems exhaust a resource, partial files in use by
+// another upload abort, everything else becomes fallback
+func fileErrorCode(err error, fallback codes.Code) codes.Code {
+	switch {
+	case errors.Is(err, os.ErrPermission), errors.Is(err, policy.ErrOutside):
+		return codes.PermissionDenied
+	case errors.Is(err, os.ErrNotExist):
+		return codes.NotFound
+	case errors.Is(err, errNotRegular), errors.Is(err, unix.ENOTSUP):
+		return codes.FailedPrecondition
+	case errors.Is(err, unix.ENOSPC), errors.Is(err, unix.EDQUOT):
+		return codes.ResourceExhausted
+	case errors.Is(err, errPartialInUse):
+		return codes.Aborted
+	default:
+		return fallback
+	}
+}
+
+func currentFSIdentity() (fsIdentity, error) {
+	groups, err := unix.Getgroups()
+	if err != nil {
+		return fsIdentity{}, fmt.Errorf("failed to get groups: %w", err)
+	}
+	// An invalid id leaves the current one in place and returns it
+	uid, _ := unix.SetfsuidRetUid(-1)
+	gid, _ := unix.SetfsgidRetGid(-1)
+	return fsIdentity{uid: uid, gid: gid, groups: groups}, nil
+}
+
+// setFSIdentity switches the identity of the calling thread. unix.Setgroups, unlike
+// syscall.Setgroups, only affects the calling thread.
+func setFSIdentity(id fsIdentity) error {
+	if err := unix.Setgroups(id.groups); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	// setfsuid and setfsgid do not report failures, check the result instead
+	_ = unix.Setfsgid(id.gid)
+	if gid, _ := unix.SetfsgidRetGid(-1); gid != id.gid {
+		return fmt.Errorf("setfsgid %d failed", id.gid)
+	}
+	_ = unix.Setfsuid(id.uid)
+	if uid, _ := unix.SetfsuidRetUid(-1); uid != id.uid {
+		return fmt.Errorf("setfsuid %d failed", id.uid)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package implement
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"syscall"
+	"testing"
+)
+
+func TestRunAsUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("switching to another user requires root")
+	}
+	nobody, err := userIdentity("nobody")
+	if err != nil {
+		t.Skipf("no user nobody: %v", err)
+	}
+	// nobody needs to get through the parent directory of t.TempDir too
+	dir := t.TempDir()
+	if err := os.Chmod(filepath.Dir(dir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	errFailed := errors.New("failed")
+	tests := []struct {
+		name    string
+		fnErr   error
+		wantErr error
+	}{
+		{name: "success"},
+		{name: "error", fnErr: errFailed, wantErr: errFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Stay on the thread runAsUser switches to check it is restored afterwards
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+			before, err := currentFSIdentity()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join(dir, tt.name)
+			var during fsIdentity
+			err = runAsUser("nobody", func() (err error) {
+				if during, err = currentFSIdentity(); err != nil {
+					return err
+				}
+				if err := os.WriteFile(path, nil, 0644); err != nil {
+					return err
+				}
+				return tt.fnErr
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("runAsUser error %v, want %v", err, tt.wantErr)
+			}
+
+			if during.uid != nobody.uid || during.gid != nobody.gid || !slices.Equal(sorted(during.groups), sorted(nobody.groups)) {
+				t.Errorf("fn ran as %+v, want %+v", during, nobody)
+			}
+			if st, err := os.Stat(path); err != nil || st.Sys().(*syscall.Stat_t).Uid != uint32(nobody.uid) {
+				t.Errorf("file created by fn: %v, want it owned by nobody", err)
+			}
+			after, err := currentFSIdentity()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if after.uid != before.uid || after.gid != before.gid || !slices.Equal(sorted(after.groups), sorted(before.groups)) {
+				t.Errorf("identity after runAsUser %+v, want %+v", after, before)
+			}
+		})
+	}
+
+	t.Run("unknown user", func(t *testing.T) {
+		called := false
+		err := runAsUser("no such user", func() error {
+			called = true
+			return nil
+		})
+		if err == nil || called {
+			t.Errorf("runAsUser of an unknown user: error %v, fn called %v", err, called)
+		}
+	})
+}
+
+func sorted(ids []int) []int {
+	ids = slices.Clone(ids)
+	slices.Sort(ids)
+	return ids
+}
@@ -0,0 +1,268 @@
+package implement
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/policy"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+// DefaultPartialFileTTL is how long the partial file of an abandoned resumable upload is kept
+const DefaultPartialFileTTL = 24 * time.Hour
+
+// errPartialInUse is returned for a partial file another upload of the same transfer id holds
+var errPartialInUse = errors.New("partial file is in use by another upload")
+
+// atomicFile stages writes in a temporary file in the directory of its target. The target
+// is only replaced, by a rename, once Commit succeeds; until then readers keep seeing the
+// previous content and an aborted upload leaves nothing behind. Partial files of resumable
+// uploads are retained instead, unless Discard is called.
+type atomicFile struct {
+	*os.File
+	path      *policy.Path
+	target    *policy.Path
+	committed bool
+	retain    bool
+}
+
+var transferIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// partialFilePattern matches the names partialFilePath gives partial files
+var partialFilePattern = regexp.MustCompile(`^\..+\.[A-Za-z0-9_-]{1,64}\.part$`)
+
+// resolveTarget resolves a symlink target so the file it points to is replaced rather than
+// the link itself, and returns the permissions of the existing file or perm
+func resolveTarget(target *policy.Path, perm os.FileMode) (*policy.Path, os.FileMode, error) {
+	if st, err := target.Lstat(); err == nil && st.Mode()&os.ModeSymlink != 0 {
+		resolved, err := target.EvalSymlinks()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, 0, fmt.Errorf("failed to resolve symlink %q: %w", target, err)
+		}
+		if err == nil {
+			target = resolved
+		}
+	}
+	if st, err := target.Stat(); err == nil {
+		if !st.Mode().IsRegular() {
+			return nil, 0, &os.PathError{Op: "replace", Path: target.String(), Err: errNotRegular}
+		}
+		perm = st.Mode().Perm()
+	}
+	return target, perm, nil
+}
+
+// createTempFile creates a new file named like "."+base+".*.tmp" in dir, like os.CreateTemp
+func createTempFile(dir *policy.Path, base string) (*policy.Path, *os.File, error) {
+	for try := 0; ; try++ {
+		path := dir.Join("." + base + "." + strconv.FormatUint(uint64(rand.Uint32()), 10) + ".tmp")
+		f, err := path.Open(os.O_RDWR|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0600)
+		if errors.Is(err, os.ErrExist) && try < 10000 {
+			continue
+		}
+		return path, f, err
+	}
+}
+
+// createAtomicFile starts a staged write of target. When target already exists its
+// permissions are kept, otherwise perm is used.
+func createAtomicFile(target *policy.Path, perm os.FileMode) (*atomicFile, error) {
+	target, perm, err := resolveTarget(target, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	path, f, err := createTempFile(target.Dir(), target.Base())
+	if err != nil {
+		return nil, err
+	}
+	a := &atomicFile{File: f, path: path, target: target}
+	if err := f.Chmod(perm); err != nil {
+		a.Cleanup()
+		return nil, err
+	}
+	return a, nil
+}
+
+// partialFilePath returns where the partial data of a resumable upload of target is kept
+func partialFilePath(target *policy.Path, transferID string) (*policy.Path, error) {
+	if !transferIDPattern.MatchString(transferID) {
+		return nil, fmt.Errorf("invalid transfer id %q", transferID)
+	}
+	return target.Dir().Join("." + target.Base() + "." + transferID + ".part"), nil
+}
+
+// openPartialFile opens, creating it when needed, the partial file of the resumable upload
+// transferID to target. The file is retained by Cleanup so the upload can be resumed. It is
+// locked until it is committed or closed, a second upload with the same transfer id fails
+// with errPartialInUse.
+func openPartialFile(target *policy.Path, transferID string, perm os.FileMode) (*atomicFile, error) {
+	target, perm, err := resolveTarget(target, perm)
+	if err != nil {
+		return nil, err
+	}
+	partial, err := partialFilePath(target, transferID)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := partial.Open(os.O_RDWR|os.O_CREATE|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockPartialFile(f, partial, unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	a := &atomicFile{File: f, path: partial, target: target, retain: true}
+	if err := f.Chmod(perm); err != nil {
+		a.Discard()
+		a.Cleanup()
+		return nil, err
+	}
+	return a, nil
+}
+
+// Discard makes Cleanup remove the staged file even when it belongs to a resumable upload,
+// used when its content turned out to be unusable
+func (a *atomicFile) Discard() {
+	a.retain = false
+}
+
+// Target returns the path the staged file will be renamed to
+func (a *atomicFile) Target() *policy.Path {
+	return a.target
+}
+
+// Commit flushes the staged content to disk and renames it over the target. The file is
+// closed only after the rename, so the lock of a partial file is held until it is in place.
+func (a *atomicFile) Commit() error {
+	if err := a.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err := a.path.Rename(a.target); err != nil {
+		return fmt.Errorf("failed to rename file: %w", err)
+	}
+	a.committed = true
+	if err := a.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+
+	// Persist the rename itself
+	if d, err := a.target.Dir().Open(os.O_RDONLY|syscall.O_DIRECTORY, 0); err == nil {
+		if err := d.Sync(); err != nil {
+			klog.V(3).ErrorS(err, "Failed to sync directory", "dir", d.Name())
+		}
+		_ = d.Close()
+	}
+	return nil
+}
+
+// Cleanup removes the staged file unless it was committed or retained, it is safe to
+// defer right after creation
+func (a *atomicFile) Cleanup() {
+	if a.committed {
+		return
+	}
+	if a.retain {
+		_ = a.Close()
+		klog.V(3).InfoS("Keeping partial file for resumption", "file_path", a.Name())
+		return
+	}
+	// Removed before closing, a discarded partial file stays locked until it is gone
+	if err := a.path.Remove(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		klog.ErrorS(err, "Failed to remove temporary file", "file_path", a.Name())
+	}
+	_ = a.Close()
+}
+
+// CleanupAsUser runs Cleanup with the permissions of username. The staged file lies in a
+// directory the user may write to, root must not remove it.
+func (a *atomicFile) CleanupAsUser(username string) {
+	err := runAsUser(username, func() error {
+		a.Cleanup()
+		return nil
+	})
+	if err != nil {
+		klog.ErrorS(err, "Failed to clean up temporary file", "file_path", a.Name())
+	}
+}
+
+// lockPartialFile locks the partial file f at path with how, LOCK_EX or LOCK_SH, without
+// waiting. It fails with errPartialInUse while another upload holds the file, or when the
+// file was committed or removed since it was opened.
+func lockPartialFile(f *os.File, path *policy.Path, how int) error {
+	err := unix.Flock(int(f.Fd()), how|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return &os.PathError{Op: "lock", Path: f.Name(), Err: errPartialInUse}
+	}
+	if err != nil {
+		return &os.PathError{Op: "lock", Path: f.Name(), Err: err}
+	}
+	opened, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if current, err := path.Lstat(); err != nil || !os.SameFile(opened, current) {
+		return &os.PathError{Op: "lock", Path: f.Name(), Err: errPartialInUse}
+	}
+	return nil
+}
+
+// removeStalePartialFiles removes the partial files next to target no upload wrote to for
+// ttl, the data of abandoned resumable uploads would fill the disk otherwise. Partial files
+// locked by a running upload are kept. A ttl of 0 keeps them all.
+func removeStalePartialFiles(target *policy.Path, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	if resolved, _, err := resolveTarget(target, 0); err == nil {
+		target = resolved
+	}
+	dir := target.Dir()
+	names, err := readDirNames(dir)
+	if err != nil {
+		klog.V(4).ErrorS(err, "Failed to list directory for stale partial files", "dir", dir)
+		return
+	}
+	cutoff := time.Now().Add(-ttl)
+	for _, name := range names {
+		if !partialFilePattern.MatchString(name) {
+			continue
+		}
+		path := dir.Join(name)
+		if err := removeStalePartialFile(path, cutoff); err != nil {
+			klog.V(4).ErrorS(err, "Failed to remove stale partial file", "file_path", path)
+		}
+	}
+}
+
+func removeStalePartialFile(path *policy.Path, cutoff time.Time) error {
+	f, err := path.Open(os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := lockPartialFile(f, path, unix.LOCK_EX); err != nil {
+		if errors.Is(err, errPartialInUse) {
+			return nil
+		}
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !st.Mode().IsRegular() || st.ModTime().After(cutoff) {
+		return nil
+	}
+	klog.V(3).InfoS("Removing stale partial file", "file_path", path, "mtime", st.ModTime())
+	return path.Remove()
+}
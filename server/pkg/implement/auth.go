@@ -4,14 +4,21 @@ import (
 	"context"
 	"encoding/base64"
 	"errors"
+	"net"
 	"os/user"
+	"strings"
+	"time"
 
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/audit"
 	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/authenicate"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/metrics"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 	"k8s.io/klog/v2"
 )
 
@@ -61,104 +68,112 @@ func GetAuthInfoFromContext(ctx context.Context) (*AuthInfo, error) {
 	return auth, nil
 }
 
-// AuthenticateUnary is a unary interceptor for authentication
-func (s *Server) AuthenticateUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	auth, err := GetAuthInfoFromContext(ctx)
-	if err != nil {
-		return nil, status.Errorf(codes.Unauthenticated, "invalid auth info: %v", err)
-	}
+// publicMethodPrefixes lists the services reachable without credentials, so that load
+// balancers and probes can query them
+var publicMethodPrefixes = []string{
+	"/grpc.health.v1.Health/",
+	"/grpc.reflection.v1.ServerReflection/",
+	"/grpc.reflection.v1alpha.ServerReflection/",
+}
 
-	// Confirm user exists
-	if _, err := user.Lookup(auth.User); err != nil {
-		klog.V(3).ErrorS(err, "user lookup failed", "user", auth.User)
-		if _, ok := err.(user.UnknownUserError); ok {
-			return nil, status.Errorf(codes.Unauthenticated, "user not authenticated")
+func isPublicMethod(fullMethod string) bool {
+	for _, prefix := range publicMethodPrefixes {
+		if strings.HasPrefix(fullMethod, prefix) {
+			return true
 		}
-		return nil, status.Errorf(codes.Internal, "user lookup failed: %v", err)
-	}
-
-	p, ok := peer.FromContext(ctx)
-	if !ok {
-		return nil, status.Errorf(codes.Internal, "peer info is nil")
 	}
+	return false
+}
 
-	var pass bool
-	var authErr error
-	switch {
-	case auth.Password != "":
-		klog.V(3).InfoS("Starting password authentication", "user", auth.User)
-		if pass, authErr = authenicate.PamAuthenticate(auth.User, auth.Password); authErr == nil {
-			klog.V(3).InfoS("Authentication attempt", "user", auth.User, "clientIP", p.Addr.String(), "passed", pass)
-		}
-
-	case auth.PubKeyAlgorithm != "" && auth.PubKeyFingerprint != "" && auth.SignedData != "":
-		klog.V(3).InfoS("Starting SSH key authentication", "user", auth.User)
-		signedData, authErr := base64.StdEncoding.DecodeString(auth.SignedData)
-		if authErr != nil {
-			return nil, status.Errorf(codes.Internal, "failed to decode SSH signature data: %v", authErr)
-		}
-
-		pass, authErr = s.SSHAuthenticator.Authenticate(&authenicate.SSHAuthInfo{
-			SignedData:  signedData,
-			Fingerprint: []byte(auth.PubKeyFingerprint),
-			Algorithm:   auth.PubKeyAlgorithm,
-			Username:    auth.User,
-		})
-
-	default:
-		klog.V(3).InfoS("Falling back to IP whitelist", "user", auth.User, "clientIP", p.Addr.String())
-		if s.WhiteList[p.Addr.String()] {
-			klog.V(3).InfoS("Client is whitelisted", "user", auth.User, "clientIP", p.Addr.String())
-			pass = true
-		}
+// AuthenticateUnary is a unary interceptor for authentication
+func (s *Server) AuthenticateUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if isPublicMethod(info.FullMethod) {
+		return handler(ctx, req)
 	}
-
-	if !pass || authErr != nil {
-		klog.V(3).ErrorS(authErr, "Authentication failed", "user", auth.User, "clientIP", p.Addr.String())
-		return nil, status.Errorf(codes.PermissionDenied, "authentication failure")
+	if err := s.authenticate(ctx, info.FullMethod); err != nil {
+		return nil, err
 	}
-
 	return handler(ctx, req)
 }
 
 // AuthenticateStream is a streaming interceptor for authentication
 func (s *Server) AuthenticateStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
-	ctx := ss.Context()
+	if isPublicMethod(info.FullMethod) {
+		return handler(srv, ss)
+	}
+	if err := s.authenticate(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// authenticate checks the credentials carried in the request metadata, throttling
+// clients that keep failing when a FailureLimiter is configured. Every attempt is
+// recorded in the audit log.
+func (s *Server) authenticate(ctx context.Context, fullMethod string) (err error) {
+	event := &audit.Event{Type: audit.EventAuth, Method: fullMethod}
+	defer func() {
+		event.Success = err == nil
+		if err != nil && event.Error == "" {
+			event.Error = status.Convert(err).Message()
+		}
+		s.Audit.Log(event)
+		metrics.AuthAttempts.WithLabelValues(authMethodLabel(event.AuthMethod), authResultLabel(err)).Inc()
+	}()
+
 	auth, err := GetAuthInfoFromContext(ctx)
 	if err != nil {
 		return status.Errorf(codes.Unauthenticated, "invalid auth info: %v", err)
 	}
+	event.User = auth.User
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return status.Errorf(codes.Internal, "peer info is nil")
+	}
+	clientIP := peerIP(p)
+	event.ClientIP = clientIP
+
+	if s.AuthLimiter != nil {
+		if wait, allowed := s.AuthLimiter.Check(clientIP, auth.User); !allowed {
+			klog.V(3).InfoS("Authentication throttled", "user", auth.User, "clientIP", p.Addr.String(), "retryAfter", wait)
+			return throttledError(wait)
+		}
+	}
 
 	// Confirm user exists
 	if _, err := user.Lookup(auth.User); err != nil {
 		klog.V(3).ErrorS(err, "user lookup failed", "user", auth.User)
 		if _, ok := err.(user.UnknownUserError); ok {
+			s.recordAuthFailure(clientIP, "")
 			return status.Errorf(codes.Unauthenticated, "user not authenticated")
 		}
 		return status.Errorf(codes.Internal, "user lookup failed: %v", err)
 	}
 
-	p, ok := peer.FromContext(ctx)
-	if !ok {
-		return status.Errorf(codes.Internal, "peer info is nil")
-	}
-
 	var pass bool
 	var authErr error
 	switch {
 	case auth.Password != "":
+		event.AuthMethod = "password"
 		klog.V(3).InfoS("Starting password authentication", "user", auth.User)
-		if pass, authErr = authenicate.PamAuthenticate(auth.User, auth.Password); authErr == nil {
+		if pass, authErr = s.PamAuthenticator.Authenticate(auth.User, auth.Password, clientIP); authErr == nil {
 			klog.V(3).InfoS("Authentication attempt", "user", auth.User, "clientIP", p.Addr.String(), "passed", pass)
 		}
 
 	case auth.PubKeyAlgorithm != "" && auth.PubKeyFingerprint != "" && auth.SignedData != "":
+		event.AuthMethod = "publickey"
 		klog.V(3).InfoS("Starting SSH key authentication", "user", auth.User)
-		signedData, authErr := base64.StdEncoding.DecodeString(auth.SignedData)
-		if authErr != nil {
-			return status.Errorf(codes.Internal, "failed to decode SSH signature data: %v", authErr)
+		signedData, err := base64.StdEncoding.DecodeString(auth.SignedData)
+		if err != nil {
+			s.recordAuthFailure(clientIP, auth.User)
+			return status.Errorf(codes.Internal, "failed to decode SSH signature data: %v", err)
 		}
 
+		if s.SSHAuthenticator == nil {
+			authErr = errors.New("ssh authenticator is not available")
+			break
+		}
 		pass, authErr = s.SSHAuthenticator.Authenticate(&authenicate.SSHAuthInfo{
 			SignedData:  signedData,
 			Fingerprint: []byte(auth.PubKeyFingerprint),
@@ -167,6 +182,7 @@ func (s *Server) AuthenticateStream(srv interface{}, ss grpc.ServerStream, info
 		})
 
 	default:
+		event.AuthMethod = "whitelist"
 		klog.V(3).InfoS("Falling back to IP whitelist", "user", auth.User, "clientIP", p.Addr.String())
 		if s.WhiteList[p.Addr.String()] {
 			klog.V(3).InfoS("Client is whitelisted", "user", auth.User, "clientIP", p.Addr.String())
@@ -174,10 +190,66 @@ func (s *Server) AuthenticateStream(srv interface{}, ss grpc.ServerStream, info
 		}
 	}
 
+	// Password logins already went through the account stack
+	if pass && authErr == nil && auth.Password == "" {
+		if pass, authErr = s.PamAuthenticator.CheckAccount(auth.User, clientIP); authErr == nil && !pass {
+			klog.V(3).InfoS("Account check rejected user", "user", auth.User, "clientIP", p.Addr.String())
+		}
+	}
+
 	if !pass || authErr != nil {
 		klog.V(3).ErrorS(authErr, "Authentication failed", "user", auth.User, "clientIP", p.Addr.String())
+		s.recordAuthFailure(clientIP, auth.User)
+		if authErr != nil {
+			event.Error = authErr.Error()
+		}
 		return status.Errorf(codes.PermissionDenied, "authentication failure")
 	}
 
-	return handler(srv, ss)
+	if s.AuthLimiter != nil {
+		s.AuthLimiter.RecordSuccess(clientIP, auth.User)
+	}
+	return nil
+}
+
+func (s *Server) recordAuthFailure(clientIP, user string) {
+	if s.AuthLimiter != nil {
+		s.AuthLimiter.RecordFailure(clientIP, user)
+	}
+}
+
+func authMethodLabel(method string) string {
+	if method == "" {
+		return "none"
+	}
+	return method
+}
+
+func authResultLabel(err error) string {
+	switch status.Code(err) {
+	case codes.OK:
+		return "success"
+	case codes.ResourceExhausted:
+		return "throttled"
+	default:
+		return "failure"
+	}
+}
+
+// peerIP returns the client address without its port
+func peerIP(p *peer.Peer) string {
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// throttledError builds a ResourceExhausted status telling the client when to retry
+func throttledError(wait time.Duration) error {
+	st := status.Newf(codes.ResourceExhausted, "too many failed authentication attempts, retry in %s", wait.Round(time.Second))
+	if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(wait)}); err == nil {
+		st = detailed
+	}
+	return st.Err()
 }
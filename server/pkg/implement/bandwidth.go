@@ -0,0 +1,32 @@
+package implement
+
+import (
+	"context"
+
+	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/throttle"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// transferThrottle returns the bandwidth throttle of a transfer by username, combining the
+// server's limits with the rate requested in info
+func (s *Server) transferThrottle(username string, info *pb.FileInfo) (*throttle.Transfer, error) {
+	if info.RateLimit < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "negative rate limit %d", info.RateLimit)
+	}
+	t := s.Throttle.Transfer(username, info.RateLimit)
+	if t.Rate() > 0 {
+		klog.V(4).InfoS("Throttling transfer", "user", username, "remote_path", info.RemotePath, "bytes_per_second", t.Rate())
+	}
+	return t, nil
+}
+
+// waitThrottle blocks until n bytes may pass t, or the RPC of ctx ends
+func waitThrottle(ctx context.Context, t *throttle.Transfer, n int) error {
+	if err := t.WaitN(ctx, n); err != nil {
+		return status.FromContextError(err).Err()
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package implement
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"strings"
+
+	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+)
+
+// newHasher returns the hash implementing alg
+func newHasher(alg pb.FileInfo_ChecksumAlgorithm) (hash.Hash, error) {
+	switch alg {
+	case pb.FileInfo_SHA256:
+		return sha256.New(), nil
+	case pb.FileInfo_SHA1:
+		return sha1.New(), nil
+	case pb.FileInfo_SHA512:
+		return sha512.New(), nil
+	case pb.FileInfo_MD5:
+		return md5.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm: %v", alg)
+	}
+}
+
+// checksumLabel formats a digest as "<algorithm>:<hex>"
+func checksumLabel(alg pb.FileInfo_ChecksumAlgorithm, sum string) string {
+	return strings.ToLower(alg.String()) + ":" + sum
+}
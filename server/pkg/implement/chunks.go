@@ -0,0 +1,76 @@
+package implement
+
+import (
+	"fmt"
+
+	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultMaxRecvMsgSize is the gRPC default for the largest message received
+	DefaultMaxRecvMsgSize = 4 << 20
+	// DefaultMaxSendMsgSize is the gRPC default for the largest message sent
+	DefaultMaxSendMsgSize = 1<<31 - 1
+
+	// chunkOverhead is the room left in a message for the framing around a data chunk
+	chunkOverhead = 1 << 10
+)
+
+// ChunkSizes bounds the size of the data chunks of file transfers
+type ChunkSizes struct {
+	Min     int
+	Max     int
+	Default int
+}
+
+// DefaultChunkSizes are the chunk sizes used unless configured otherwise
+var DefaultChunkSizes = ChunkSizes{
+	Min:     4 << 10,
+	Max:     1 << 20,
+	Default: 32 << 10,
+}
+
+// Validate checks that the bounds are consistent and that the largest chunk fits into
+// messages of maxMsgSize bytes
+func (c ChunkSizes) Validate(maxMsgSize int) error {
+	if c.Min <= 0 || c.Min > c.Default || c.Default > c.Max {
+		return fmt.Errorf("chunk sizes must satisfy 0 < min (%d) <= default (%d) <= max (%d)", c.Min, c.Default, c.Max)
+	}
+	if c.Max+chunkOverhead > maxMsgSize {
+		return fmt.Errorf("max chunk size %d does not fit into messages of %d bytes", c.Max, maxMsgSize)
+	}
+	return nil
+}
+
+// transferLimits returns the limits advertised to clients
+func (s *Server) transferLimits() *pb.TransferLimits {
+	return &pb.TransferLimits{
+		MinChunkSize:     int32(s.ChunkSizes.Min),
+		MaxChunkSize:     int32(s.ChunkSizes.Max),
+		DefaultChunkSize: int32(s.ChunkSizes.Default),
+		MaxRecvMsgSize:   int32(s.MaxRecvMsgSize),
+		MaxSendMsgSize:   int32(s.MaxSendMsgSize),
+	}
+}
+
+// chunkSize returns the chunk size of a transfer requesting requested bytes, 0 selects the default
+func (s *Server) chunkSize(requested int32) (int, error) {
+	if requested == 0 {
+		return s.ChunkSizes.Default, nil
+	}
+	if int(requested) < s.ChunkSizes.Min || int(requested) > s.ChunkSizes.Max {
+		return 0, status.Errorf(codes.InvalidArgument, "chunk size %d is outside of [%d, %d]", requested, s.ChunkSizes.Min, s.ChunkSizes.Max)
+	}
+	return int(requested), nil
+}
+
+// uploadChunkLimit returns the largest data chunk a client requesting requested bytes may
+// send. Clients that do not request a chunk size may send up to the maximum.
+func (s *Server) uploadChunkLimit(requested int32) (int, error) {
+	if requested == 0 {
+		return s.ChunkSizes.Max, nil
+	}
+	return s.chunkSize(requested)
+}
@@ -9,7 +9,7 @@ import (
 
 // Connect method implementation
 func (s *Server) Connect(ctx context.Context, req *pb.ConnectRequest) (*pb.ConnectResponse, error) {
-	return &pb.ConnectResponse{Success: true, Message: "Connected"}, nil
+	return &pb.ConnectResponse{Success: true, Message: "Connected", TransferLimits: s.transferLimits()}, nil
 }
 
 // Close method implementation
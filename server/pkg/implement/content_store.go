@@ -0,0 +1,100 @@
+package implement
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+
+	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/contentstore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// HaveContent reports which of the requested contents the user stored earlier. Contents are
+// kept per user, so nobody learns about or obtains another user's files by their digest.
+func (s *Server) HaveContent(ctx context.Context, req *pb.HaveContentRequest) (*pb.HaveContentResponse, error) {
+	auth, err := GetAuthInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid auth info: %v", err)
+	}
+	owner, err := contentOwner(auth.User)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+
+	resp := &pb.HaveContentResponse{}
+	for _, d := range req.Digests {
+		digest, err := contentstore.ParseDigest(d)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		if s.Store != nil && s.Store.Has(owner, digest) {
+			resp.Present = append(resp.Present, d)
+		}
+	}
+	klog.V(4).InfoS("Checked content store", "user", auth.User, "requested", len(req.Digests), "present", len(resp.Present))
+	return resp, nil
+}
+
+// contentOwner returns the owner of username's contents in the store, its uid
+func contentOwner(username string) (string, error) {
+	id, err := userIdentity(username)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(id.uid), nil
+}
+
+// writeStoredContent copies the content with digest that username stored earlier to w
+func (s *Server) writeStoredContent(username, digest string, w io.Writer) (int64, error) {
+	if s.Store == nil {
+		return 0, status.Errorf(codes.NotFound, "content store is disabled")
+	}
+	hexDigest, err := contentstore.ParseDigest(digest)
+	if err != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	owner, err := contentOwner(username)
+	if err != nil {
+		return 0, status.Errorf(codes.Internal, "%v", err)
+	}
+
+	f, err := s.Store.Open(owner, hexDigest)
+	if errors.Is(err, contentstore.ErrNotFound) {
+		return 0, status.Errorf(codes.NotFound, "%v: %s", err, digest)
+	}
+	if err != nil {
+		return 0, status.Errorf(codes.Internal, "failed to open stored content: %v", err)
+	}
+	defer f.Close()
+
+	n, err := io.Copy(w, f)
+	if err != nil {
+		return n, fileError(err, codes.Internal, "failed to copy stored content: %v", err)
+	}
+	return n, nil
+}
+
+// storeContent adds the verified content of an upload to the store. A failure only costs
+// the next upload of the content its shortcut, so it is logged and otherwise ignored.
+func (s *Server) storeContent(username, checksum string, r io.Reader, size int64) {
+	if s.Store == nil {
+		return
+	}
+	owner, err := contentOwner(username)
+	if err == nil {
+		err = s.Store.Add(owner, checksum, r, size)
+	}
+	if errors.Is(err, contentstore.ErrTooLarge) {
+		klog.V(3).InfoS("Content too large for the content store", "user", username, "size", size)
+		return
+	}
+	if err != nil {
+		klog.ErrorS(err, "Failed to add content to the content store", "user", username, "digest", contentstore.DigestPrefix+checksum)
+		return
+	}
+	klog.V(4).InfoS("Content stored", "user", username, "digest", contentstore.DigestPrefix+checksum, "size", size)
+}
@@ -1,17 +1,25 @@
 package implement
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/audit"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/compression"
 	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/metrics"
 	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/utils"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
 	"mvdan.cc/sh/v3/shell"
@@ -35,6 +43,10 @@ func (s *Server) ExecCommand(ctx context.Context, req *pb.CommandRequest) (*pb.C
 	if err != nil {
 		return nil, status.Errorf(codes.Unauthenticated, "invalid gid: %v", err)
 	}
+	groups, err := userGroups(u)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "%v", err)
+	}
 	env, err := utils.GetUserEnvFunc(u)
 	if err != nil {
 		return nil, status.Errorf(codes.FailedPrecondition, "failed to get user environment: %v", err)
@@ -66,20 +78,133 @@ func (s *Server) ExecCommand(ctx context.Context, req *pb.CommandRequest) (*pb.C
 		}
 	}
 	cmd.SysProcAttr = &syscall.SysProcAttr{}
-	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
-	output, err := cmd.CombinedOutput()
-	klog.V(5).InfoS("command result", "stdout", string(output), "stderr", string(output), "err", err, "command", args)
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups}
+	chroot, err := s.execChroot(u.Username)
+	if err != nil {
+		return nil, err
+	}
+	if chroot != "" {
+		if err := chrootCommand(cmd, chroot, args[0]); err != nil {
+			return &pb.CommandResponse{
+				ExitCode: 127,
+				Stdout:   "",
+				Stderr:   err.Error(),
+			}, nil
+		}
+	}
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	start := time.Now()
+	metrics.RunningProcesses.Inc()
+	if s.PamSessions {
+		err = s.execInPamSession(ctx, cmd, u.Username)
+	} else {
+		err = cmd.Run()
+	}
+	metrics.RunningProcesses.Dec()
+	s.auditExec(ctx, u.Username, cmd, time.Since(start), err)
+	if compression.IsCompressed(output.Bytes()) {
+		skipCompression(ctx)
+	}
+	klog.V(5).InfoS("command result", "stdout", output.String(), "stderr", output.String(), "err", err, "command", args)
 	if err != nil {
 		return &pb.CommandResponse{
 			ExitCode: int32(cmd.ProcessState.ExitCode()),
-			Stdout:   string(output),
+			Stdout:   output.String(),
 			Stderr:   err.Error(),
 		}, nil
 	}
 
 	return &pb.CommandResponse{
 		ExitCode: int32(cmd.ProcessState.ExitCode()),
-		Stdout:   string(output),
+		Stdout:   output.String(),
 		Stderr:   "",
 	}, nil
 }
+
+// userGroups returns the ids of the groups u is a member of, which commands run with as their
+// supplementary groups
+func userGroups(u *user.User) ([]uint32, error) {
+	gids, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup groups of %q: %w", u.Username, err)
+	}
+	groups := make([]uint32, 0, len(gids))
+	for _, g := range gids {
+		gid, err := strconv.ParseUint(g, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gid %q: %w", g, err)
+		}
+		groups = append(groups, uint32(gid))
+	}
+	return groups, nil
+}
+
+// execInPamSession runs cmd inside a PAM session opened for username
+func (s *Server) execInPamSession(ctx context.Context, cmd *exec.Cmd, username string) error {
+	var clientIP string
+	if p, ok := peer.FromContext(ctx); ok {
+		clientIP = peerIP(p)
+	}
+	err := s.runInPamSession(ctx, cmd, username, clientIP)
+	if err != nil && cmd.ProcessState == nil {
+		klog.ErrorS(err, "Failed to start command in pam session", "user", username)
+	}
+	return err
+}
+
+// auditExec records an executed command in the audit log
+func (s *Server) auditExec(ctx context.Context, username string, cmd *exec.Cmd, duration time.Duration, err error) {
+	if s.Audit == nil {
+		return
+	}
+	cwd := cmd.Dir
+	if cwd == "" {
+		cwd, _ = os.Getwd()
+	}
+	exitCode := cmd.ProcessState.ExitCode()
+	event := &audit.Event{
+		Type:     audit.EventExec,
+		User:     username,
+		Argv:     cmd.Args,
+		Cwd:      cwd,
+		ExitCode: &exitCode,
+		Duration: duration.Seconds(),
+		Success:  err == nil,
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		event.ClientIP = peerIP(p)
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	s.Audit.Log(event)
+}
+
+// chrootSearchPath is where programs without a path are looked up inside a chroot
+var chrootSearchPath = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
+
+// chrootCommand makes cmd run inside chroot. exec.Command looked the program up on the host,
+// so it is looked up again below chroot.
+func chrootCommand(cmd *exec.Cmd, chroot, name string) error {
+	cmd.SysProcAttr.Chroot = chroot
+	cmd.Dir = "/"
+	path := name
+	if !strings.Contains(name, "/") {
+		path = ""
+		for _, dir := range chrootSearchPath {
+			candidate := filepath.Join(dir, name)
+			if st, err := os.Stat(filepath.Join(chroot, candidate)); err == nil && st.Mode().IsRegular() && st.Mode()&0111 != 0 {
+				path = candidate
+				break
+			}
+		}
+		if path == "" {
+			return fmt.Errorf("%s: command not found in %s", name, chroot)
+		}
+	}
+	cmd.Path = path
+	cmd.Err = nil
+	return nil
+}
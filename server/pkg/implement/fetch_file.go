@@ -1,36 +1,59 @@
 package implement
 
 import (
+	"bytes"
 	"context"
-	"os"
 
 	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
-	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/utils"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
 )
 
-// FetchFile method implementation
+// FetchFile returns a file in a single message. It is deprecated in favour of TransferFile
+// and disabled unless LegacyRPCMaxSize is set, larger files are refused. The file is read by
+// the same download as TransferFile.
 func (s *Server) FetchFile(ctx context.Context, req *pb.FetchFileRequest) (*pb.FetchFileResponse, error) {
 	klog.V(5).InfoS("FetchFile request", "remote_path", req.RemotePath)
 
-	auth, err := GetAuthInfoFromContext(ctx)
-	if err != nil {
-		return nil, status.Errorf(codes.Unauthenticated, "invalid auth info: %v", err)
+	if err := s.checkLegacyRPC("FetchFile"); err != nil {
+		return nil, err
 	}
 
-	filePath, err := utils.ExpandHomeDirectory(auth.User, req.RemotePath)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to expend home directory: %v", err)
+	var data bytes.Buffer
+	var limitErr error
+	stream := &unaryTransferStream{
+		ctx: ctx,
+		send: func(msg *pb.FileTransferMessage) error {
+			switch payload := msg.Payload.(type) {
+			case *pb.FileTransferMessage_Control:
+				if size := payload.Control.Info.GetFileSize(); payload.Control.Operation == pb.ControlMessage_DOWNLOAD && size > s.LegacyRPCMaxSize {
+					limitErr = status.Errorf(codes.ResourceExhausted, "file of %d bytes exceeds the FetchFile limit of %d bytes, use TransferFile", size, s.LegacyRPCMaxSize)
+				}
+			case *pb.FileTransferMessage_Data:
+				// The file may have grown since it was opened
+				if int64(data.Len()+len(payload.Data.Data)) > s.LegacyRPCMaxSize {
+					limitErr = status.Errorf(codes.ResourceExhausted, "file exceeds the FetchFile limit of %d bytes, use TransferFile", s.LegacyRPCMaxSize)
+				} else {
+					data.Write(payload.Data.Data)
+				}
+			}
+			return limitErr
+		},
 	}
-
-	klog.V(5).InfoS("Expanded file path", "file_path", filePath)
-
-	data, err := os.ReadFile(filePath)
-	if err != nil {
-		return &pb.FetchFileResponse{Message: err.Error(), Success: false}, nil
+	control := &pb.ControlMessage{
+		Operation: pb.ControlMessage_DOWNLOAD,
+		Info: &pb.FileInfo{
+			RemotePath: req.RemotePath,
+			ChunkSize:  int32(s.ChunkSizes.Max),
+		},
 	}
 
-	return &pb.FetchFileResponse{Success: true, Message: "File fetched", FileData: data}, nil
+	if err := s.handleTransfer(stream, control); err != nil {
+		if limitErr != nil {
+			return nil, limitErr
+		}
+		return &pb.FetchFileResponse{Message: status.Convert(err).Message(), Success: false}, nil
+	}
+	return &pb.FetchFileResponse{Success: true, Message: "File fetched", FileData: data.Bytes()}, nil
 }
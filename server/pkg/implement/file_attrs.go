@@ -0,0 +1,148 @@
+package implement
+
+import (
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/utils"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// uploadOwnership resolves the uid and gid an uploaded file is given. Without an explicit
+// owner or group the authenticated user's ids are used; only root may hand files to other
+// users, and other users may only pick a group they are a member of.
+func uploadOwnership(username string, info *pb.FileInfo) (int, int, error) {
+	u, err := utils.LookupUser(username)
+	if err != nil {
+		return 0, 0, status.Errorf(codes.Internal, "failed to lookup user: %v", err)
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, status.Errorf(codes.Internal, "invalid uid: %v", err)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return 0, 0, status.Errorf(codes.Internal, "invalid gid: %v", err)
+	}
+	isRoot := uid == 0
+
+	if info.Owner != "" {
+		owner, err := utils.LookupUID(info.Owner)
+		if err != nil {
+			return 0, 0, status.Errorf(codes.InvalidArgument, "invalid owner %q: %v", info.Owner, err)
+		}
+		if owner != uid && !isRoot {
+			return 0, 0, status.Errorf(codes.PermissionDenied, "only root may set owner %q", info.Owner)
+		}
+		uid = owner
+	}
+
+	if info.Group != "" {
+		group, err := utils.LookupGID(info.Group)
+		if err != nil {
+			return 0, 0, status.Errorf(codes.InvalidArgument, "invalid group %q: %v", info.Group, err)
+		}
+		if group != gid && !isRoot {
+			member, err := isGroupMember(u, group)
+			if err != nil {
+				return 0, 0, status.Errorf(codes.Internal, "failed to lookup groups of %q: %v", username, err)
+			}
+			if !member {
+				return 0, 0, status.Errorf(codes.PermissionDenied, "user %q is not a member of group %q", username, info.Group)
+			}
+		}
+		gid = group
+	}
+
+	return uid, gid, nil
+}
+
+func isGroupMember(u *user.User, gid int) (bool, error) {
+	groups, err := u.GroupIds()
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(groups, strconv.Itoa(gid)), nil
+}
+
+// applyUploadAttributes sets the mode and timestamps requested for an upload. It must run
+// after the file got its owner, since chown clears the setuid and setgid bits.
+func applyUploadAttributes(file *os.File, info *pb.FileInfo) error {
+	if info.Mode != nil {
+		if err := file.Chmod(unixMode(*info.Mode)); err != nil {
+			return err
+		}
+	}
+	if info.Mtime != nil || info.Atime != nil {
+		var atime, mtime time.Time
+		if info.Atime != nil {
+			atime = info.Atime.AsTime()
+		}
+		if info.Mtime != nil {
+			mtime = info.Mtime.AsTime()
+		}
+		if err := futimes(file, atime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// futimes sets the timestamps of an open file, zero times are left unchanged. It works on the
+// file descriptor like Chmod and Chown, since the file's path may have been replaced by then.
+func futimes(file *os.File, atime, mtime time.Time) error {
+	ts := []unix.Timespec{{Nsec: unix.UTIME_OMIT}, {Nsec: unix.UTIME_OMIT}}
+	if !atime.IsZero() {
+		ts[0] = unix.NsecToTimespec(atime.UnixNano())
+	}
+	if !mtime.IsZero() {
+		ts[1] = unix.NsecToTimespec(mtime.UnixNano())
+	}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, fdPath(file), ts, 0); err != nil {
+		return &os.PathError{Op: "futimens", Path: file.Name(), Err: err}
+	}
+	return nil
+}
+
+// fdPath returns the /proc path of an open file. Its magic link leads to the open file
+// whatever its path became, also for O_PATH descriptors the *xattr calls do not accept.
+func fdPath(file *os.File) string {
+	return "/proc/self/fd/" + strconv.Itoa(int(file.Fd()))
+}
+
+// unixMode converts raw permission bits into an os.FileMode
+func unixMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	if mode&syscall.S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// fillFileAttributes reports the mode, ownership and timestamps of st in info
+func fillFileAttributes(info *pb.FileInfo, st os.FileInfo) {
+	sys, ok := st.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	mode := sys.Mode &^ syscall.S_IFMT
+	info.Mode = &mode
+	info.Owner = utils.UserName(sys.Uid)
+	info.Group = utils.GroupName(sys.Gid)
+	info.Mtime = timestamppb.New(time.Unix(sys.Mtim.Unix()))
+	info.Atime = timestamppb.New(time.Unix(sys.Atim.Unix()))
+}
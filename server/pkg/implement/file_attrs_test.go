@@ -0,0 +1,107 @@
+package implement
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestUploadOwnership(t *testing.T) {
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skipf("no user nobody: %v", err)
+	}
+	nobodyGroup, err := user.LookupGroupId(nobody.Gid)
+	if err != nil {
+		t.Skipf("no primary group of nobody: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		user     string
+		info     *pb.FileInfo
+		wantUID  string
+		wantGID  string
+		wantCode codes.Code
+	}{
+		{name: "own ids by default", user: "nobody", info: &pb.FileInfo{}, wantUID: nobody.Uid, wantGID: nobody.Gid},
+		{name: "own owner", user: "nobody", info: &pb.FileInfo{Owner: "nobody", Group: nobodyGroup.Name}, wantUID: nobody.Uid, wantGID: nobody.Gid},
+		{name: "numeric owner", user: "nobody", info: &pb.FileInfo{Owner: nobody.Uid}, wantUID: nobody.Uid, wantGID: nobody.Gid},
+		{name: "foreign owner", user: "nobody", info: &pb.FileInfo{Owner: "root"}, wantCode: codes.PermissionDenied},
+		{name: "foreign group", user: "nobody", info: &pb.FileInfo{Group: "root"}, wantCode: codes.PermissionDenied},
+		{name: "root hands out files", user: "root", info: &pb.FileInfo{Owner: "nobody", Group: nobodyGroup.Name}, wantUID: nobody.Uid, wantGID: nobody.Gid},
+		{name: "unknown owner", user: "root", info: &pb.FileInfo{Owner: "no such user"}, wantCode: codes.InvalidArgument},
+		{name: "unknown group", user: "root", info: &pb.FileInfo{Group: "no such group"}, wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uid, gid, err := uploadOwnership(tt.user, tt.info)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("uploadOwnership error %v, want code %v", err, tt.wantCode)
+			}
+			if err == nil && (strconv.Itoa(uid) != tt.wantUID || strconv.Itoa(gid) != tt.wantGID) {
+				t.Errorf("uploadOwnership = %d:%d, want %s:%s", uid, gid, tt.wantUID, tt.wantGID)
+			}
+		})
+	}
+}
+
+func TestUploadAttributes(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	atime := time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC)
+	mode := uint32(0640 | syscall.S_ISGID)
+	target := filepath.Join(t.TempDir(), "file")
+	info := &pb.FileInfo{RemotePath: target, Mode: &mode, Mtime: timestamppb.New(mtime), Atime: timestamppb.New(atime)}
+	// Only root may hand the file to another user
+	nobody, err := user.Lookup("nobody")
+	if os.Geteuid() == 0 && err == nil {
+		info.Owner = "nobody"
+	}
+	if err := NewServer(nil, nil, nil).TransferFile(newTransferStream(t, controlMsg(pb.ControlMessage_UPLOAD, info), dataMsg("content"))); err != nil {
+		t.Fatalf("TransferFile: %v", err)
+	}
+
+	st, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sys := st.Sys().(*syscall.Stat_t)
+	// The mode is applied after the owner, whose change clears the setgid bit
+	if got := sys.Mode &^ syscall.S_IFMT; got != mode {
+		t.Errorf("mode %o, want %o", got, mode)
+	}
+	if !st.ModTime().Equal(mtime) || !time.Unix(sys.Atim.Unix()).Equal(atime) {
+		t.Errorf("times mtime %v atime %v, want %v and %v", st.ModTime(), time.Unix(sys.Atim.Unix()), mtime, atime)
+	}
+	if info.Owner != "" {
+		if strconv.FormatUint(uint64(sys.Uid), 10) != nobody.Uid {
+			t.Errorf("owner %d, want nobody", sys.Uid)
+		}
+	}
+
+	// Downloads report the attributes
+	stream := newTransferStream(t, controlMsg(pb.ControlMessage_DOWNLOAD, &pb.FileInfo{RemotePath: target}))
+	if err := NewServer(nil, nil, nil).TransferFile(stream); err != nil {
+		t.Fatalf("TransferFile: %v", err)
+	}
+	control, ok := stream.sent[0].Payload.(*pb.FileTransferMessage_Control)
+	if !ok {
+		t.Fatalf("first download message %v is no control message", stream.sent[0])
+	}
+	got := control.Control.Info
+	if got.GetMode() != mode || !got.Mtime.AsTime().Equal(mtime) || !got.Atime.AsTime().Equal(atime) {
+		t.Errorf("download reports mode %o, mtime %v, atime %v, want %o, %v, %v", got.GetMode(), got.Mtime.AsTime(), got.Atime.AsTime(), mode, mtime, atime)
+	}
+	if info.Owner != "" && got.Owner != info.Owner {
+		t.Errorf("download reports owner %q, want %q", got.Owner, info.Owner)
+	}
+}
@@ -0,0 +1,316 @@
+package implement
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/audit"
+	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/policy"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/utils"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"k8s.io/klog/v2"
+)
+
+// FileSystemServer implements pb.FileSystemServiceServer on top of a Server. Every call runs
+// with the filesystem permissions of the authenticated user.
+type FileSystemServer struct {
+	pb.UnimplementedFileSystemServiceServer
+	server *Server
+}
+
+// NewFileSystemServer creates the filesystem service for s
+func NewFileSystemServer(s *Server) *FileSystemServer {
+	return &FileSystemServer{server: s}
+}
+
+// Stat returns the metadata of a path, a missing path is reported by exists being false
+func (f *FileSystemServer) Stat(ctx context.Context, req *pb.StatRequest) (*pb.StatResponse, error) {
+	username, path, err := f.resolve(ctx, req.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer path.Close()
+
+	resp := &pb.StatResponse{}
+	err = runAsUser(username, func() error {
+		var st os.FileInfo
+		if req.FollowSymlinks {
+			st, err = path.Stat()
+		} else {
+			st, err = path.Lstat()
+		}
+		if err != nil {
+			return err
+		}
+		resp.Exists = true
+		resp.Stat = fileStat(path, st)
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return &pb.StatResponse{}, nil
+	}
+	if err != nil {
+		return nil, fsError(err)
+	}
+	return resp, nil
+}
+
+// ListDir returns the entries of a directory without following symlinks
+func (f *FileSystemServer) ListDir(ctx context.Context, req *pb.ListDirRequest) (*pb.ListDirResponse, error) {
+	username, path, err := f.resolve(ctx, req.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer path.Close()
+
+	resp := &pb.ListDirResponse{}
+	err = runAsUser(username, func() error {
+		names, err := readDirNames(path)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			entry := path.Join(name)
+			st, err := entry.Lstat()
+			if errors.Is(err, os.ErrNotExist) {
+				// Removed since the directory was read
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			resp.Entries = append(resp.Entries, fileStat(entry, st))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fsError(err)
+	}
+	sort.Slice(resp.Entries, func(i, j int) bool { return resp.Entries[i].Name < resp.Entries[j].Name })
+	klog.V(5).InfoS("Listed directory", "path", path, "entries", len(resp.Entries))
+	return resp, nil
+}
+
+// Remove deletes a path, like rm -f, or rm -rf when recursive is set
+func (f *FileSystemServer) Remove(ctx context.Context, req *pb.RemoveRequest) (resp *pb.RemoveResponse, err error) {
+	username, path, err := f.resolve(ctx, req.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer path.Close()
+	defer func() { f.server.auditFileSystem(ctx, username, "remove", path.String(), err) }()
+
+	resp = &pb.RemoveResponse{}
+	err = runAsUser(username, func() error {
+		if _, err := path.Lstat(); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		resp.Removed = true
+		if req.Recursive {
+			return path.RemoveAll()
+		}
+		return path.Remove()
+	})
+	if err != nil {
+		return nil, fsError(err)
+	}
+	return resp, nil
+}
+
+// MkdirAll creates a directory along with its missing parents
+func (f *FileSystemServer) MkdirAll(ctx context.Context, req *pb.MkdirAllRequest) (resp *pb.MkdirAllResponse, err error) {
+	username, path, err := f.resolve(ctx, req.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer path.Close()
+	defer func() { f.server.auditFileSystem(ctx, username, "mkdir", path.String(), err) }()
+
+	perm := os.FileMode(0755)
+	if req.Mode != nil {
+		perm = unixMode(*req.Mode)
+	}
+	resp = &pb.MkdirAllResponse{}
+	err = runAsUser(username, func() error {
+		if st, err := path.Stat(); err == nil {
+			if !st.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: path.String(), Err: syscall.ENOTDIR}
+			}
+			return nil
+		}
+		if err := path.MkdirAll(perm); err != nil {
+			return err
+		}
+		resp.Created = true
+		// The umask must not narrow an explicitly requested mode
+		if req.Mode != nil {
+			return path.Chmod(perm)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fsError(err)
+	}
+	return resp, nil
+}
+
+// Rename moves a path, replacing the destination like rename(2)
+func (f *FileSystemServer) Rename(ctx context.Context, req *pb.RenameRequest) (resp *pb.RenameResponse, err error) {
+	username, oldPath, err := f.resolve(ctx, req.OldPath)
+	if err != nil {
+		return nil, err
+	}
+	defer oldPath.Close()
+	_, newPath, err := f.resolve(ctx, req.NewPath)
+	if err != nil {
+		return nil, err
+	}
+	defer newPath.Close()
+	paths := oldPath.String() + " -> " + newPath.String()
+	defer func() { f.server.auditFileSystem(ctx, username, "rename", paths, err) }()
+
+	err = runAsUser(username, func() error {
+		return oldPath.Rename(newPath)
+	})
+	if err != nil {
+		return nil, fsError(err)
+	}
+	return &pb.RenameResponse{}, nil
+}
+
+// Readlink returns the target of a symlink
+func (f *FileSystemServer) Readlink(ctx context.Context, req *pb.ReadlinkRequest) (*pb.ReadlinkResponse, error) {
+	username, path, err := f.resolve(ctx, req.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer path.Close()
+
+	resp := &pb.ReadlinkResponse{}
+	err = runAsUser(username, func() error {
+		resp.Target, err = path.Readlink()
+		return err
+	})
+	if err != nil {
+		return nil, fsError(err)
+	}
+	return resp, nil
+}
+
+// resolve returns the authenticated user and path resolved by the server's path rules, the
+// path has to be closed
+func (f *FileSystemServer) resolve(ctx context.Context, path string) (string, *policy.Path, error) {
+	auth, err := GetAuthInfoFromContext(ctx)
+	if err != nil {
+		return "", nil, status.Errorf(codes.Unauthenticated, "invalid auth info: %v", err)
+	}
+	if path == "" {
+		return "", nil, status.Errorf(codes.InvalidArgument, "empty path")
+	}
+	resolved, err := f.server.resolvePath(auth.User, path)
+	if err != nil {
+		klog.ErrorS(err, "Failed to resolve path", "path", path)
+		return "", nil, err
+	}
+	return auth.User, resolved, nil
+}
+
+// fsError maps a filesystem error to a gRPC status
+func fsError(err error) error {
+	var code codes.Code
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		code = codes.NotFound
+	case errors.Is(err, os.ErrPermission), errors.Is(err, policy.ErrOutside):
+		code = codes.PermissionDenied
+	case errors.Is(err, os.ErrExist), errors.Is(err, syscall.ENOTEMPTY):
+		code = codes.AlreadyExists
+	case errors.Is(err, syscall.ENOTDIR), errors.Is(err, syscall.EISDIR), errors.Is(err, syscall.EINVAL), errors.Is(err, syscall.EXDEV):
+		code = codes.FailedPrecondition
+	default:
+		code = codes.Internal
+	}
+	return status.Error(code, err.Error())
+}
+
+// fileStat converts the result of a stat of path
+func fileStat(path *policy.Path, st os.FileInfo) *pb.FileStat {
+	fs := &pb.FileStat{
+		Name: st.Name(),
+		Path: path.String(),
+		Type: fileType(st.Mode()),
+		Size: st.Size(),
+	}
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+		fs.Mode = sys.Mode &^ syscall.S_IFMT
+		fs.Uid = sys.Uid
+		fs.Gid = sys.Gid
+		fs.Owner = utils.UserName(sys.Uid)
+		fs.Group = utils.GroupName(sys.Gid)
+		fs.Mtime = timestamppb.New(time.Unix(sys.Mtim.Unix()))
+		fs.Atime = timestamppb.New(time.Unix(sys.Atim.Unix()))
+		fs.Ctime = timestamppb.New(time.Unix(sys.Ctim.Unix()))
+		fs.Inode = sys.Ino
+		fs.Device = sys.Dev
+		fs.Nlink = uint64(sys.Nlink)
+	}
+	if st.Mode()&os.ModeSymlink != 0 {
+		if target, err := path.Readlink(); err == nil {
+			fs.SymlinkTarget = target
+		}
+	}
+	return fs
+}
+
+func fileType(mode os.FileMode) pb.FileStat_Type {
+	switch {
+	case mode.IsRegular():
+		return pb.FileStat_REGULAR
+	case mode.IsDir():
+		return pb.FileStat_DIRECTORY
+	case mode&os.ModeSymlink != 0:
+		return pb.FileStat_SYMLINK
+	case mode&os.ModeNamedPipe != 0:
+		return pb.FileStat_FIFO
+	case mode&os.ModeSocket != 0:
+		return pb.FileStat_SOCKET
+	case mode&os.ModeCharDevice != 0:
+		return pb.FileStat_CHAR_DEVICE
+	case mode&os.ModeDevice != 0:
+		return pb.FileStat_BLOCK_DEVICE
+	default:
+		return pb.FileStat_UNKNOWN
+	}
+}
+
+// auditFileSystem records a modifying filesystem call in the audit log
+func (s *Server) auditFileSystem(ctx context.Context, username, operation, path string, err error) {
+	if s.Audit == nil {
+		return
+	}
+	event := &audit.Event{
+		Type:      audit.EventFileSystem,
+		User:      username,
+		Operation: operation,
+		Path:      path,
+		Success:   err == nil,
+	}
+	if err != nil {
+		event.Error = status.Convert(err).Message()
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		event.ClientIP = peerIP(p)
+	}
+	s.Audit.Log(event)
+}
@@ -0,0 +1,49 @@
+package implement
+
+import (
+	"context"
+	"io"
+
+	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultLegacyRPCMaxSize is the default file size limit of PutFile and FetchFile once enabled
+const DefaultLegacyRPCMaxSize = 4 << 20
+
+// checkLegacyRPC rejects the deprecated unary file RPCs unless they are enabled
+func (s *Server) checkLegacyRPC(method string) error {
+	if s.LegacyRPCMaxSize <= 0 {
+		return status.Errorf(codes.Unimplemented, "%s is deprecated and disabled on this server, use TransferFile", method)
+	}
+	return nil
+}
+
+// unaryTransferStream runs a TransferFile handler on behalf of a unary RPC. The handler
+// receives the messages in in and what it sends is passed to send. Only Context, Recv and
+// Send are available to the handler.
+type unaryTransferStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	in   []*pb.FileTransferMessage
+	send func(*pb.FileTransferMessage) error
+}
+
+func (u *unaryTransferStream) Context() context.Context {
+	return u.ctx
+}
+
+func (u *unaryTransferStream) Recv() (*pb.FileTransferMessage, error) {
+	if len(u.in) == 0 {
+		return nil, io.EOF
+	}
+	msg := u.in[0]
+	u.in = u.in[1:]
+	return msg, nil
+}
+
+func (u *unaryTransferStream) Send(msg *pb.FileTransferMessage) error {
+	return u.send(msg)
+}
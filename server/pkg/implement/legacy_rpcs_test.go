@@ -0,0 +1,105 @@
+package implement
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPutFileMaxSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxSize  int64
+		data     string
+		wantCode codes.Code
+	}{
+		{name: "disabled", maxSize: 0, data: "content", wantCode: codes.Unimplemented},
+		{name: "within the limit", maxSize: 7, data: "content"},
+		{name: "empty file", maxSize: 7},
+		{name: "over the limit", maxSize: 6, data: "content", wantCode: codes.ResourceExhausted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := filepath.Join(t.TempDir(), "file")
+			s := NewServer(nil, nil, nil)
+			s.LegacyRPCMaxSize = tt.maxSize
+			resp, err := s.PutFile(newTransferStream(t).Context(), &pb.PutFileRequest{RemotePath: target, FileData: []byte(tt.data)})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("PutFile error %v, want code %v", err, tt.wantCode)
+			}
+			if tt.wantCode != codes.OK {
+				if _, err := os.Stat(target); !os.IsNotExist(err) {
+					t.Errorf("refused PutFile created the target: %v", err)
+				}
+				return
+			}
+			if !resp.Success {
+				t.Fatalf("PutFile failed: %s", resp.Message)
+			}
+			if got, err := os.ReadFile(target); err != nil || string(got) != tt.data {
+				t.Errorf("target holds %q, %v, want %q", got, err, tt.data)
+			}
+		})
+	}
+
+	// Data larger than a chunk is split as TransferFile would receive it
+	t.Run("several chunks", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "file")
+		s := NewServer(nil, nil, nil)
+		data := strings.Repeat("x", 2*s.ChunkSizes.Max+1)
+		s.LegacyRPCMaxSize = int64(len(data))
+		resp, err := s.PutFile(newTransferStream(t).Context(), &pb.PutFileRequest{RemotePath: target, FileData: []byte(data)})
+		if err != nil || !resp.Success {
+			t.Fatalf("PutFile: %v, %v", resp, err)
+		}
+		if got, err := os.ReadFile(target); err != nil || string(got) != data {
+			t.Errorf("target holds %d bytes, %v, want %d bytes", len(got), err, len(data))
+		}
+	})
+}
+
+func TestFetchFileMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "file")
+	if err := os.WriteFile(source, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		maxSize     int64
+		path        string
+		wantCode    codes.Code
+		wantSuccess bool
+	}{
+		{name: "disabled", maxSize: 0, path: source, wantCode: codes.Unimplemented},
+		{name: "within the limit", maxSize: 7, path: source, wantSuccess: true},
+		{name: "over the limit", maxSize: 6, path: source, wantCode: codes.ResourceExhausted},
+		// Other failures of the download are reported in the response
+		{name: "missing file", maxSize: 7, path: filepath.Join(dir, "missing")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(nil, nil, nil)
+			s.LegacyRPCMaxSize = tt.maxSize
+			resp, err := s.FetchFile(newTransferStream(t).Context(), &pb.FetchFileRequest{RemotePath: tt.path})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("FetchFile error %v, want code %v", err, tt.wantCode)
+			}
+			if tt.wantCode != codes.OK {
+				return
+			}
+			if resp.Success != tt.wantSuccess {
+				t.Fatalf("FetchFile success %v (%s), want %v", resp.Success, resp.Message, tt.wantSuccess)
+			}
+			if tt.wantSuccess && string(resp.FileData) != "content" {
+				t.Errorf("FetchFile returned %q, want %q", resp.FileData, "content")
+			}
+		})
+	}
+}
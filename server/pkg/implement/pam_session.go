@@ -0,0 +1,242 @@
+package implement
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/authenicate"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+// PamSessionHelperArg is the first argument that makes the daemon's binary run as the helper
+// holding a PAM session around a command, see RunPamSessionHelper
+const PamSessionHelperArg = "__pam-session-helper"
+
+// The helper gets its spec on fd 3 and reports on fd 4
+const (
+	pamHelperSpecFd   = 3
+	pamHelperResultFd = 4
+)
+
+// A helper asked to stop passes the signal on to the command's process group and kills the
+// group after pamCommandKillDelay. It is killed itself when it has not closed the session
+// pamHelperKillDelay after being asked.
+const (
+	pamCommandKillDelay = 5 * time.Second
+	pamHelperKillDelay  = 10 * time.Second
+)
+
+// pamSessionSpec tells the helper which session to open and which command to run in it
+type pamSessionSpec struct {
+	Service string   `json:"service"`
+	User    string   `json:"user"`
+	Rhost   string   `json:"rhost,omitempty"`
+	Path    string   `json:"path"`
+	Args    []string `json:"args"`
+	Env     []string `json:"env"`
+	Dir     string   `json:"dir,omitempty"`
+	UID     uint32   `json:"uid"`
+	GID     uint32   `json:"gid"`
+	Groups  []uint32 `json:"groups"`
+	Chroot  string   `json:"chroot,omitempty"`
+}
+
+// pamSessionResult is what the helper reports besides the command's exit status
+type pamSessionResult struct {
+	// StartError is set when the session could not be opened or the command not started
+	StartError string `json:"start_error,omitempty"`
+	// CloseError is set when closing the session failed after the command exited
+	CloseError string `json:"close_error,omitempty"`
+	// Signal is the signal that killed the command, the helper then exits with 128 + Signal
+	Signal int `json:"signal,omitempty"`
+}
+
+// runInPamSession runs cmd inside a PAM session opened for username. Session modules such as
+// pam_limits change the resource limits of the process opening the session, so the session
+// is held by a helper process, a re-execution of the daemon's binary, which starts the
+// command and passes on its exit status. The daemon's own limits are never touched. Once ctx
+// is done the helper is told to stop the command and close the session.
+func (s *Server) runInPamSession(ctx context.Context, cmd *exec.Cmd, username, clientIP string) error {
+	if cmd.Err != nil {
+		// The program was not found
+		return cmd.Err
+	}
+	spec := pamSessionSpec{
+		Service: s.PamAuthenticator.Service(),
+		User:    username,
+		Rhost:   clientIP,
+		Path:    cmd.Path,
+		Args:    cmd.Args,
+		Env:     cmd.Env,
+		Dir:     cmd.Dir,
+	}
+	if attr := cmd.SysProcAttr; attr != nil {
+		if attr.Credential != nil {
+			spec.UID, spec.GID, spec.Groups = attr.Credential.Uid, attr.Credential.Gid, attr.Credential.Groups
+		}
+		spec.Chroot = attr.Chroot
+	}
+
+	specR, specW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer specR.Close()
+	defer specW.Close()
+	resultR, resultW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer resultR.Close()
+	defer resultW.Close()
+
+	helper := exec.CommandContext(ctx, "/proc/self/exe", PamSessionHelperArg)
+	helper.Cancel = func() error { return helper.Process.Signal(syscall.SIGTERM) }
+	helper.WaitDelay = pamHelperKillDelay
+	helper.Stdout = cmd.Stdout
+	helper.Stderr = cmd.Stderr
+	helper.ExtraFiles = []*os.File{specR, resultW}
+	if err := helper.Start(); err != nil {
+		return fmt.Errorf("failed to start pam session helper: %w", err)
+	}
+	specR.Close()
+	resultW.Close()
+
+	encodeErr := json.NewEncoder(specW).Encode(&spec)
+	specW.Close()
+	var result pamSessionResult
+	decodeErr := json.NewDecoder(resultR).Decode(&result)
+	waitErr := helper.Wait()
+
+	if encodeErr != nil {
+		return fmt.Errorf("failed to pass command to pam session helper: %w", encodeErr)
+	}
+	if decodeErr != nil {
+		if waitErr == nil {
+			waitErr = decodeErr
+		}
+		return fmt.Errorf("pam session helper failed: %w", waitErr)
+	}
+	if result.StartError != "" {
+		return errors.New(result.StartError)
+	}
+	if result.CloseError != "" {
+		klog.ErrorS(errors.New(result.CloseError), "Failed to close pam session", "user", username)
+	}
+	// The helper exits like the command did
+	cmd.ProcessState = helper.ProcessState
+	if result.Signal != 0 {
+		return fmt.Errorf("signal: %v", syscall.Signal(result.Signal))
+	}
+	return waitErr
+}
+
+// RunPamSessionHelper is the helper process of runInPamSession. It opens the PAM session,
+// runs the command with the limits and environment the session modules set and closes the
+// session again. Termination signals are passed on to the command, so the session is closed
+// when the daemon stops the helper. It returns the command's exit code, or 128 plus the signal
+// that killed it.
+func RunPamSessionHelper() int {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	syscall.CloseOnExec(pamHelperSpecFd)
+	syscall.CloseOnExec(pamHelperResultFd)
+	specFile := os.NewFile(pamHelperSpecFd, "pam-session-spec")
+	resultFile := os.NewFile(pamHelperResultFd, "pam-session-result")
+	report := func(result pamSessionResult) {
+		_ = json.NewEncoder(resultFile).Encode(&result)
+		resultFile.Close()
+	}
+
+	var spec pamSessionSpec
+	err := json.NewDecoder(specFile).Decode(&spec)
+	specFile.Close()
+	if err != nil {
+		report(pamSessionResult{StartError: fmt.Sprintf("invalid pam session spec: %v", err)})
+		return 1
+	}
+
+	session, err := authenicate.NewPamAuthenticator(spec.Service, false).OpenSession(spec.User, spec.Rhost)
+	if err != nil {
+		report(pamSessionResult{StartError: err.Error()})
+		return 1
+	}
+
+	// pam_limits calls setrlimit itself, going through syscall.Setrlimit makes the runtime hand
+	// the session's open file limit to the command instead of the one the helper started with
+	var nofile syscall.Rlimit
+	if err := syscall.Getrlimit(unix.RLIMIT_NOFILE, &nofile); err == nil {
+		_ = syscall.Setrlimit(unix.RLIMIT_NOFILE, &nofile)
+	}
+
+	cmd := &exec.Cmd{
+		Path:   spec.Path,
+		Args:   spec.Args,
+		Env:    append(spec.Env, session.Env...),
+		Dir:    spec.Dir,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+		SysProcAttr: &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: spec.UID, Gid: spec.GID, Groups: spec.Groups},
+			Chroot:     spec.Chroot,
+			// A group of its own lets the helper stop the command along with its children
+			Setpgid: true,
+		},
+	}
+	var startErr error
+	select {
+	case sig := <-signals:
+		startErr = fmt.Errorf("command not started: %v", sig)
+	default:
+		startErr = cmd.Start()
+	}
+	if startErr != nil {
+		result := pamSessionResult{StartError: startErr.Error()}
+		if cerr := session.Close(); cerr != nil {
+			result.CloseError = cerr.Error()
+		}
+		report(result)
+		return 1
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		pgid := -cmd.Process.Pid
+		var kill <-chan time.Time
+		for {
+			select {
+			case sig := <-signals:
+				_ = syscall.Kill(pgid, sig.(syscall.Signal))
+				if kill == nil {
+					kill = time.After(pamCommandKillDelay)
+				}
+			case <-kill:
+				_ = syscall.Kill(pgid, syscall.SIGKILL)
+			case <-exited:
+				return
+			}
+		}
+	}()
+	_ = cmd.Wait()
+	close(exited)
+	var result pamSessionResult
+	if err := session.Close(); err != nil {
+		result.CloseError = err.Error()
+	}
+	code := cmd.ProcessState.ExitCode()
+	if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		result.Signal = int(ws.Signal())
+		code = 128 + result.Signal
+	}
+	report(result)
+	return code
+}
@@ -0,0 +1,77 @@
+package implement
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/policy"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/utils"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// resolvePath expands the home directory in path and, when a path policy is configured,
+// confines it to the directories allowed for username. Relative paths are then taken
+// relative to the home directory. Symlinks are resolved by the operations on the returned
+// path, which has to be closed.
+func (s *Server) resolvePath(username, path string) (*policy.Path, error) {
+	expanded, err := utils.ExpandHomeDirectory(username, path)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to expand home directory: %v", err)
+	}
+	if s.Policy == nil {
+		return policy.Unconfined(expanded), nil
+	}
+
+	u, err := utils.LookupUser(username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "user lookup failed: %v", err)
+	}
+	conf, err := s.Policy.For(u)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to evaluate path policy: %v", err)
+	}
+	if !filepath.IsAbs(expanded) {
+		expanded = filepath.Join(u.HomeDir, expanded)
+	}
+	resolved, err := conf.Resolve(expanded)
+	if errors.Is(err, policy.ErrOutside) {
+		return nil, status.Errorf(codes.PermissionDenied, "%v", err)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to resolve path: %v", err)
+	}
+	return resolved, nil
+}
+
+// execChroot returns the directory the commands of username are chrooted into, if any. Only
+// a chroot confines commands, users whose paths are confined may not run commands without.
+func (s *Server) execChroot(username string) (string, error) {
+	if s.Policy == nil {
+		return "", nil
+	}
+	u, err := utils.LookupUser(username)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "user lookup failed: %v", err)
+	}
+	conf, err := s.Policy.For(u)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "failed to evaluate path policy: %v", err)
+	}
+	if conf.ExecChroot == "" && conf.Confined() {
+		return "", status.Errorf(codes.PermissionDenied, "commands of user %q would not be confined to the allowed paths, the path policy sets no exec_chroot", username)
+	}
+	return conf.ExecChroot, nil
+}
+
+// readDirNames returns the names of the entries of the directory dir
+func readDirNames(dir *policy.Path) ([]string, error) {
+	f, err := dir.Open(os.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
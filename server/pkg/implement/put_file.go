@@ -2,42 +2,49 @@ package implement
 
 import (
 	"context"
-	"os"
-	"path/filepath"
 
 	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
-	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/utils"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
 )
 
-// PutFile method implementation
+// PutFile writes a file sent in a single message. It is deprecated in favour of TransferFile
+// and disabled unless LegacyRPCMaxSize is set. The data goes through the same upload as
+// TransferFile, so the file is replaced atomically, owned by the user and throttled.
 func (s *Server) PutFile(ctx context.Context, req *pb.PutFileRequest) (*pb.PutFileResponse, error) {
 	klog.V(5).InfoS("PutFile request", "remote_path", req.RemotePath)
 	klog.V(9).InfoS("File data", "data_length", len(req.FileData))
 
-	auth, err := GetAuthInfoFromContext(ctx)
-	if err != nil {
-		return nil, status.Errorf(codes.Unauthenticated, "invalid auth info: %v", err)
+	if err := s.checkLegacyRPC("PutFile"); err != nil {
+		return nil, err
 	}
-
-	filePath, err := utils.ExpandHomeDirectory(auth.User, req.RemotePath)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to expend home directory: %v", err)
+	if int64(len(req.FileData)) > s.LegacyRPCMaxSize {
+		return nil, status.Errorf(codes.ResourceExhausted, "file of %d bytes exceeds the PutFile limit of %d bytes, use TransferFile", len(req.FileData), s.LegacyRPCMaxSize)
 	}
 
-	klog.V(5).InfoS("Expanded file path", "file_path", filePath)
-
-	// Ensure the directory exists
-	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
-		return &pb.PutFileResponse{Message: err.Error(), Success: false}, nil
+	control := &pb.ControlMessage{
+		Operation: pb.ControlMessage_UPLOAD,
+		Info: &pb.FileInfo{
+			LocalPath:  req.LocalPath,
+			RemotePath: req.RemotePath,
+			FileSize:   int64(len(req.FileData)),
+		},
 	}
-
-	// Write the file with appropriate permissions
-	if err := os.WriteFile(filePath, req.FileData, 0644); err != nil {
-		return &pb.PutFileResponse{Message: err.Error(), Success: false}, nil
+	stream := &unaryTransferStream{
+		ctx:  ctx,
+		send: func(*pb.FileTransferMessage) error { return nil },
+	}
+	// Uploads accept chunks up to the largest chunk size when none is requested
+	for off := 0; off < len(req.FileData); off += s.ChunkSizes.Max {
+		chunk := req.FileData[off:min(off+s.ChunkSizes.Max, len(req.FileData))]
+		stream.in = append(stream.in, &pb.FileTransferMessage{
+			Payload: &pb.FileTransferMessage_Data{Data: &pb.FileData{Data: chunk}},
+		})
 	}
 
+	if err := s.handleTransfer(stream, control); err != nil {
+		return &pb.PutFileResponse{Message: status.Convert(err).Message(), Success: false}, nil
+	}
 	return &pb.PutFileResponse{Success: true, Message: "File transferred"}, nil
 }
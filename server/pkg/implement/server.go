@@ -1,21 +1,61 @@
 package implement
 
 import (
+	"time"
+
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/audit"
 	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/authenicate"
 	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/contentstore"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/policy"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/throttle"
 )
 
 // Server struct implementing pb.ConnectionServiceServer
 type Server struct {
 	pb.UnimplementedConnectionServiceServer
 	SSHAuthenticator *authenicate.SSHAuthenticator
+	PamAuthenticator *authenicate.PamAuthenticator
 	WhiteList        map[string]bool
+	// AuthLimiter throttles clients with repeated authentication failures, nil disables it
+	AuthLimiter *authenicate.FailureLimiter
+	// PamSessions opens a PAM session around every executed command
+	PamSessions bool
+	// Audit records authentication attempts, commands and file transfers, nil disables it
+	Audit *audit.Logger
+	// Policy confines file operations per user and chroots commands, users with confined
+	// paths and no chroot may not run commands. nil leaves both unrestricted.
+	Policy *policy.Policy
+	// Throttle limits the bandwidth of file transfers, nil leaves them unthrottled unless
+	// the client asks for a rate
+	Throttle *throttle.Limiter
+	// Store keeps uploaded contents for HaveContent and uploads by digest, nil disables it
+	Store *contentstore.Store
+	// ChunkSizes bounds the data chunks of file transfers
+	ChunkSizes ChunkSizes
+	// MaxRecvMsgSize and MaxSendMsgSize are the gRPC message size limits, advertised to clients
+	MaxRecvMsgSize int
+	MaxSendMsgSize int
+	// PartialFileTTL is how long the partial files of resumable uploads are kept without being
+	// written to, 0 keeps them until they are resumed
+	PartialFileTTL time.Duration
+	// LegacyRPCMaxSize caps the file size of the deprecated PutFile and FetchFile RPCs, 0
+	// disables them
+	LegacyRPCMaxSize int64
+
+	// transfers lists the running file transfers for the admin service
+	transfers transferRegistry
 }
 
 // NewServer creates a new Server instance
-func NewServer(whiteList map[string]bool, sshAuthenticator *authenicate.SSHAuthenticator) *Server {
+func NewServer(whiteList map[string]bool, sshAuthenticator *authenicate.SSHAuthenticator, pamAuthenticator *authenicate.PamAuthenticator) *Server {
 	return &Server{
 		SSHAuthenticator: sshAuthenticator,
+		PamAuthenticator: pamAuthenticator,
 		WhiteList:        whiteList,
+		ChunkSizes:       DefaultChunkSizes,
+		MaxRecvMsgSize:   DefaultMaxRecvMsgSize,
+		MaxSendMsgSize:   DefaultMaxSendMsgSize,
+		PartialFileTTL:   DefaultPartialFileTTL,
 	}
 }
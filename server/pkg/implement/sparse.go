@@ -0,0 +1,145 @@
+package implement
+
+import (
+	"context"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"syscall"
+
+	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/metrics"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/policy"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/throttle"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// errNotRegular is returned for transfers of FIFOs, devices, sockets and directories
+var errNotRegular = errors.New("not a regular file")
+
+// openRegularFile opens path for reading, refusing anything but a regular file. Reading a
+// FIFO or a device could block forever, so path is checked before opening it, and once more
+// on the opened file, which is opened non-blocking in case it was swapped in between.
+func openRegularFile(path *policy.Path) (*os.File, error) {
+	st, err := path.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !st.Mode().IsRegular() {
+		return nil, &os.PathError{Op: "open", Path: path.String(), Err: errNotRegular}
+	}
+	f, err := path.Open(os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	if st, err = f.Stat(); err != nil || !st.Mode().IsRegular() {
+		f.Close()
+		if err == nil {
+			err = &os.PathError{Op: "open", Path: path.String(), Err: errNotRegular}
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// sendSparse sends file from offset to size like a plain download, except that its holes
+// are sent as hole messages instead of zeros. Holes are found with SEEK_DATA and SEEK_HOLE,
+// filesystems without support report the whole file as data. Returns the bytes covered,
+// holes included.
+func sendSparse(stream pb.ConnectionService_TransferFileServer, file *os.File, offset, size int64, buffer []byte, hasher hash.Hash, limit *throttle.Transfer) (int64, error) {
+	fd := int(file.Fd())
+	pos := offset
+	for pos < size {
+		data, err := unix.Seek(fd, pos, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// Nothing but a hole up to the end of the file
+			data = size
+		} else if err != nil {
+			return pos - offset, fileError(err, codes.Internal, "failed to find data: %v", err)
+		}
+		data = min(data, size)
+		if data > pos {
+			msg := &pb.FileTransferMessage{
+				Payload: &pb.FileTransferMessage_Data{Data: &pb.FileData{Hole: data - pos}},
+			}
+			if err := stream.Send(msg); err != nil {
+				return pos - offset, status.Errorf(codes.Unknown, "failed to send hole: %v", err)
+			}
+			if err := hashHole(stream.Context(), hasher, data-pos, limit); err != nil {
+				return pos - offset, err
+			}
+			klog.V(5).InfoS("Sent hole", "offset", pos, "length", data-pos)
+			pos = data
+			continue
+		}
+
+		end, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return pos - offset, fileError(err, codes.Internal, "failed to find hole: %v", err)
+		}
+		for end = min(end, size); pos < end; {
+			n, err := file.ReadAt(buffer[:min(int64(len(buffer)), end-pos)], pos)
+			if n > 0 {
+				if err := waitThrottle(stream.Context(), limit, n); err != nil {
+					return pos - offset, err
+				}
+				msg := &pb.FileTransferMessage{
+					Payload: &pb.FileTransferMessage_Data{Data: &pb.FileData{Data: buffer[:n]}},
+				}
+				if err := stream.Send(msg); err != nil {
+					return pos - offset, status.Errorf(codes.Unknown, "failed to send file chunk: %v", err)
+				}
+				hasher.Write(buffer[:n])
+				pos += int64(n)
+				metrics.TransferBytes.WithLabelValues("download").Add(float64(n))
+			}
+			if err == io.EOF {
+				// The file shrank, the final size tells the client
+				return pos - offset, nil
+			}
+			if err != nil {
+				return pos - offset, fileError(err, codes.Internal, "failed to read file: %v", err)
+			}
+		}
+	}
+	return pos - offset, nil
+}
+
+// holeHashChunk is how many zeros of a hole are hashed between checks of the RPC and the
+// throttle
+const holeHashChunk = 1 << 20
+
+// skipHole leaves a hole of n bytes in an upload instead of writing zeros. The client chooses
+// n, so it has to fit into the remaining bytes of the announced file size.
+func skipHole(ctx context.Context, file *atomicFile, hasher hash.Hash, n, remaining int64, limit *throttle.Transfer) error {
+	if n < 0 {
+		return status.Errorf(codes.InvalidArgument, "negative hole of %d bytes", n)
+	}
+	if n > remaining {
+		return status.Errorf(codes.InvalidArgument, "hole of %d bytes exceeds the %d bytes left of the file size", n, max(remaining, 0))
+	}
+	if _, err := file.Seek(n, io.SeekCurrent); err != nil {
+		return fileError(err, codes.Internal, "failed to seek file: %v", err)
+	}
+	return hashHole(ctx, hasher, n, limit)
+}
+
+// hashHole adds the n zeros of a hole to hasher. Hashing them costs as much as hashing data,
+// so holes pass the throttle like data and stop with the RPC.
+func hashHole(ctx context.Context, hasher hash.Hash, n int64, limit *throttle.Transfer) error {
+	for n > 0 {
+		chunk := min(n, holeHashChunk)
+		if err := waitThrottle(ctx, limit, int(chunk)); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(hasher, zeroReader{}, chunk); err != nil {
+			return fileError(err, codes.Internal, "failed to checksum hole: %v", err)
+		}
+		n -= chunk
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package implement
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func holeMsg(n int64) *pb.FileTransferMessage {
+	return &pb.FileTransferMessage{Payload: &pb.FileTransferMessage_Data{Data: &pb.FileData{Hole: n}}}
+}
+
+func TestSparseUpload(t *testing.T) {
+	const mb = 1 << 20
+	tests := []struct {
+		name     string
+		info     *pb.FileInfo
+		msgs     []*pb.FileTransferMessage
+		wantCode codes.Code
+		want     string
+	}{
+		{
+			name: "hole between data",
+			info: &pb.FileInfo{Sparse: true, FileSize: 2*mb + 8},
+			msgs: []*pb.FileTransferMessage{dataMsg("head"), holeMsg(2 * mb), dataMsg("tail")},
+			want: "head" + strings.Repeat("\x00", 2*mb) + "tail",
+		},
+		{
+			name: "trailing hole",
+			info: &pb.FileInfo{Sparse: true, FileSize: 2*mb + 4},
+			msgs: []*pb.FileTransferMessage{dataMsg("head"), holeMsg(2 * mb)},
+			want: "head" + strings.Repeat("\x00", 2*mb),
+		},
+		{
+			name:     "hole past the end of the file",
+			info:     &pb.FileInfo{Sparse: true, FileSize: 8},
+			msgs:     []*pb.FileTransferMessage{dataMsg("head"), holeMsg(10)},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "hole larger than the file",
+			info:     &pb.FileInfo{Sparse: true, FileSize: 4},
+			msgs:     []*pb.FileTransferMessage{holeMsg(1 << 50)},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "data past the file size",
+			info:     &pb.FileInfo{Sparse: true, FileSize: 8},
+			msgs:     []*pb.FileTransferMessage{dataMsg("head"), holeMsg(4), dataMsg("tail")},
+			wantCode: codes.DataLoss,
+		},
+		{
+			name:     "negative hole",
+			info:     &pb.FileInfo{Sparse: true, FileSize: 8},
+			msgs:     []*pb.FileTransferMessage{dataMsg("head"), holeMsg(-4)},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "hole without file size",
+			info:     &pb.FileInfo{Sparse: true},
+			msgs:     []*pb.FileTransferMessage{holeMsg(4)},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "hole in a plain upload",
+			info:     &pb.FileInfo{FileSize: 8},
+			msgs:     []*pb.FileTransferMessage{dataMsg("head"), holeMsg(4)},
+			wantCode: codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := filepath.Join(t.TempDir(), "file")
+			tt.info.RemotePath = target
+			if tt.wantCode == codes.OK {
+				tt.info.Checksum = sha256Hex(tt.want)
+			}
+			stream := newTransferStream(t, append([]*pb.FileTransferMessage{controlMsg(pb.ControlMessage_UPLOAD, tt.info)}, tt.msgs...)...)
+			err := NewServer(nil, nil, nil).TransferFile(stream)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("TransferFile error %v, want code %v", err, tt.wantCode)
+			}
+			if tt.wantCode != codes.OK {
+				if _, err := os.Stat(target); !os.IsNotExist(err) {
+					t.Errorf("failed upload created the target: %v", err)
+				}
+				return
+			}
+			if got, err := os.ReadFile(target); err != nil || string(got) != tt.want {
+				t.Errorf("target holds %d bytes, %v, want %d bytes", len(got), err, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestSparseDownload(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "file")
+	f, err := os.Create(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("tail"), 4<<20); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if st, err := os.Stat(source); err != nil || st.Sys().(*syscall.Stat_t).Blocks*512 >= 4<<20 {
+		t.Skipf("the filesystem does not support holes: %v", err)
+	}
+
+	stream := newTransferStream(t, controlMsg(pb.ControlMessage_DOWNLOAD, &pb.FileInfo{RemotePath: source, Sparse: true}))
+	if err := NewServer(nil, nil, nil).TransferFile(stream); err != nil {
+		t.Fatalf("TransferFile: %v", err)
+	}
+	var got bytes.Buffer
+	var holes int64
+	for _, msg := range stream.sent {
+		if data, ok := msg.Payload.(*pb.FileTransferMessage_Data); ok {
+			got.Write(data.Data.Data)
+			got.Write(make([]byte, data.Data.Hole))
+			holes += data.Data.Hole
+		}
+	}
+	want := strings.Repeat("\x00", 4<<20) + "tail"
+	if got.String() != want || stream.last(t).Info.GetChecksum() != sha256Hex(want) {
+		t.Errorf("sparse download of %d bytes with checksum %s, want %d bytes", got.Len(), stream.last(t).Info.GetChecksum(), len(want))
+	}
+	if holes == 0 {
+		t.Errorf("sparse download sent the hole as data")
+	}
+
+	// Special files are refused instead of blocking the download
+	fifo := filepath.Join(dir, "fifo")
+	if err := syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Fatal(err)
+	}
+	stream = newTransferStream(t, controlMsg(pb.ControlMessage_DOWNLOAD, &pb.FileInfo{RemotePath: fifo}))
+	if err := NewServer(nil, nil, nil).TransferFile(stream); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("download of a FIFO: error %v, want code %v", err, codes.FailedPrecondition)
+	}
+}
@@ -0,0 +1,112 @@
+package implement
+
+import (
+	"fmt"
+	"io"
+
+	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// batchStream hands the messages of one transfer of a batch to its handler. The handler sees
+// the end of the stream once the transfer's data has been ended, so it cannot consume the
+// control message starting the next transfer.
+type batchStream struct {
+	pb.ConnectionService_TransferFileServer
+	// ended is set once the control message or end of stream ending the transfer was received
+	ended bool
+	// closed is set once the client closed its side of the stream
+	closed bool
+}
+
+func (b *batchStream) Recv() (*pb.FileTransferMessage, error) {
+	if b.ended {
+		return nil, io.EOF
+	}
+	msg, err := b.ConnectionService_TransferFileServer.Recv()
+	if err == io.EOF {
+		b.ended, b.closed = true, true
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := msg.Payload.(*pb.FileTransferMessage_Control); ok {
+		b.ended = true
+	}
+	return msg, nil
+}
+
+// skip discards the remaining messages of the current transfer
+func (b *batchStream) skip() error {
+	for !b.ended {
+		if _, err := b.Recv(); err != nil && err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleBatch runs the transfers of a stream one after the other until the client closes
+// it. A failed transfer is reported to the client and does not end the stream, unless the
+// stream itself broke.
+func (s *Server) handleBatch(stream pb.ConnectionService_TransferFileServer, control *pb.ControlMessage) error {
+	b := &batchStream{ConnectionService_TransferFileServer: stream}
+	var transfers, failed int
+	for {
+		transfers++
+		b.ended = !sendsData(control)
+		if err := s.handleTransfer(b, control); err != nil {
+			failed++
+			if stream.Context().Err() != nil {
+				return err
+			}
+			klog.V(3).InfoS("Transfer in batch failed", "operation", control.Operation, "remote_path", control.Info.GetRemotePath(), "err", err)
+			if err := b.skip(); err != nil {
+				return status.Errorf(codes.Unknown, "failed to receive data: %v", err)
+			}
+			if err := sendTransferError(stream, control, err); err != nil {
+				return status.Errorf(codes.Unknown, "failed to send transfer error: %v", err)
+			}
+		}
+		if b.closed {
+			break
+		}
+
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			klog.ErrorS(err, "Failed to receive next transfer in batch")
+			return status.Errorf(codes.Unknown, "failed to receive control message: %v", err)
+		}
+		payload, ok := msg.Payload.(*pb.FileTransferMessage_Control)
+		if !ok {
+			errMsg := "expected ControlMessage to start the next transfer"
+			klog.ErrorS(nil, errMsg, "received_type", fmt.Sprintf("%T", msg.Payload))
+			return status.Errorf(codes.InvalidArgument, errMsg)
+		}
+		control = payload.Control
+	}
+	klog.V(3).InfoS("Batch completed", "transfers", transfers, "failed", failed)
+	return nil
+}
+
+// sendsData reports whether the client follows control with data ended by a control message
+func sendsData(control *pb.ControlMessage) bool {
+	switch control.Operation {
+	case pb.ControlMessage_UPLOAD:
+		// Probing a resumable upload and placing stored content are single messages
+		if control.Info.GetContentDigest() != "" {
+			return false
+		}
+		return !(control.Info.GetTransferId() != "" && control.Info.GetOffset() < 0)
+	case pb.ControlMessage_UPLOAD_TREE, pb.ControlMessage_UPLOAD_DELTA:
+		return true
+	default:
+		return false
+	}
+}
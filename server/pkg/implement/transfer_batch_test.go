@@ -0,0 +1,86 @@
+package implement
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// batchMsg is controlMsg for the first message of a batch
+func batchMsg(op pb.ControlMessage_Operation, info *pb.FileInfo) *pb.FileTransferMessage {
+	msg := controlMsg(op, info)
+	msg.Payload.(*pb.FileTransferMessage_Control).Control.Batch = true
+	return msg
+}
+
+func TestBatch(t *testing.T) {
+	dir := t.TempDir()
+	a, b, c := filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "c")
+	stream := newTransferStream(t,
+		batchMsg(pb.ControlMessage_UPLOAD, &pb.FileInfo{RemotePath: a}),
+		dataMsg("A"),
+		controlMsg(pb.ControlMessage_UPLOAD, &pb.FileInfo{Checksum: sha256Hex("A")}),
+		controlMsg(pb.ControlMessage_UPLOAD, &pb.FileInfo{RemotePath: b, Checksum: sha256Hex("other")}),
+		dataMsg("B"),
+		dataMsg("B"),
+		controlMsg(pb.ControlMessage_UPLOAD, &pb.FileInfo{}),
+		controlMsg(pb.ControlMessage_DOWNLOAD, &pb.FileInfo{RemotePath: a}),
+		controlMsg(pb.ControlMessage_DOWNLOAD, &pb.FileInfo{RemotePath: filepath.Join(dir, "missing")}),
+		controlMsg(pb.ControlMessage_UPLOAD, &pb.FileInfo{RemotePath: c}),
+		dataMsg("C"),
+	)
+	if err := NewServer(nil, nil, nil).TransferFile(stream); err != nil {
+		t.Fatalf("TransferFile: %v", err)
+	}
+
+	for path, want := range map[string]string{a: "A", c: "C"} {
+		if got, err := os.ReadFile(path); err != nil || string(got) != want {
+			t.Errorf("%s holds %q, %v, want %q", path, got, err, want)
+		}
+	}
+	if _, err := os.Stat(b); !os.IsNotExist(err) {
+		t.Errorf("failed upload in the batch created its file: %v", err)
+	}
+
+	// Every transfer is answered in order, failed ones with their status
+	var results []codes.Code
+	var downloaded string
+	for _, msg := range stream.sent {
+		switch payload := msg.Payload.(type) {
+		case *pb.FileTransferMessage_Data:
+			downloaded += string(payload.Data.Data)
+		case *pb.FileTransferMessage_Control:
+			switch {
+			case payload.Control.Status != nil:
+				results = append(results, codes.Code(payload.Control.Status.Code))
+			case payload.Control.Info.GetChecksum() != "":
+				// Acknowledgements and the end of downloads carry the checksum
+				results = append(results, codes.OK)
+			}
+		}
+	}
+	if want := []codes.Code{codes.OK, codes.DataLoss, codes.OK, codes.NotFound, codes.OK}; !slices.Equal(results, want) {
+		t.Errorf("batch answered %v, want %v", results, want)
+	}
+	if downloaded != "A" {
+		t.Errorf("batch downloaded %q, want %q", downloaded, "A")
+	}
+}
+
+func TestBatchExpectsControl(t *testing.T) {
+	dir := t.TempDir()
+	stream := newTransferStream(t,
+		batchMsg(pb.ControlMessage_UPLOAD, &pb.FileInfo{RemotePath: filepath.Join(dir, "a")}),
+		dataMsg("A"),
+		controlMsg(pb.ControlMessage_UPLOAD, &pb.FileInfo{}),
+		dataMsg("stray"),
+	)
+	if err := NewServer(nil, nil, nil).TransferFile(stream); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("TransferFile error %v, want code %v", err, codes.InvalidArgument)
+	}
+}
@@ -0,0 +1,282 @@
+package implement
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/delta"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/metrics"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// signatureBatchSize is the number of block signatures sent per message
+const signatureBatchSize = 4096
+
+// handleUploadDelta rebuilds a file from the copy of it the server already has and the
+// differences sent by the client. The new file is staged and renamed over the old one like
+// a plain upload, which is also what happens when there is no old file to start from.
+func (s *Server) handleUploadDelta(stream pb.ConnectionService_TransferFileServer, info *pb.FileInfo) (err error) {
+	if info == nil {
+		errMsg := "missing FileInfo in delta upload"
+		klog.ErrorS(nil, errMsg)
+		return status.Errorf(codes.InvalidArgument, errMsg)
+	}
+
+	auth, err := GetAuthInfoFromContext(stream.Context())
+	if err != nil {
+		klog.ErrorS(err, "Failed to retrieve auth info for delta upload")
+		return status.Errorf(codes.Unauthenticated, "invalid auth info: %v", err)
+	}
+
+	path, err := s.resolvePath(auth.User, info.RemotePath)
+	if err != nil {
+		klog.ErrorS(err, "Failed to resolve path for delta upload", "remote_path", info.RemotePath)
+		return err
+	}
+	defer path.Close()
+	filePath := path.String()
+	klog.V(3).InfoS("Starting delta upload", "local_path", info.LocalPath, "file_path", filePath, "file_size", info.FileSize)
+
+	hasher, err := newHasher(info.ChecksumAlgorithm)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	expectedChecksum := strings.ToLower(info.Checksum)
+
+	limit, err := s.transferThrottle(auth.User, info)
+	if err != nil {
+		return err
+	}
+
+	uid, gid, err := uploadOwnership(auth.User, info)
+	if err != nil {
+		klog.ErrorS(err, "Rejected ownership for delta upload", "user", auth.User, "owner", info.Owner, "group", info.Group)
+		return err
+	}
+	if err := checkUploadXattrs(auth.User, info); err != nil {
+		klog.ErrorS(err, "Rejected extended attributes for delta upload", "user", auth.User)
+		return err
+	}
+
+	var fileSize, literalBytes int64
+	defer func() {
+		// The rebuilt file is discarded on failure, nothing is committed
+		err = transferFailure(err, pb.ControlMessage_UPLOAD_DELTA, filePath, 0)
+		s.auditTransfer(stream.Context(), auth.User, "upload_delta", filePath, fileSize, checksumLabel(info.ChecksumAlgorithm, hex.EncodeToString(hasher.Sum(nil))), err)
+	}()
+
+	// The old file is the base the client's instructions refer to, a missing one is empty.
+	// Both it and the staged file are opened with the user's permissions.
+	var file *atomicFile
+	var base *os.File
+	var baseErr error
+	err = runAsUser(auth.User, func() error {
+		if err := path.Dir().MkdirAll(0755); err != nil {
+			return fmt.Errorf("failed to create directories: %w", err)
+		}
+		var err error
+		if file, err = createAtomicFile(path, 0644); err != nil {
+			return fmt.Errorf("failed to create file: %w", err)
+		}
+		base, baseErr = openRegularFile(file.Target())
+		return nil
+	})
+	if err != nil {
+		klog.ErrorS(err, "Failed to create file for delta upload", "file_path", filePath)
+		return fileError(err, codes.Internal, "%v", err)
+	}
+	defer file.CleanupAsUser(auth.User)
+
+	var baseSize int64
+	switch err := baseErr; {
+	case err == nil:
+		defer base.Close()
+		st, err := base.Stat()
+		if err != nil {
+			return fileError(err, codes.Internal, "failed to stat file: %v", err)
+		}
+		baseSize = st.Size()
+	case errors.Is(err, os.ErrNotExist):
+		base = nil
+	default:
+		klog.ErrorS(err, "Failed to open base file for delta upload", "file_path", file.Target())
+		return fileError(err, codes.Internal, "failed to open file: %v", err)
+	}
+
+	blockSize := int(info.BlockSize)
+	if blockSize == 0 {
+		blockSize = delta.BlockSize(baseSize)
+	}
+	if err := delta.ValidBlockSize(blockSize); err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	controlMsg := &pb.FileTransferMessage{
+		Payload: &pb.FileTransferMessage_Control{
+			Control: &pb.ControlMessage{
+				Operation: pb.ControlMessage_UPLOAD_DELTA,
+				Info: &pb.FileInfo{
+					LocalPath:  info.LocalPath,
+					RemotePath: info.RemotePath,
+					FileSize:   baseSize,
+					BlockSize:  int32(blockSize),
+				},
+			},
+		},
+	}
+	if err := stream.Send(controlMsg); err != nil {
+		klog.ErrorS(err, "Failed to send ControlMessage for delta upload", "file_path", filePath)
+		return status.Errorf(codes.Unknown, "failed to send control message: %v", err)
+	}
+
+	var baseReader io.ReaderAt = strings.NewReader("")
+	if base != nil {
+		baseReader = base
+	}
+	if err := sendSignatures(stream, io.NewSectionReader(baseReader, 0, baseSize), blockSize); err != nil {
+		klog.ErrorS(err, "Failed to send block signatures for delta upload", "file_path", filePath)
+		return err
+	}
+
+	patcher, err := delta.NewPatcher(baseReader, baseSize, blockSize)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	out := io.MultiWriter(file, hasher)
+
+receive:
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			klog.ErrorS(err, "Failed to receive delta instruction", "file_path", filePath, "file_size", fileSize)
+			return status.Errorf(codes.Unknown, "failed to receive delta instruction: %v", err)
+		}
+
+		switch payload := msg.Payload.(type) {
+		case *pb.FileTransferMessage_Delta:
+			// Only the literal data crosses the network
+			if err := waitThrottle(stream.Context(), limit, len(payload.Delta.Literal)); err != nil {
+				return err
+			}
+			op := delta.Op{
+				Index:   payload.Delta.BlockIndex,
+				Count:   payload.Delta.BlockCount,
+				Literal: payload.Delta.Literal,
+			}
+			n, err := patcher.Apply(out, op)
+			fileSize += n
+			if err != nil {
+				klog.ErrorS(err, "Failed to apply delta instruction", "file_path", filePath, "file_size", fileSize)
+				return status.Errorf(codes.InvalidArgument, "failed to apply delta instruction: %v", err)
+			}
+			literalBytes += int64(len(op.Literal))
+			metrics.TransferBytes.WithLabelValues("upload").Add(float64(len(op.Literal)))
+			if info.FileSize > 0 && fileSize > info.FileSize {
+				return status.Errorf(codes.DataLoss, "file size mismatch: expected %d bytes, rebuilt more", info.FileSize)
+			}
+		case *pb.FileTransferMessage_Control:
+			if payload.Control.Info != nil && payload.Control.Info.Checksum != "" {
+				expectedChecksum = strings.ToLower(payload.Control.Info.Checksum)
+			}
+			break receive
+		default:
+			errMsg := "expected DeltaInstruction message during delta upload"
+			klog.ErrorS(nil, errMsg, "received_type", fmt.Sprintf("%T", msg.Payload))
+			return status.Errorf(codes.InvalidArgument, errMsg)
+		}
+	}
+	klog.V(3).InfoS("Delta upload completed", "file_path", filePath, "file_size", fileSize, "literal_bytes", literalBytes)
+
+	if info.FileSize > 0 && fileSize != info.FileSize {
+		errMsg := fmt.Sprintf("file size mismatch: expected %d bytes, rebuilt %d bytes", info.FileSize, fileSize)
+		klog.ErrorS(nil, errMsg, "file_path", filePath)
+		return status.Errorf(codes.DataLoss, errMsg)
+	}
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+	if expectedChecksum != "" && checksum != expectedChecksum {
+		errMsg := fmt.Sprintf("checksum mismatch: expected %s, computed %s", expectedChecksum, checksum)
+		klog.ErrorS(nil, errMsg, "file_path", filePath, "algorithm", info.ChecksumAlgorithm)
+		return status.Errorf(codes.DataLoss, errMsg)
+	}
+
+	if err := file.Chown(uid, gid); err != nil {
+		klog.ErrorS(err, "Failed to change ownership of file", "file_path", filePath)
+		return fileError(err, codes.Internal, "failed to change ownership of file: %v", err)
+	}
+	if err := applyUploadAttributes(file.File, info); err != nil {
+		klog.ErrorS(err, "Failed to apply file attributes", "file_path", filePath)
+		return fileError(err, codes.Internal, "failed to apply file attributes: %v", err)
+	}
+	if err := applyUploadXattrs(auth.User, file, info); err != nil {
+		klog.ErrorS(err, "Failed to apply extended attributes", "file_path", filePath)
+		return err
+	}
+	if err := runAsUser(auth.User, file.Commit); err != nil {
+		klog.ErrorS(err, "Failed to commit delta upload", "file_path", filePath, "temp_path", file.Name())
+		return fileError(err, codes.Internal, "failed to commit file: %v", err)
+	}
+
+	ackMsg := &pb.FileTransferMessage{
+		Payload: &pb.FileTransferMessage_Control{
+			Control: &pb.ControlMessage{
+				Operation: pb.ControlMessage_COMPLETE,
+				Info: &pb.FileInfo{
+					LocalPath:         info.LocalPath,
+					RemotePath:        info.RemotePath,
+					FileSize:          fileSize,
+					ChecksumAlgorithm: info.ChecksumAlgorithm,
+					Checksum:          checksum,
+					BlockSize:         int32(blockSize),
+				},
+			},
+		},
+	}
+	if err := stream.Send(ackMsg); err != nil {
+		klog.ErrorS(err, "Failed to send acknowledgment after delta upload", "file_path", filePath)
+		return status.Errorf(codes.Unknown, "failed to send acknowledgment: %v", err)
+	}
+	return nil
+}
+
+// sendSignatures streams the block signatures of base in batches, the last one flagged even
+// when base is empty
+func sendSignatures(stream pb.ConnectionService_TransferFileServer, base io.Reader, blockSize int) error {
+	batch := &pb.BlockSignatures{}
+	send := func() error {
+		msg := &pb.FileTransferMessage{
+			Payload: &pb.FileTransferMessage_Signatures{Signatures: batch},
+		}
+		if err := stream.Send(msg); err != nil {
+			return status.Errorf(codes.Unknown, "failed to send block signatures: %v", err)
+		}
+		batch = &pb.BlockSignatures{}
+		return nil
+	}
+
+	err := delta.Signatures(bufio.NewReaderSize(base, blockSize), blockSize, func(b delta.Block) error {
+		batch.Blocks = append(batch.Blocks, &pb.BlockSignature{Weak: b.Weak, Strong: b.Strong})
+		if len(batch.Blocks) == signatureBatchSize {
+			return send()
+		}
+		return nil
+	})
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return fileError(err, codes.Internal, "failed to read file: %v", err)
+	}
+	batch.Last = true
+	return send()
+}
@@ -0,0 +1,75 @@
+package implement
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// statusError is a status error that keeps the error it was made from, so the errno of a
+// failed file operation can still be reported
+type statusError struct {
+	st    *status.Status
+	cause error
+}
+
+func (e *statusError) Error() string              { return e.st.Err().Error() }
+func (e *statusError) GRPCStatus() *status.Status { return e.st }
+func (e *statusError) Unwrap() error              { return e.cause }
+
+// fileError returns the status error of the failed file operation err, with the code chosen
+// by fileErrorCode
+func fileError(err error, fallback codes.Code, format string, args ...any) error {
+	return &statusError{st: status.Newf(fileErrorCode(err, fallback), format, args...), cause: err}
+}
+
+// transferFailure adds a TransferErrorDetail to the status of a failed transfer, unless it
+// already has one. path is used when err does not name the path it failed at.
+func transferFailure(err error, op pb.ControlMessage_Operation, path string, committed int64) error {
+	if err == nil {
+		return nil
+	}
+	st := status.Convert(err)
+	for _, d := range st.Details() {
+		if _, ok := d.(*pb.TransferErrorDetail); ok {
+			return err
+		}
+	}
+
+	detail := &pb.TransferErrorDetail{Operation: op, Path: path, BytesCommitted: committed}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		detail.Path = pathErr.Path
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		detail.Errno = int32(errno)
+		detail.ErrnoName = unix.ErrnoName(errno)
+	}
+	withDetail, derr := st.WithDetails(detail)
+	if derr != nil {
+		return err
+	}
+	return withDetail.Err()
+}
+
+// sendTransferError reports the failed transfer started by control in an ERROR control message
+func sendTransferError(stream pb.ConnectionService_TransferFileServer, control *pb.ControlMessage, err error) error {
+	return stream.Send(&pb.FileTransferMessage{
+		Payload: &pb.FileTransferMessage_Control{
+			Control: &pb.ControlMessage{
+				Operation: pb.ControlMessage_ERROR,
+				Info: &pb.FileInfo{
+					LocalPath:  control.Info.GetLocalPath(),
+					RemotePath: control.Info.GetRemotePath(),
+				},
+				Status: status.Convert(err).Proto(),
+			},
+		},
+	})
+}
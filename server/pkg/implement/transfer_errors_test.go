@@ -0,0 +1,116 @@
+package implement
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+
+	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// operations returns the operations of the control messages in msgs, data messages as UNKNOWN
+func operations(msgs []*pb.FileTransferMessage) []pb.ControlMessage_Operation {
+	var ops []pb.ControlMessage_Operation
+	for _, msg := range msgs {
+		control, ok := msg.Payload.(*pb.FileTransferMessage_Control)
+		if !ok {
+			ops = append(ops, pb.ControlMessage_UNKNOWN)
+			continue
+		}
+		ops = append(ops, control.Control.Operation)
+	}
+	return ops
+}
+
+func TestTransferControlSequence(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing")
+	if err := os.WriteFile(existing, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		msgs    []*pb.FileTransferMessage
+		wantOps []pb.ControlMessage_Operation
+		// wantCode and wantDetail describe the ERROR of a failed transfer
+		wantCode   codes.Code
+		wantDetail *pb.TransferErrorDetail
+	}{
+		{
+			name:    "upload",
+			msgs:    []*pb.FileTransferMessage{controlMsg(pb.ControlMessage_UPLOAD, &pb.FileInfo{RemotePath: filepath.Join(dir, "new")}), dataMsg("content")},
+			wantOps: []pb.ControlMessage_Operation{pb.ControlMessage_COMPLETE},
+		},
+		{
+			name:    "download",
+			msgs:    []*pb.FileTransferMessage{controlMsg(pb.ControlMessage_DOWNLOAD, &pb.FileInfo{RemotePath: existing})},
+			wantOps: []pb.ControlMessage_Operation{pb.ControlMessage_DOWNLOAD, pb.ControlMessage_UNKNOWN, pb.ControlMessage_COMPLETE},
+		},
+		{
+			name:       "failed upload",
+			msgs:       []*pb.FileTransferMessage{controlMsg(pb.ControlMessage_UPLOAD, &pb.FileInfo{RemotePath: filepath.Join(dir, "bad"), Checksum: sha256Hex("other")}), dataMsg("content")},
+			wantOps:    []pb.ControlMessage_Operation{pb.ControlMessage_ERROR},
+			wantCode:   codes.DataLoss,
+			wantDetail: &pb.TransferErrorDetail{Operation: pb.ControlMessage_UPLOAD, Path: filepath.Join(dir, "bad")},
+		},
+		{
+			name:       "failed resumable upload",
+			msgs:       []*pb.FileTransferMessage{controlMsg(pb.ControlMessage_UPLOAD, &pb.FileInfo{RemotePath: filepath.Join(dir, "short"), TransferId: "t1", FileSize: 100}), dataMsg("content")},
+			wantOps:    []pb.ControlMessage_Operation{pb.ControlMessage_ERROR},
+			wantCode:   codes.DataLoss,
+			wantDetail: &pb.TransferErrorDetail{Operation: pb.ControlMessage_UPLOAD, Path: filepath.Join(dir, "short"), BytesCommitted: 7},
+		},
+		{
+			name:       "failed download",
+			msgs:       []*pb.FileTransferMessage{controlMsg(pb.ControlMessage_DOWNLOAD, &pb.FileInfo{RemotePath: filepath.Join(dir, "missing")})},
+			wantOps:    []pb.ControlMessage_Operation{pb.ControlMessage_ERROR},
+			wantCode:   codes.NotFound,
+			wantDetail: &pb.TransferErrorDetail{Operation: pb.ControlMessage_DOWNLOAD, Path: filepath.Join(dir, "missing"), Errno: int32(syscall.ENOENT), ErrnoName: "ENOENT"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := newTransferStream(t, tt.msgs...)
+			err := NewServer(nil, nil, nil).TransferFile(stream)
+			if got := operations(stream.sent); !slices.Equal(got, tt.wantOps) {
+				t.Errorf("server sent %v, want %v", got, tt.wantOps)
+			}
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("TransferFile error %v, want code %v", err, tt.wantCode)
+			}
+			last := stream.last(t)
+			if tt.wantDetail == nil {
+				if last.Status != nil {
+					t.Errorf("successful transfer ended with status %v", last.Status)
+				}
+				return
+			}
+
+			// The ERROR message and the status ending the stream carry the same detail
+			for _, st := range []*status.Status{status.FromProto(last.Status), status.Convert(err)} {
+				if st.Code() != tt.wantCode {
+					t.Errorf("status code %v, want %v", st.Code(), tt.wantCode)
+				}
+				var detail *pb.TransferErrorDetail
+				for _, d := range st.Details() {
+					if d, ok := d.(*pb.TransferErrorDetail); ok {
+						detail = d
+					}
+				}
+				if detail == nil {
+					t.Errorf("status %v has no TransferErrorDetail", st)
+					continue
+				}
+				if detail.Operation != tt.wantDetail.Operation || detail.Path != tt.wantDetail.Path || detail.BytesCommitted != tt.wantDetail.BytesCommitted ||
+					detail.Errno != tt.wantDetail.Errno || detail.ErrnoName != tt.wantDetail.ErrnoName {
+					t.Errorf("detail %v, want %v", detail, tt.wantDetail)
+				}
+			}
+		})
+	}
+}
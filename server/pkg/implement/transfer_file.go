@@ -2,14 +2,26 @@
 package implement
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
-	"path/filepath"
+	"strings"
+	"syscall"
 
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/audit"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/compression"
 	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
-	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/utils"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/metrics"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/policy"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
 )
@@ -25,29 +37,62 @@ func (s *Server) TransferFile(stream pb.ConnectionService_TransferFileServer) er
 		return status.Errorf(codes.InvalidArgument, "failed to receive initial message: %v", err)
 	}
 
-	switch payload := firstMsg.Payload.(type) {
-	case *pb.FileTransferMessage_Control:
-		switch payload.Control.Operation {
-		case pb.ControlMessage_UPLOAD:
-			klog.V(4).InfoS("Handling file upload operation", "remote_path", payload.Control.Info.RemotePath)
-			return s.handleUpload(stream, payload.Control.Info)
-		case pb.ControlMessage_DOWNLOAD:
-			klog.V(4).InfoS("Handling file download operation", "remote_path", payload.Control.Info.RemotePath)
-			return s.handleDownload(stream, payload.Control.Info)
-		default:
-			errMsg := fmt.Sprintf("unknown operation: %v", payload.Control.Operation)
-			klog.ErrorS(nil, errMsg, "operation", payload.Control.Operation)
-			return status.Errorf(codes.InvalidArgument, errMsg)
-		}
-	default:
+	payload, ok := firstMsg.Payload.(*pb.FileTransferMessage_Control)
+	if !ok {
 		errMsg := "expected ControlMessage as first message"
 		klog.ErrorS(nil, errMsg, "received_type", fmt.Sprintf("%T", firstMsg.Payload))
 		return status.Errorf(codes.InvalidArgument, errMsg)
 	}
+	if payload.Control.Batch {
+		return s.handleBatch(stream, payload.Control)
+	}
+	if err := s.handleTransfer(stream, payload.Control); err != nil {
+		// The status ending the stream repeats the error for clients not handling ERROR
+		if stream.Context().Err() == nil {
+			if serr := sendTransferError(stream, payload.Control, err); serr != nil {
+				klog.V(4).ErrorS(serr, "Failed to send transfer error")
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// handleTransfer runs the transfer started by control. Its errors carry a TransferErrorDetail.
+func (s *Server) handleTransfer(stream pb.ConnectionService_TransferFileServer, control *pb.ControlMessage) error {
+	tracked, stop := s.trackTransfer(stream, control)
+	err := s.runTransfer(tracked, control)
+	stop()
+	return transferFailure(err, control.Operation, control.Info.GetRemotePath(), 0)
+}
+
+// runTransfer dispatches the transfer started by control to the handler of its operation
+func (s *Server) runTransfer(stream pb.ConnectionService_TransferFileServer, control *pb.ControlMessage) error {
+	switch control.Operation {
+	case pb.ControlMessage_UPLOAD:
+		klog.V(4).InfoS("Handling file upload operation", "remote_path", control.Info.GetRemotePath())
+		return s.handleUpload(stream, control.Info)
+	case pb.ControlMessage_DOWNLOAD:
+		klog.V(4).InfoS("Handling file download operation", "remote_path", control.Info.GetRemotePath())
+		return s.handleDownload(stream, control.Info)
+	case pb.ControlMessage_UPLOAD_TREE:
+		klog.V(4).InfoS("Handling tree upload operation", "remote_path", control.Info.GetRemotePath())
+		return s.handleUploadTree(stream, control.Info)
+	case pb.ControlMessage_DOWNLOAD_TREE:
+		klog.V(4).InfoS("Handling tree download operation", "remote_path", control.Info.GetRemotePath())
+		return s.handleDownloadTree(stream, control.Info)
+	case pb.ControlMessage_UPLOAD_DELTA:
+		klog.V(4).InfoS("Handling delta upload operation", "remote_path", control.Info.GetRemotePath())
+		return s.handleUploadDelta(stream, control.Info)
+	default:
+		errMsg := fmt.Sprintf("unknown operation: %v", control.Operation)
+		klog.ErrorS(nil, errMsg, "operation", control.Operation)
+		return status.Errorf(codes.InvalidArgument, errMsg)
+	}
 }
 
 // handleUpload manages the upload process with detailed logging.
-func (s *Server) handleUpload(stream pb.ConnectionService_TransferFileServer, info *pb.FileInfo) error {
+func (s *Server) handleUpload(stream pb.ConnectionService_TransferFileServer, info *pb.FileInfo) (err error) {
 	if info == nil {
 		errMsg := "missing FileInfo in upload"
 		klog.ErrorS(nil, errMsg)
@@ -62,89 +107,300 @@ func (s *Server) handleUpload(stream pb.ConnectionService_TransferFileServer, in
 		return status.Errorf(codes.Unauthenticated, "invalid auth info: %v", err)
 	}
 
-	// Expand tilde in file path
-	filePath, err := utils.ExpandHomeDirectory(auth.User, info.RemotePath)
+	// Expand tilde in file path and confine it to the allowed paths
+	path, err := s.resolvePath(auth.User, info.RemotePath)
 	if err != nil {
-		klog.ErrorS(err, "Failed to expand home directory for upload", "remote_path", info.RemotePath)
-		return status.Errorf(codes.Internal, "failed to expand home directory: %v", err)
+		klog.ErrorS(err, "Failed to resolve path for upload", "remote_path", info.RemotePath)
+		return err
 	}
+	defer path.Close()
+	filePath := path.String()
 
 	klog.V(4).InfoS("Expanded file path for upload", "file_path", filePath)
 
-	// Ensure the directory exists
-	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
-		klog.ErrorS(err, "Failed to create directories for upload", "dir", filepath.Dir(filePath))
-		return status.Errorf(codes.Internal, "failed to create directories: %v", err)
+	hasher, err := newHasher(info.ChecksumAlgorithm)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
 	}
+	expectedChecksum := strings.ToLower(info.Checksum)
 
-	// Create the file with appropriate permissions
-	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	chunkSize, err := s.uploadChunkLimit(info.ChunkSize)
 	if err != nil {
-		klog.ErrorS(err, "Failed to create file for upload", "file_path", filePath)
-		return status.Errorf(codes.Internal, "failed to create file: %v", err)
+		return err
+	}
+	limit, err := s.transferThrottle(auth.User, info)
+	if err != nil {
+		return err
+	}
+
+	if info.TransferId != "" && info.Offset < 0 {
+		return s.handleUploadProbe(stream, info, auth.User, path)
+	}
+	if info.ContentDigest != "" && info.TransferId != "" {
+		return status.Errorf(codes.InvalidArgument, "stored content cannot be placed by a resumable upload")
+	}
+	if info.StoreContent && info.ChecksumAlgorithm != pb.FileInfo_SHA256 {
+		return status.Errorf(codes.InvalidArgument, "storing content requires the SHA256 checksum algorithm")
+	}
+	if info.TransferId == "" && info.Offset != 0 {
+		return status.Errorf(codes.InvalidArgument, "resuming an upload requires a transfer id")
 	}
+
+	// Check the requested ownership before any data is received
+	uid, gid, err := uploadOwnership(auth.User, info)
+	if err != nil {
+		klog.ErrorS(err, "Rejected ownership for upload", "user", auth.User, "owner", info.Owner, "group", info.Group)
+		return err
+	}
+	if err := checkUploadXattrs(auth.User, info); err != nil {
+		klog.ErrorS(err, "Rejected extended attributes for upload", "user", auth.User)
+		return err
+	}
+
+	var receivedBytes int64
+	var file *atomicFile
 	defer func() {
-		if cerr := file.Close(); cerr != nil {
-			klog.ErrorS(cerr, "Failed to close file after upload", "file_path", filePath)
+		// Only the partial file of a resumable upload outlives a failure
+		var committed int64
+		if file != nil && file.retain {
+			committed = info.Offset + receivedBytes
 		}
+		err = transferFailure(err, pb.ControlMessage_UPLOAD, filePath, committed)
+		s.auditTransfer(stream.Context(), auth.User, "upload", filePath, receivedBytes, checksumLabel(info.ChecksumAlgorithm, hex.EncodeToString(hasher.Sum(nil))), err)
 	}()
 
-	var receivedBytes int64
-	for {
-		msg, err := stream.Recv()
-		if err == io.EOF {
-			klog.V(3).InfoS("File upload completed", "file_path", filePath, "bytes_received", receivedBytes)
-			break
+	// Check the file being replaced before any data is received
+	if info.SkipUnchanged && expectedChecksum == "" {
+		return status.Errorf(codes.InvalidArgument, "skipping unchanged files requires the checksum in the first FileInfo")
+	}
+	if hasUploadConditions(info) {
+		var targetHasher hash.Hash
+		if info.IfChecksum != "" || info.SkipUnchanged {
+			targetHasher, _ = newHasher(info.ChecksumAlgorithm)
 		}
+		state, err := inspectTarget(auth.User, path, targetHasher)
 		if err != nil {
-			klog.ErrorS(err, "Failed to receive file chunk during upload", "file_path", filePath, "bytes_received", receivedBytes)
-			return status.Errorf(codes.Unknown, "failed to receive file chunk: %v", err)
+			klog.ErrorS(err, "Failed to inspect file for upload", "file_path", filePath)
+			return err
+		}
+		if err := checkUploadConditions(info, state); err != nil {
+			klog.V(3).InfoS("Upload condition not met", "file_path", filePath, "err", err)
+			return err
+		}
+		if info.SkipUnchanged && state.exists && state.checksum == expectedChecksum {
+			hasher = targetHasher
+			return s.skipUnchangedUpload(stream, info, state)
+		}
+	}
+
+	// Stage the upload in a temporary file, the target is replaced only once everything checks out.
+	// Resumable uploads use a partial file that outlives a broken stream. Directories and files
+	// are created with the user's permissions.
+	err = runAsUser(auth.User, func() error {
+		if err := path.Dir().MkdirAll(0755); err != nil {
+			return fmt.Errorf("failed to create directories: %w", err)
+		}
+		var err error
+		if info.TransferId != "" {
+			removeStalePartialFiles(path, s.PartialFileTTL)
+			file, err = openPartialFile(path, info.TransferId, 0644)
+		} else {
+			file, err = createAtomicFile(path, 0644)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create file: %w", err)
 		}
+		return nil
+	})
+	if err != nil {
+		klog.ErrorS(err, "Failed to create file for upload", "file_path", filePath)
+		return fileError(err, codes.Internal, "%v", err)
+	}
+	defer file.CleanupAsUser(auth.User)
 
-		dataPayload, ok := msg.Payload.(*pb.FileTransferMessage_Data)
-		if !ok {
-			errMsg := "expected FileData message during upload"
-			klog.ErrorS(nil, errMsg, "received_type", fmt.Sprintf("%T", msg.Payload))
-			return status.Errorf(codes.InvalidArgument, errMsg)
+	if info.TransferId != "" {
+		if err := resumePartialFile(file, info, hasher); err != nil {
+			klog.ErrorS(err, "Failed to resume upload", "file_path", filePath, "transfer_id", info.TransferId, "offset", info.Offset)
+			return err
 		}
+	}
 
-		// Write the chunk to the file
-		n, err := file.Write(dataPayload.Data.Data)
+	var sawHole bool
+	if info.ContentDigest != "" {
+		// The content comes from the store, the client sends no data
+		n, err := s.writeStoredContent(auth.User, info.ContentDigest, io.MultiWriter(file, hasher))
+		receivedBytes = n
 		if err != nil {
-			klog.ErrorS(err, "Failed to write to file during upload", "file_path", filePath, "bytes_received", receivedBytes)
-			return status.Errorf(codes.Internal, "failed to write to file: %v", err)
+			klog.ErrorS(err, "Failed to place stored content", "file_path", filePath, "digest", info.ContentDigest)
+			return err
+		}
+		klog.V(3).InfoS("Stored content placed", "file_path", filePath, "digest", info.ContentDigest, "file_size", n)
+	} else {
+	receive:
+		for {
+			msg, err := stream.Recv()
+			if err == io.EOF {
+				klog.V(3).InfoS("File upload completed", "file_path", filePath, "bytes_received", receivedBytes)
+				break
+			}
+			if err != nil {
+				klog.ErrorS(err, "Failed to receive file chunk during upload", "file_path", filePath, "bytes_received", receivedBytes)
+				return status.Errorf(codes.Unknown, "failed to receive file chunk: %v", err)
+			}
+
+			var dataPayload *pb.FileTransferMessage_Data
+			switch payload := msg.Payload.(type) {
+			case *pb.FileTransferMessage_Data:
+				dataPayload = payload
+			case *pb.FileTransferMessage_Control:
+				// A control message after the data ends the file and may carry its checksum
+				if payload.Control.Info != nil && payload.Control.Info.Checksum != "" {
+					expectedChecksum = strings.ToLower(payload.Control.Info.Checksum)
+				}
+				klog.V(3).InfoS("File upload completed", "file_path", filePath, "bytes_received", receivedBytes)
+				break receive
+			default:
+				errMsg := "expected FileData message during upload"
+				klog.ErrorS(nil, errMsg, "received_type", fmt.Sprintf("%T", msg.Payload))
+				return status.Errorf(codes.InvalidArgument, errMsg)
+			}
+			if hole := dataPayload.Data.Hole; hole != 0 {
+				if !info.Sparse || len(dataPayload.Data.Data) > 0 {
+					return status.Errorf(codes.InvalidArgument, "holes are only accepted alone in sparse uploads")
+				}
+				if info.FileSize <= 0 {
+					return status.Errorf(codes.InvalidArgument, "holes require the file size in the first FileInfo")
+				}
+				if err := skipHole(stream.Context(), file, hasher, hole, info.FileSize-info.Offset-receivedBytes, limit); err != nil {
+					return err
+				}
+				receivedBytes += hole
+				sawHole = true
+				klog.V(5).InfoS("Received hole", "file_path", filePath, "length", hole, "total_received", receivedBytes)
+				continue
+			}
+			if len(dataPayload.Data.Data) > chunkSize {
+				return status.Errorf(codes.InvalidArgument, "chunk of %d bytes exceeds the chunk size %d", len(dataPayload.Data.Data), chunkSize)
+			}
+
+			if err := waitThrottle(stream.Context(), limit, len(dataPayload.Data.Data)); err != nil {
+				return err
+			}
+
+			// Write the chunk to the file
+			n, err := file.Write(dataPayload.Data.Data)
+			if err != nil {
+				klog.ErrorS(err, "Failed to write to file during upload", "file_path", filePath, "bytes_received", receivedBytes)
+				return fileError(err, codes.Internal, "failed to write to file: %v", err)
+			}
+			hasher.Write(dataPayload.Data.Data[:n])
+			receivedBytes += int64(n)
+			metrics.TransferBytes.WithLabelValues("upload").Add(float64(n))
+			klog.V(5).InfoS("Received and wrote file chunk", "file_path", filePath, "bytes_written", n, "total_received", receivedBytes)
 		}
-		receivedBytes += int64(n)
-		klog.V(5).InfoS("Received and wrote file chunk", "file_path", filePath, "bytes_written", n, "total_received", receivedBytes)
 	}
 
-	// Optionally, verify the file size
-	if info.FileSize > 0 && receivedBytes != info.FileSize {
-		errMsg := fmt.Sprintf("file size mismatch: expected %d bytes, received %d bytes", info.FileSize, receivedBytes)
+	// A trailing hole only exists once the file is extended to its full size
+	if sawHole {
+		if err := file.Truncate(info.Offset + receivedBytes); err != nil {
+			klog.ErrorS(err, "Failed to extend sparse file", "file_path", filePath)
+			return fileError(err, codes.Internal, "failed to extend file: %v", err)
+		}
+	}
+
+	// Optionally, verify the file size. A short resumable upload keeps its partial file.
+	fileSize := info.Offset + receivedBytes
+	if info.FileSize > 0 && fileSize != info.FileSize {
+		errMsg := fmt.Sprintf("file size mismatch: expected %d bytes, received %d bytes", info.FileSize, fileSize)
 		klog.ErrorS(nil, errMsg, "file_path", filePath)
+		if fileSize > info.FileSize {
+			file.Discard()
+		}
 		return status.Errorf(codes.DataLoss, errMsg)
 	}
 
-	uid, gid, err := utils.GetUserIDs(auth.User)
-	if err != nil {
-		klog.ErrorS(err, "Failed to lookup user", "user", auth.User)
-		return status.Errorf(codes.Internal, "failed to lookup user: %v", err)
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+	if expectedChecksum != "" && checksum != expectedChecksum {
+		file.Discard()
+		errMsg := fmt.Sprintf("checksum mismatch: expected %s, computed %s", expectedChecksum, checksum)
+		klog.ErrorS(nil, errMsg, "file_path", filePath, "algorithm", info.ChecksumAlgorithm)
+		return status.Errorf(codes.DataLoss, errMsg)
 	}
 
-	if err := os.Chown(filePath, uid, gid); err != nil {
+	if info.StoreContent {
+		s.storeContent(auth.User, checksum, io.NewSectionReader(file, 0, fileSize), fileSize)
+	}
+
+	if err := file.Chown(uid, gid); err != nil {
 		klog.ErrorS(err, "Failed to change ownership of file", "file_path", filePath)
-		return status.Errorf(codes.Internal, "failed to change ownership of file: %v", err)
+		return fileError(err, codes.Internal, "failed to change ownership of file: %v", err)
+	}
+
+	if err := applyUploadAttributes(file.File, info); err != nil {
+		klog.ErrorS(err, "Failed to apply file attributes", "file_path", filePath)
+		return fileError(err, codes.Internal, "failed to apply file attributes: %v", err)
+	}
+	if err := applyUploadXattrs(auth.User, file, info); err != nil {
+		klog.ErrorS(err, "Failed to apply extended attributes", "file_path", filePath)
+		return err
+	}
+
+	// Recheck the conditions, the file may have changed while the data was received
+	if info.IfChecksum != "" || info.IfMtime != nil {
+		var targetHasher hash.Hash
+		if info.IfChecksum != "" {
+			targetHasher, _ = newHasher(info.ChecksumAlgorithm)
+		}
+		state, err := inspectTarget(auth.User, path, targetHasher)
+		if err != nil {
+			klog.ErrorS(err, "Failed to inspect file for upload", "file_path", filePath)
+			return err
+		}
+		if err := checkUploadConditions(info, state); err != nil {
+			klog.V(3).InfoS("Upload condition not met", "file_path", filePath, "err", err)
+			return err
+		}
 	}
 
+	result := pb.FileInfo_CREATED
+	var backupPath string
+	err = runAsUser(auth.User, func() (err error) {
+		if _, err := file.Target().Stat(); err == nil {
+			result = pb.FileInfo_REPLACED
+		}
+		if info.Backup {
+			backupPath, err = backupFile(file.Target())
+		}
+		return err
+	})
+	if err != nil {
+		klog.ErrorS(err, "Failed to back up file before upload", "file_path", filePath)
+		return fileError(err, codes.Internal, "%v", err)
+	}
+	if backupPath != "" {
+		klog.V(3).InfoS("Backed up replaced file", "file_path", filePath, "backup_path", backupPath)
+	}
+
+	if err := runAsUser(auth.User, file.Commit); err != nil {
+		klog.ErrorS(err, "Failed to commit uploaded file", "file_path", filePath, "temp_path", file.Name())
+		return fileError(err, codes.Internal, "failed to commit file: %v", err)
+	}
+	klog.V(4).InfoS("Uploaded file committed", "file_path", file.Target())
+
 	// Send a final ControlMessage as acknowledgment
 	ackMsg := &pb.FileTransferMessage{
 		Payload: &pb.FileTransferMessage_Control{
 			Control: &pb.ControlMessage{
-				Operation: pb.ControlMessage_UPLOAD,
+				Operation: pb.ControlMessage_COMPLETE,
 				Info: &pb.FileInfo{
-					LocalPath:  info.LocalPath,
-					RemotePath: info.RemotePath,
-					FileSize:   receivedBytes,
+					LocalPath:         info.LocalPath,
+					RemotePath:        info.RemotePath,
+					FileSize:          fileSize,
+					ChecksumAlgorithm: info.ChecksumAlgorithm,
+					Checksum:          checksum,
+					TransferId:        info.TransferId,
+					Result:            result,
+					BackupPath:        backupPath,
 				},
 			},
 		},
@@ -160,7 +416,7 @@ func (s *Server) handleUpload(stream pb.ConnectionService_TransferFileServer, in
 }
 
 // handleDownload manages the download process with detailed logging.
-func (s *Server) handleDownload(stream pb.ConnectionService_TransferFileServer, info *pb.FileInfo) error {
+func (s *Server) handleDownload(stream pb.ConnectionService_TransferFileServer, info *pb.FileInfo) (err error) {
 	if info == nil {
 		errMsg := "missing FileInfo in download"
 		klog.ErrorS(nil, errMsg)
@@ -175,20 +431,46 @@ func (s *Server) handleDownload(stream pb.ConnectionService_TransferFileServer,
 		return status.Errorf(codes.Unauthenticated, "invalid auth info: %v", err)
 	}
 
-	// Expand tilde in file path
-	filePath, err := utils.ExpandHomeDirectory(auth.User, info.RemotePath)
+	// Expand tilde in file path and confine it to the allowed paths
+	path, err := s.resolvePath(auth.User, info.RemotePath)
 	if err != nil {
-		klog.ErrorS(err, "Failed to expand home directory for download", "remote_path", info.RemotePath)
-		return status.Errorf(codes.Internal, "failed to expand home directory: %v", err)
+		klog.ErrorS(err, "Failed to resolve path for download", "remote_path", info.RemotePath)
+		return err
 	}
+	defer path.Close()
+	filePath := path.String()
 
 	klog.V(4).InfoS("Expanded file path for download", "file_path", filePath)
 
-	// Open the file for reading
-	file, err := os.Open(filePath)
+	hasher, err := newHasher(info.ChecksumAlgorithm)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	chunkSize, err := s.chunkSize(info.ChunkSize)
+	if err != nil {
+		return err
+	}
+	limit, err := s.transferThrottle(auth.User, info)
+	if err != nil {
+		return err
+	}
+
+	var sentBytes int64
+	defer func() {
+		err = transferFailure(err, pb.ControlMessage_DOWNLOAD, filePath, info.Offset+sentBytes)
+		s.auditTransfer(stream.Context(), auth.User, "download", filePath, sentBytes, checksumLabel(info.ChecksumAlgorithm, hex.EncodeToString(hasher.Sum(nil))), err)
+	}()
+
+	// Open the file for reading with the user's permissions
+	var file *os.File
+	err = runAsUser(auth.User, func() (err error) {
+		file, err = openRegularFile(path)
+		return err
+	})
 	if err != nil {
 		klog.ErrorS(err, "Failed to open file for download", "file_path", filePath)
-		return status.Errorf(codes.NotFound, "failed to open file: %v", err)
+		return fileError(err, codes.NotFound, "failed to open file: %v", err)
 	}
 	defer func() {
 		if cerr := file.Close(); cerr != nil {
@@ -200,21 +482,58 @@ func (s *Server) handleDownload(stream pb.ConnectionService_TransferFileServer,
 	fileStat, err := file.Stat()
 	if err != nil {
 		klog.ErrorS(err, "Failed to stat file for download", "file_path", filePath)
-		return status.Errorf(codes.Internal, "failed to stat file: %v", err)
+		return fileError(err, codes.Internal, "failed to stat file: %v", err)
 	}
 
 	klog.V(4).InfoS("File info retrieved for download", "file_path", filePath, "file_size", fileStat.Size())
 
+	// Resume at the requested offset, the skipped prefix still goes into the checksum
+	if info.Offset < 0 || info.Offset > fileStat.Size() {
+		return status.Errorf(codes.OutOfRange, "offset %d is outside of the file size %d", info.Offset, fileStat.Size())
+	}
+	if info.Offset > 0 {
+		if _, err := io.Copy(hasher, io.NewSectionReader(file, 0, info.Offset)); err != nil {
+			klog.ErrorS(err, "Failed to checksum skipped prefix for download", "file_path", filePath, "offset", info.Offset)
+			return fileError(err, codes.Internal, "failed to read file: %v", err)
+		}
+		if _, err := file.Seek(info.Offset, io.SeekStart); err != nil {
+			klog.ErrorS(err, "Failed to seek for download", "file_path", filePath, "offset", info.Offset)
+			return fileError(err, codes.Internal, "failed to seek file: %v", err)
+		}
+	}
+
+	// Compressing already compressed content again would only cost CPU time
+	head := make([]byte, compression.MagicSize)
+	if n, _ := file.ReadAt(head, 0); compression.IsCompressed(head[:n]) {
+		skipCompression(stream.Context())
+	}
+
 	// Send ControlMessage with FileInfo
+	fileInfo := &pb.FileInfo{
+		LocalPath:  info.LocalPath,
+		RemotePath: info.RemotePath,
+		FileSize:   fileStat.Size(),
+		Offset:     info.Offset,
+		ChunkSize:  int32(chunkSize),
+		RateLimit:  limit.Rate(),
+		Sparse:     info.Sparse,
+	}
+	fillFileAttributes(fileInfo, fileStat)
+	if info.XattrMode == pb.FileInfo_XATTRS_TRANSFER {
+		err := runAsUser(auth.User, func() (err error) {
+			fileInfo.Xattrs, err = fileXattrs(file)
+			return err
+		})
+		if err != nil {
+			klog.ErrorS(err, "Failed to read extended attributes for download", "file_path", filePath)
+			return fileError(err, codes.Internal, "failed to read extended attributes: %v", err)
+		}
+	}
 	controlMsg := &pb.FileTransferMessage{
 		Payload: &pb.FileTransferMessage_Control{
 			Control: &pb.ControlMessage{
 				Operation: pb.ControlMessage_DOWNLOAD,
-				Info: &pb.FileInfo{
-					LocalPath:  info.LocalPath,
-					RemotePath: info.RemotePath,
-					FileSize:   fileStat.Size(),
-				},
+				Info:      fileInfo,
 			},
 		},
 	}
@@ -225,35 +544,243 @@ func (s *Server) handleDownload(stream pb.ConnectionService_TransferFileServer,
 	}
 	klog.V(3).InfoS("ControlMessage sent for download", "file_path", filePath)
 
-	// Stream the file in chunks
-	buffer := make([]byte, 32*1024) // 32KB chunks
-	var sentBytes int64
+	// Stream the file in chunks, small files do not need a buffer of the full chunk size
+	buffer := make([]byte, max(min(int64(chunkSize), fileStat.Size()-info.Offset), 1))
+	if info.Sparse {
+		sentBytes, err = sendSparse(stream, file, info.Offset, fileStat.Size(), buffer, hasher, limit)
+		if err != nil {
+			klog.ErrorS(err, "Failed to send sparse file", "file_path", filePath, "bytes_sent", sentBytes)
+			return err
+		}
+		klog.V(3).InfoS("Sparse file download completed", "file_path", filePath, "bytes_sent", sentBytes)
+	} else {
+		for {
+			n, err := file.Read(buffer)
+			if err == io.EOF {
+				klog.V(3).InfoS("File download completed", "file_path", filePath, "bytes_sent", sentBytes)
+				break
+			}
+			if err != nil {
+				klog.ErrorS(err, "Failed to read file chunk during download", "file_path", filePath, "bytes_sent", sentBytes)
+				return fileError(err, codes.Internal, "failed to read file: %v", err)
+			}
+
+			dataMsg := &pb.FileTransferMessage{
+				Payload: &pb.FileTransferMessage_Data{
+					Data: &pb.FileData{
+						Data: buffer[:n],
+					},
+				},
+			}
+
+			if err := waitThrottle(stream.Context(), limit, n); err != nil {
+				return err
+			}
+			if err := stream.Send(dataMsg); err != nil {
+				klog.ErrorS(err, "Failed to send file chunk during download", "file_path", filePath, "bytes_sent", sentBytes)
+				return status.Errorf(codes.Unknown, "failed to send file chunk: %v", err)
+			}
+			hasher.Write(buffer[:n])
+			sentBytes += int64(n)
+			metrics.TransferBytes.WithLabelValues("download").Add(float64(n))
+			klog.V(5).InfoS("Sent file chunk", "file_path", filePath, "bytes_sent", n, "total_sent", sentBytes)
+		}
+	}
+
+	// Send a final ControlMessage with the checksum of the data sent
+	doneMsg := &pb.FileTransferMessage{
+		Payload: &pb.FileTransferMessage_Control{
+			Control: &pb.ControlMessage{
+				Operation: pb.ControlMessage_COMPLETE,
+				Info: &pb.FileInfo{
+					LocalPath:         info.LocalPath,
+					RemotePath:        info.RemotePath,
+					FileSize:          info.Offset + sentBytes,
+					ChecksumAlgorithm: info.ChecksumAlgorithm,
+					Checksum:          hex.EncodeToString(hasher.Sum(nil)),
+					Offset:            info.Offset,
+				},
+			},
+		},
+	}
+
+	if err := stream.Send(doneMsg); err != nil {
+		klog.ErrorS(err, "Failed to send checksum after download", "file_path", filePath)
+		return status.Errorf(codes.Unknown, "failed to send checksum: %v", err)
+	}
+	klog.V(3).InfoS("Checksum sent after file download", "file_path", filePath)
+
+	return nil
+}
+
+// skipUnchangedUpload acknowledges an upload of content the file already has without writing
+// it. The client may stop sending data once it got the acknowledgement, whatever it still sends
+// is discarded.
+func (s *Server) skipUnchangedUpload(stream pb.ConnectionService_TransferFileServer, info *pb.FileInfo, state *targetState) error {
+	klog.V(3).InfoS("Skipping upload of unchanged file", "remote_path", info.RemotePath, "file_size", state.size)
+	ackMsg := &pb.FileTransferMessage{
+		Payload: &pb.FileTransferMessage_Control{
+			Control: &pb.ControlMessage{
+				Operation: pb.ControlMessage_COMPLETE,
+				Info: &pb.FileInfo{
+					LocalPath:         info.LocalPath,
+					RemotePath:        info.RemotePath,
+					FileSize:          state.size,
+					ChecksumAlgorithm: info.ChecksumAlgorithm,
+					Checksum:          state.checksum,
+					TransferId:        info.TransferId,
+					Result:            pb.FileInfo_UNCHANGED,
+				},
+			},
+		},
+	}
+	if err := stream.Send(ackMsg); err != nil {
+		return status.Errorf(codes.Unknown, "failed to send acknowledgment: %v", err)
+	}
+	if info.ContentDigest != "" {
+		return nil
+	}
 	for {
-		n, err := file.Read(buffer)
+		msg, err := stream.Recv()
 		if err == io.EOF {
-			klog.V(3).InfoS("File download completed", "file_path", filePath, "bytes_sent", sentBytes)
-			break
+			return nil
 		}
 		if err != nil {
-			klog.ErrorS(err, "Failed to read file chunk during download", "file_path", filePath, "bytes_sent", sentBytes)
-			return status.Errorf(codes.Internal, "failed to read file: %v", err)
+			if stream.Context().Err() != nil {
+				// The client gave up sending after the acknowledgement
+				return nil
+			}
+			return status.Errorf(codes.Unknown, "failed to receive file chunk: %v", err)
+		}
+		if _, ok := msg.Payload.(*pb.FileTransferMessage_Control); ok {
+			return nil
+		}
+	}
+}
+
+// handleUploadProbe tells the client how much data of a resumable upload the server holds
+func (s *Server) handleUploadProbe(stream pb.ConnectionService_TransferFileServer, info *pb.FileInfo, username string, path *policy.Path) error {
+	var target *policy.Path
+	err := runAsUser(username, func() (err error) {
+		target, _, err = resolveTarget(path, 0)
+		return err
+	})
+	if err != nil {
+		return status.Errorf(codes.FailedPrecondition, "%v", err)
+	}
+	partial, err := partialFilePath(target, info.TransferId)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	hasher, err := newHasher(info.ChecksumAlgorithm)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	// Expired partial data is dropped first and reported as nothing received, the partial file
+	// of a running upload cannot be probed
+	var offset int64
+	var file *os.File
+	err = runAsUser(username, func() (err error) {
+		removeStalePartialFiles(path, s.PartialFileTTL)
+		if file, err = partial.Open(os.O_RDONLY|syscall.O_NOFOLLOW, 0); err != nil {
+			return err
+		}
+		if err = lockPartialFile(file, partial, unix.LOCK_SH); err != nil {
+			file.Close()
 		}
+		return err
+	})
+	switch {
+	case err == nil:
+		defer file.Close()
+		if offset, err = io.Copy(hasher, file); err != nil {
+			klog.ErrorS(err, "Failed to read partial file", "file_path", partial)
+			return fileError(err, codes.Internal, "failed to read partial file: %v", err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		klog.ErrorS(err, "Failed to open partial file", "file_path", partial)
+		return fileError(err, codes.Internal, "failed to open partial file: %v", err)
+	}
+	klog.V(3).InfoS("Answering upload resume probe", "file_path", path, "transfer_id", info.TransferId, "offset", offset)
 
-		dataMsg := &pb.FileTransferMessage{
-			Payload: &pb.FileTransferMessage_Data{
-				Data: &pb.FileData{
-					Data: buffer[:n],
+	return stream.Send(&pb.FileTransferMessage{
+		Payload: &pb.FileTransferMessage_Control{
+			Control: &pb.ControlMessage{
+				Operation: pb.ControlMessage_UPLOAD,
+				Info: &pb.FileInfo{
+					LocalPath:         info.LocalPath,
+					RemotePath:        info.RemotePath,
+					ChecksumAlgorithm: info.ChecksumAlgorithm,
+					TransferId:        info.TransferId,
+					Offset:            offset,
+					PrefixChecksum:    hex.EncodeToString(hasher.Sum(nil)),
 				},
 			},
-		}
+		},
+	})
+}
 
-		if err := stream.Send(dataMsg); err != nil {
-			klog.ErrorS(err, "Failed to send file chunk during download", "file_path", filePath, "bytes_sent", sentBytes)
-			return status.Errorf(codes.Unknown, "failed to send file chunk: %v", err)
+// resumePartialFile positions a partial upload file at the offset requested by the client,
+// after checking that the data kept so far matches the client's prefix checksum
+func resumePartialFile(file *atomicFile, info *pb.FileInfo, hasher hash.Hash) error {
+	st, err := file.Stat()
+	if err != nil {
+		return fileError(err, codes.Internal, "failed to stat partial file: %v", err)
+	}
+	if info.Offset > st.Size() {
+		return status.Errorf(codes.FailedPrecondition, "cannot resume at offset %d, only %d bytes were received", info.Offset, st.Size())
+	}
+	if info.Offset > 0 {
+		if info.PrefixChecksum == "" {
+			return status.Errorf(codes.InvalidArgument, "resuming an upload requires a prefix checksum")
+		}
+		if _, err := io.Copy(hasher, io.NewSectionReader(file, 0, info.Offset)); err != nil {
+			return fileError(err, codes.Internal, "failed to read partial file: %v", err)
+		}
+		prefix := hex.EncodeToString(hasher.Sum(nil))
+		if prefix != strings.ToLower(info.PrefixChecksum) {
+			file.Discard()
+			return status.Errorf(codes.FailedPrecondition, "prefix checksum mismatch: expected %s, computed %s", info.PrefixChecksum, prefix)
 		}
-		sentBytes += int64(n)
-		klog.V(5).InfoS("Sent file chunk", "file_path", filePath, "bytes_sent", n, "total_sent", sentBytes)
 	}
-
+	if err := file.Truncate(info.Offset); err != nil {
+		return fileError(err, codes.Internal, "failed to truncate partial file: %v", err)
+	}
+	if _, err := file.Seek(info.Offset, io.SeekStart); err != nil {
+		return fileError(err, codes.Internal, "failed to seek partial file: %v", err)
+	}
 	return nil
 }
+
+// auditTransfer records a finished or failed file transfer in the audit log
+func (s *Server) auditTransfer(ctx context.Context, username, operation, path string, bytes int64, checksum string, err error) {
+	if s.Audit == nil {
+		return
+	}
+	event := &audit.Event{
+		Type:      audit.EventTransfer,
+		User:      username,
+		Operation: operation,
+		Path:      path,
+		Bytes:     bytes,
+		Success:   err == nil,
+	}
+	if err == nil {
+		event.Checksum = checksum
+	} else {
+		event.Error = status.Convert(err).Message()
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		event.ClientIP = peerIP(p)
+	}
+	s.Audit.Log(event)
+}
+
+// skipCompression sends the remaining responses of the RPC of ctx uncompressed, whatever
+// compressor the client asked for
+func skipCompression(ctx context.Context) {
+	if err := grpc.SetSendCompressor(ctx, encoding.Identity); err != nil {
+		klog.V(4).ErrorS(err, "Failed to disable response compression")
+	}
+}
@@ -0,0 +1,399 @@
+package implement
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// fakeTransferStream feeds the messages of recv to the server, which ends the client side once
+// recv is closed, and records the messages the server sends
+type fakeTransferStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	recv chan *pb.FileTransferMessage
+	sent []*pb.FileTransferMessage
+}
+
+// newTransferStream returns a stream of the current user sending msgs and closing its side
+func newTransferStream(t *testing.T, msgs ...*pb.FileTransferMessage) *fakeTransferStream {
+	t.Helper()
+	s := newOpenTransferStream(t, len(msgs))
+	for _, msg := range msgs {
+		s.recv <- msg
+	}
+	close(s.recv)
+	return s
+}
+
+// newOpenTransferStream returns a stream of the current user the test sends messages on
+func newOpenTransferStream(t *testing.T, buffer int) *fakeTransferStream {
+	t.Helper()
+	u, err := user.Current()
+	if err != nil {
+		t.Skipf("no current user: %v", err)
+	}
+	ctx, cancel := context.WithCancel(metadata.NewIncomingContext(context.Background(), metadata.Pairs("user", u.Username)))
+	t.Cleanup(cancel)
+	return &fakeTransferStream{ctx: ctx, recv: make(chan *pb.FileTransferMessage, buffer)}
+}
+
+func (s *fakeTransferStream) Context() context.Context { return s.ctx }
+
+func (s *fakeTransferStream) Send(msg *pb.FileTransferMessage) error {
+	s.sent = append(s.sent, msg)
+	return nil
+}
+
+func (s *fakeTransferStream) Recv() (*pb.FileTransferMessage, error) {
+	select {
+	case msg, ok := <-s.recv:
+		if !ok {
+			return nil, io.EOF
+		}
+		return msg, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+// last returns the last message the server sent
+func (s *fakeTransferStream) last(t *testing.T) *pb.ControlMessage {
+	t.Helper()
+	if len(s.sent) == 0 {
+		t.Fatalf("server sent nothing")
+	}
+	control, ok := s.sent[len(s.sent)-1].Payload.(*pb.FileTransferMessage_Control)
+	if !ok {
+		t.Fatalf("last message %v is no control message", s.sent[len(s.sent)-1])
+	}
+	return control.Control
+}
+
+func controlMsg(op pb.ControlMessage_Operation, info *pb.FileInfo) *pb.FileTransferMessage {
+	return &pb.FileTransferMessage{Payload: &pb.FileTransferMessage_Control{Control: &pb.ControlMessage{Operation: op, Info: info}}}
+}
+
+func dataMsg(data string) *pb.FileTransferMessage {
+	return &pb.FileTransferMessage{Payload: &pb.FileTransferMessage_Data{Data: &pb.FileData{Data: []byte(data)}}}
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// dirEntries returns the sorted names in dir
+func dirEntries(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestUploadAtomic(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int64
+		msgs     []*pb.FileTransferMessage
+		wantCode codes.Code
+		want     string
+	}{
+		{name: "replaced", size: 11, msgs: []*pb.FileTransferMessage{dataMsg("new "), dataMsg("content")}, want: "new content"},
+		{name: "emptied", msgs: nil, want: ""},
+		{name: "size mismatch", size: 100, msgs: []*pb.FileTransferMessage{dataMsg("short")}, wantCode: codes.DataLoss, want: "old content"},
+		{name: "unexpected message", msgs: []*pb.FileTransferMessage{dataMsg("new"), {}}, wantCode: codes.InvalidArgument, want: "old content"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			target := filepath.Join(dir, "file")
+			if err := os.WriteFile(target, []byte("old content"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			msgs := append([]*pb.FileTransferMessage{controlMsg(pb.ControlMessage_UPLOAD, &pb.FileInfo{RemotePath: target, FileSize: tt.size})}, tt.msgs...)
+			err := NewServer(nil, nil, nil).TransferFile(newTransferStream(t, msgs...))
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("TransferFile error %v, want code %v", err, tt.wantCode)
+			}
+			if got, err := os.ReadFile(target); err != nil || string(got) != tt.want {
+				t.Errorf("target holds %q, %v, want %q", got, err, tt.want)
+			}
+			// The temporary file is gone whatever the outcome
+			if names := dirEntries(t, dir); !slices.Equal(names, []string{"file"}) {
+				t.Errorf("directory holds %q, want only the target", names)
+			}
+		})
+	}
+}
+
+func TestTransferChecksum(t *testing.T) {
+	content := "checked content"
+	tests := []struct {
+		name     string
+		info     *pb.FileInfo
+		trailer  *pb.FileInfo
+		wantCode codes.Code
+	}{
+		{name: "no checksum"},
+		{name: "checksum first", info: &pb.FileInfo{Checksum: sha256Hex(content)}},
+		{name: "upper case checksum", info: &pb.FileInfo{Checksum: strings.ToUpper(sha256Hex(content))}},
+		{name: "checksum in trailer", trailer: &pb.FileInfo{Checksum: sha256Hex(content)}},
+		{name: "mismatch first", info: &pb.FileInfo{Checksum: sha256Hex("other")}, wantCode: codes.DataLoss},
+		{name: "mismatch in trailer", info: &pb.FileInfo{Checksum: sha256Hex(content)}, trailer: &pb.FileInfo{Checksum: sha256Hex("other")}, wantCode: codes.DataLoss},
+		{name: "unknown algorithm", info: &pb.FileInfo{ChecksumAlgorithm: pb.FileInfo_ChecksumAlgorithm(99)}, wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := filepath.Join(t.TempDir(), "file")
+			info := &pb.FileInfo{}
+			if tt.info != nil {
+				info = tt.info
+			}
+			info.RemotePath = target
+			msgs := []*pb.FileTransferMessage{controlMsg(pb.ControlMessage_UPLOAD, info), dataMsg(content)}
+			if tt.trailer != nil {
+				msgs = append(msgs, controlMsg(pb.ControlMessage_UPLOAD, tt.trailer))
+			}
+			stream := newTransferStream(t, msgs...)
+			err := NewServer(nil, nil, nil).TransferFile(stream)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("TransferFile error %v, want code %v", err, tt.wantCode)
+			}
+			if tt.wantCode != codes.OK {
+				if _, err := os.Stat(target); !os.IsNotExist(err) {
+					t.Errorf("failed upload created the target: %v", err)
+				}
+				return
+			}
+			if got := stream.last(t).Info.GetChecksum(); got != sha256Hex(content) {
+				t.Errorf("acknowledged checksum %q, want %q", got, sha256Hex(content))
+			}
+		})
+	}
+
+	t.Run("download", func(t *testing.T) {
+		source := filepath.Join(t.TempDir(), "file")
+		if err := os.WriteFile(source, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		stream := newTransferStream(t, controlMsg(pb.ControlMessage_DOWNLOAD, &pb.FileInfo{RemotePath: source}))
+		if err := NewServer(nil, nil, nil).TransferFile(stream); err != nil {
+			t.Fatalf("TransferFile: %v", err)
+		}
+		if got := stream.last(t).Info.GetChecksum(); got != sha256Hex(content) {
+			t.Errorf("download checksum %q, want %q", got, sha256Hex(content))
+		}
+	})
+}
+
+func TestResumeUpload(t *testing.T) {
+	tests := []struct {
+		name     string
+		info     *pb.FileInfo
+		data     string
+		wantCode codes.Code
+		// wantPartial is the content the partial file is left with, "" when it is gone
+		wantPartial string
+	}{
+		{name: "resumed", info: &pb.FileInfo{Offset: 6, PrefixChecksum: sha256Hex("hello ")}, data: "world"},
+		{name: "restarted", info: &pb.FileInfo{}, data: "hello world"},
+		{name: "resumed within the data", info: &pb.FileInfo{Offset: 2, PrefixChecksum: sha256Hex("he")}, data: "llo world"},
+		{name: "offset past the data", info: &pb.FileInfo{Offset: 7, PrefixChecksum: sha256Hex("hello w")}, wantCode: codes.FailedPrecondition, wantPartial: "hello "},
+		{name: "no prefix checksum", info: &pb.FileInfo{Offset: 6}, wantCode: codes.InvalidArgument, wantPartial: "hello "},
+		{name: "prefix mismatch", info: &pb.FileInfo{Offset: 6, PrefixChecksum: sha256Hex("jello ")}, wantCode: codes.FailedPrecondition},
+		{name: "short again", info: &pb.FileInfo{Offset: 6, PrefixChecksum: sha256Hex("hello "), FileSize: 11}, data: "wo", wantCode: codes.DataLoss, wantPartial: "hello wo"},
+		{name: "checksum mismatch", info: &pb.FileInfo{Offset: 6, PrefixChecksum: sha256Hex("hello "), Checksum: sha256Hex("hello there")}, data: "world", wantCode: codes.DataLoss},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			target := filepath.Join(dir, "file")
+			partial := filepath.Join(dir, ".file.t1.part")
+			s := NewServer(nil, nil, nil)
+
+			// A broken upload keeps the data received so far
+			stream := newTransferStream(t, controlMsg(pb.ControlMessage_UPLOAD, &pb.FileInfo{RemotePath: target, TransferId: "t1", FileSize: 11}), dataMsg("hello "))
+			if err := s.TransferFile(stream); status.Code(err) != codes.DataLoss {
+				t.Fatalf("short upload error %v, want code %v", err, codes.DataLoss)
+			}
+
+			tt.info.RemotePath, tt.info.TransferId = target, "t1"
+			stream = newTransferStream(t, controlMsg(pb.ControlMessage_UPLOAD, tt.info), dataMsg(tt.data))
+			err := s.TransferFile(stream)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("resumed upload error %v, want code %v", err, tt.wantCode)
+			}
+			if got, err := os.ReadFile(partial); string(got) != tt.wantPartial || (tt.wantPartial == "") != os.IsNotExist(err) {
+				t.Errorf("partial file holds %q, %v, want %q", got, err, tt.wantPartial)
+			}
+			if tt.wantCode != codes.OK {
+				if _, err := os.Stat(target); !os.IsNotExist(err) {
+					t.Errorf("failed upload created the target: %v", err)
+				}
+				return
+			}
+			if got, err := os.ReadFile(target); err != nil || string(got) != "hello world" {
+				t.Errorf("target holds %q, %v, want %q", got, err, "hello world")
+			}
+			if got := stream.last(t).Info.GetChecksum(); got != sha256Hex("hello world") {
+				t.Errorf("acknowledged checksum %q, want the checksum of the whole file", got)
+			}
+		})
+	}
+
+	t.Run("offset without transfer id", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "file")
+		stream := newTransferStream(t, controlMsg(pb.ControlMessage_UPLOAD, &pb.FileInfo{RemotePath: target, Offset: 6}), dataMsg("world"))
+		if err := NewServer(nil, nil, nil).TransferFile(stream); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("TransferFile error %v, want code %v", err, codes.InvalidArgument)
+		}
+	})
+
+	t.Run("invalid transfer id", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "file")
+		stream := newTransferStream(t, controlMsg(pb.ControlMessage_UPLOAD, &pb.FileInfo{RemotePath: target, TransferId: "../t1"}), dataMsg("hello"))
+		if err := NewServer(nil, nil, nil).TransferFile(stream); status.Code(err) == codes.OK {
+			t.Errorf("upload with transfer id ../t1 succeeded")
+		}
+		if names := dirEntries(t, filepath.Dir(target)); len(names) != 0 {
+			t.Errorf("directory holds %q, want nothing", names)
+		}
+	})
+}
+
+func TestResumeDownload(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(source, []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		offset   int64
+		want     string
+		wantCode codes.Code
+	}{
+		{offset: 0, want: "hello world"},
+		{offset: 6, want: "world"},
+		{offset: 11, want: ""},
+		{offset: 12, wantCode: codes.OutOfRange},
+		{offset: -1, wantCode: codes.OutOfRange},
+	}
+	for _, tt := range tests {
+		stream := newTransferStream(t, controlMsg(pb.ControlMessage_DOWNLOAD, &pb.FileInfo{RemotePath: source, Offset: tt.offset}))
+		err := NewServer(nil, nil, nil).TransferFile(stream)
+		if status.Code(err) != tt.wantCode {
+			t.Errorf("download at offset %d: error %v, want code %v", tt.offset, err, tt.wantCode)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var got string
+		for _, msg := range stream.sent {
+			if data, ok := msg.Payload.(*pb.FileTransferMessage_Data); ok {
+				got += string(data.Data.Data)
+			}
+		}
+		// The checksum covers the whole file, the skipped prefix included
+		if got != tt.want || stream.last(t).Info.GetChecksum() != sha256Hex("hello world") {
+			t.Errorf("download at offset %d: %q with checksum %s, want %q", tt.offset, got, stream.last(t).Info.GetChecksum(), tt.want)
+		}
+	}
+}
+
+func TestPartialFileLocked(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "file")
+	partial := filepath.Join(dir, ".file.t1.part")
+	s := NewServer(nil, nil, nil)
+
+	// The first upload holds the partial file while it waits for more data
+	first := newOpenTransferStream(t, 2)
+	first.recv <- controlMsg(pb.ControlMessage_UPLOAD, &pb.FileInfo{RemotePath: target, TransferId: "t1"})
+	first.recv <- dataMsg("hello ")
+	done := make(chan error)
+	go func() { done <- s.TransferFile(first) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if st, err := os.Stat(partial); err == nil && st.Size() == 6 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("first upload did not write the partial file")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tests := []struct {
+		name string
+		info *pb.FileInfo
+	}{
+		{name: "restart", info: &pb.FileInfo{RemotePath: target, TransferId: "t1"}},
+		{name: "resume", info: &pb.FileInfo{RemotePath: target, TransferId: "t1", Offset: 6, PrefixChecksum: sha256Hex("hello ")}},
+	}
+	for _, tt := range tests {
+		second := newTransferStream(t, controlMsg(pb.ControlMessage_UPLOAD, tt.info), dataMsg("world"))
+		if err := s.TransferFile(second); status.Code(err) != codes.Aborted {
+			t.Errorf("%s while the partial file is in use: error %v, want code %v", tt.name, err, codes.Aborted)
+		}
+	}
+
+	// Uploads of other transfer ids are not held up
+	other := newTransferStream(t, controlMsg(pb.ControlMessage_UPLOAD, &pb.FileInfo{RemotePath: filepath.Join(dir, "other"), TransferId: "t2"}), dataMsg("other"))
+	if err := s.TransferFile(other); err != nil {
+		t.Errorf("upload of another transfer id: %v", err)
+	}
+
+	first.recv <- dataMsg("world")
+	close(first.recv)
+	if err := <-done; err != nil {
+		t.Fatalf("first upload: %v", err)
+	}
+	if got, err := os.ReadFile(target); err != nil || string(got) != "hello world" {
+		t.Errorf("target holds %q, %v, want %q", got, err, "hello world")
+	}
+}
+
+func TestStalePartialFiles(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, ".file.old.part")
+	fresh := filepath.Join(dir, ".file.new.part")
+	for _, path := range []string{stale, fresh} {
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * DefaultPartialFileTTL)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	stream := newTransferStream(t, controlMsg(pb.ControlMessage_UPLOAD, &pb.FileInfo{RemotePath: filepath.Join(dir, "file"), TransferId: "t1"}), dataMsg("hello"))
+	if err := NewServer(nil, nil, nil).TransferFile(stream); err != nil {
+		t.Fatalf("TransferFile: %v", err)
+	}
+	if names := dirEntries(t, dir); !slices.Equal(names, []string{".file.new.part", "file"}) {
+		t.Errorf("directory holds %q, want the fresh partial file and the target", names)
+	}
+}
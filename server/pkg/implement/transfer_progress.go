@@ -0,0 +1,252 @@
+package implement
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"k8s.io/klog/v2"
+)
+
+// minProgressInterval keeps clients from flooding their streams with progress reports
+const minProgressInterval = 100 * time.Millisecond
+
+// transferTracker follows the progress of one running transfer
+type transferTracker struct {
+	id        uint64
+	user      string
+	clientIP  string
+	operation pb.ControlMessage_Operation
+	path      string
+	started   time.Time
+
+	// base is the offset the transfer started at, transferred the bytes passed since
+	base         atomic.Int64
+	transferred  atomic.Int64
+	total        atomic.Int64
+	lastActivity atomic.Int64 // Unix nanoseconds
+}
+
+// done returns the offset the transfer reached
+func (t *transferTracker) done() int64 {
+	done := t.base.Load() + t.transferred.Load()
+	if total := t.total.Load(); total > 0 {
+		// Delta block copies count whole blocks, the last one may be shorter
+		done = min(done, total)
+	}
+	return done
+}
+
+func (t *transferTracker) add(n int64) {
+	if n > 0 {
+		t.transferred.Add(n)
+		t.lastActivity.Store(time.Now().UnixNano())
+	}
+}
+
+// running returns the transfer for the admin listing, with the rate averaged since its start
+func (t *transferTracker) running(now time.Time) *pb.RunningTransfer {
+	transferred := t.transferred.Load()
+	var rate int64
+	if elapsed := now.Sub(t.started).Seconds(); elapsed > 0 {
+		rate = int64(float64(transferred) / elapsed)
+	}
+	return &pb.RunningTransfer{
+		Id:         t.id,
+		User:       t.user,
+		ClientIp:   t.clientIP,
+		Operation:  t.operation,
+		RemotePath: t.path,
+		Progress: &pb.TransferProgress{
+			BytesDone:      t.done(),
+			BytesTotal:     t.total.Load(),
+			BytesPerSecond: rate,
+		},
+		Started:      timestamppb.New(t.started),
+		LastActivity: timestamppb.New(time.Unix(0, t.lastActivity.Load())),
+	}
+}
+
+// transferRegistry keeps the running transfers for the admin service, its zero value is ready
+// to use
+type transferRegistry struct {
+	mu      sync.Mutex
+	nextID  uint64
+	running map[uint64]*transferTracker
+}
+
+func (r *transferRegistry) add(t *transferTracker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.running == nil {
+		r.running = make(map[uint64]*transferTracker)
+	}
+	r.nextID++
+	t.id = r.nextID
+	r.running[t.id] = t
+}
+
+func (r *transferRegistry) remove(t *transferTracker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.running, t.id)
+}
+
+// list returns the running transfers, oldest first
+func (r *transferRegistry) list() []*pb.RunningTransfer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	transfers := make([]*pb.RunningTransfer, 0, len(r.running))
+	for _, t := range r.running {
+		transfers = append(transfers, t.running(now))
+	}
+	slices.SortFunc(transfers, func(a, b *pb.RunningTransfer) int { return cmp.Compare(a.Id, b.Id) })
+	return transfers
+}
+
+// trackedStream counts the data of a transfer passing through it and sends its PROGRESS
+// reports, serialized with the handler's messages
+type trackedStream struct {
+	pb.ConnectionService_TransferFileServer
+	tracker *transferTracker
+	info    *pb.FileInfo
+
+	mu sync.Mutex
+	// finished is set once COMPLETE or ERROR was sent, no reports may follow
+	finished bool
+	// blockSize is the block size of a delta upload, set and read by the handler's goroutine
+	blockSize int64
+}
+
+// trackTransfer registers the transfer started by control and wraps stream to follow it. The
+// returned stop function ends the progress reports and must be called before the handler's
+// stream is left.
+func (s *Server) trackTransfer(stream pb.ConnectionService_TransferFileServer, control *pb.ControlMessage) (*trackedStream, func()) {
+	t := &transferTracker{
+		operation: control.Operation,
+		path:      control.Info.GetRemotePath(),
+		started:   time.Now(),
+	}
+	if auth, err := GetAuthInfoFromContext(stream.Context()); err == nil {
+		t.user = auth.User
+	}
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		t.clientIP = peerIP(p)
+	}
+	t.lastActivity.Store(t.started.UnixNano())
+	if control.Operation == pb.ControlMessage_UPLOAD || control.Operation == pb.ControlMessage_UPLOAD_TREE ||
+		control.Operation == pb.ControlMessage_UPLOAD_DELTA {
+		t.base.Store(max(control.Info.GetOffset(), 0))
+		t.total.Store(control.Info.GetFileSize())
+	}
+	s.transfers.add(t)
+
+	tracked := &trackedStream{ConnectionService_TransferFileServer: stream, tracker: t, info: control.Info}
+	stopReports := func() {}
+	if ms := control.Info.GetProgressIntervalMs(); ms > 0 {
+		interval := max(time.Duration(ms)*time.Millisecond, minProgressInterval)
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tracked.reportProgress(interval, stop)
+		}()
+		stopReports = func() {
+			close(stop)
+			wg.Wait()
+		}
+	}
+	return tracked, func() {
+		stopReports()
+		s.transfers.remove(t)
+	}
+}
+
+func (s *trackedStream) Recv() (*pb.FileTransferMessage, error) {
+	msg, err := s.ConnectionService_TransferFileServer.Recv()
+	if err == nil {
+		s.count(msg)
+	}
+	return msg, err
+}
+
+func (s *trackedStream) Send(msg *pb.FileTransferMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if control := msg.GetControl(); control != nil {
+		switch control.Operation {
+		case pb.ControlMessage_DOWNLOAD, pb.ControlMessage_DOWNLOAD_TREE:
+			// Describes what is about to be sent
+			s.tracker.base.Store(control.Info.GetOffset())
+			s.tracker.total.Store(control.Info.GetFileSize())
+		case pb.ControlMessage_UPLOAD_DELTA:
+			s.blockSize = int64(control.Info.GetBlockSize())
+		case pb.ControlMessage_COMPLETE, pb.ControlMessage_ERROR:
+			s.finished = true
+		}
+	}
+	s.count(msg)
+	return s.ConnectionService_TransferFileServer.Send(msg)
+}
+
+// count adds the file bytes msg carries to the transfer's progress
+func (s *trackedStream) count(msg *pb.FileTransferMessage) {
+	switch payload := msg.Payload.(type) {
+	case *pb.FileTransferMessage_Data:
+		s.tracker.add(int64(len(payload.Data.Data)) + payload.Data.Hole)
+	case *pb.FileTransferMessage_Delta:
+		s.tracker.add(payload.Delta.BlockCount*s.blockSize + int64(len(payload.Delta.Literal)))
+	}
+}
+
+// reportProgress sends a PROGRESS control message every interval until stop is closed
+func (s *trackedStream) reportProgress(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last, lastTime := s.tracker.transferred.Load(), time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			transferred := s.tracker.transferred.Load()
+			rate := int64(float64(transferred-last) / now.Sub(lastTime).Seconds())
+			last, lastTime = transferred, now
+			if err := s.sendProgress(rate); err != nil {
+				klog.V(4).ErrorS(err, "Failed to send transfer progress", "remote_path", s.tracker.path)
+				return
+			}
+		}
+	}
+}
+
+func (s *trackedStream) sendProgress(rate int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished {
+		return nil
+	}
+	return s.ConnectionService_TransferFileServer.Send(&pb.FileTransferMessage{
+		Payload: &pb.FileTransferMessage_Control{
+			Control: &pb.ControlMessage{
+				Operation: pb.ControlMessage_PROGRESS,
+				Info: &pb.FileInfo{
+					LocalPath:  s.info.GetLocalPath(),
+					RemotePath: s.info.GetRemotePath(),
+				},
+				Progress: &pb.TransferProgress{
+					BytesDone:      s.tracker.done(),
+					BytesTotal:     s.tracker.total.Load(),
+					BytesPerSecond: rate,
+				},
+			},
+		},
+	})
+}
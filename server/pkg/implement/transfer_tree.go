@@ -0,0 +1,700 @@
+package implement
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/metrics"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/policy"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/throttle"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// streamReader exposes the data messages of a TransferFile stream as a byte stream. It ends
+// with the stream or at a control message, which is kept as the trailer. Data messages larger
+// than chunkSize are rejected, the data is throttled by limit.
+type streamReader struct {
+	stream    pb.ConnectionService_TransferFileServer
+	hasher    hash.Hash
+	chunkSize int
+	limit     *throttle.Transfer
+	buf       []byte
+	n         int64
+	trailer   *pb.ControlMessage
+	done      bool
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		msg, err := r.stream.Recv()
+		if err == io.EOF {
+			r.done = true
+			continue
+		}
+		if err != nil {
+			return 0, status.Errorf(codes.Unknown, "failed to receive data: %v", err)
+		}
+		switch payload := msg.Payload.(type) {
+		case *pb.FileTransferMessage_Data:
+			if len(payload.Data.Data) > r.chunkSize {
+				return 0, status.Errorf(codes.InvalidArgument, "chunk of %d bytes exceeds the chunk size %d", len(payload.Data.Data), r.chunkSize)
+			}
+			if err := waitThrottle(r.stream.Context(), r.limit, len(payload.Data.Data)); err != nil {
+				return 0, err
+			}
+			r.buf = payload.Data.Data
+			r.hasher.Write(r.buf)
+			r.n += int64(len(r.buf))
+			metrics.TransferBytes.WithLabelValues("upload").Add(float64(len(r.buf)))
+		case *pb.FileTransferMessage_Control:
+			r.trailer = payload.Control
+			r.done = true
+		default:
+			return 0, status.Errorf(codes.InvalidArgument, "expected FileData message during upload")
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// streamWriter sends everything written to it as data messages of a TransferFile stream,
+// none of them larger than chunkSize and throttled by limit
+type streamWriter struct {
+	stream    pb.ConnectionService_TransferFileServer
+	hasher    hash.Hash
+	chunkSize int
+	limit     *throttle.Transfer
+	n         int64
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), w.chunkSize)]
+		msg := &pb.FileTransferMessage{
+			Payload: &pb.FileTransferMessage_Data{
+				Data: &pb.FileData{Data: chunk},
+			},
+		}
+		if err := waitThrottle(w.stream.Context(), w.limit, len(chunk)); err != nil {
+			return written, err
+		}
+		if err := w.stream.Send(msg); err != nil {
+			return written, status.Errorf(codes.Unknown, "failed to send data: %v", err)
+		}
+		w.hasher.Write(chunk)
+		w.n += int64(len(chunk))
+		metrics.TransferBytes.WithLabelValues("download").Add(float64(len(chunk)))
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// handleUploadTree extracts a tar archive streamed by the client into a directory. Entries
+// are confined to the directory, symlinks are never followed while extracting and everything
+// is owned by the authenticated user. The archive checksum can only be verified once it has
+// been extracted, a mismatch is reported but does not roll back the entries written.
+func (s *Server) handleUploadTree(stream pb.ConnectionService_TransferFileServer, info *pb.FileInfo) (err error) {
+	if info == nil {
+		errMsg := "missing FileInfo in tree upload"
+		klog.ErrorS(nil, errMsg)
+		return status.Errorf(codes.InvalidArgument, errMsg)
+	}
+
+	auth, err := GetAuthInfoFromContext(stream.Context())
+	if err != nil {
+		klog.ErrorS(err, "Failed to retrieve auth info for tree upload")
+		return status.Errorf(codes.Unauthenticated, "invalid auth info: %v", err)
+	}
+
+	path, err := s.resolvePath(auth.User, info.RemotePath)
+	if err != nil {
+		klog.ErrorS(err, "Failed to resolve path for tree upload", "remote_path", info.RemotePath)
+		return err
+	}
+	defer path.Close()
+	root := path.String()
+	klog.V(3).InfoS("Starting tree upload", "local_path", info.LocalPath, "dir", root, "compression", info.ArchiveCompression)
+
+	hasher, err := newHasher(info.ChecksumAlgorithm)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	expectedChecksum := strings.ToLower(info.Checksum)
+
+	uid, gid, err := uploadOwnership(auth.User, info)
+	if err != nil {
+		klog.ErrorS(err, "Rejected ownership for tree upload", "user", auth.User, "owner", info.Owner, "group", info.Group)
+		return err
+	}
+
+	chunkSize, err := s.uploadChunkLimit(info.ChunkSize)
+	if err != nil {
+		return err
+	}
+	limit, err := s.transferThrottle(auth.User, info)
+	if err != nil {
+		return err
+	}
+	r := &streamReader{stream: stream, hasher: hasher, chunkSize: chunkSize, limit: limit}
+	defer func() {
+		err = transferFailure(err, pb.ControlMessage_UPLOAD_TREE, root, r.n)
+		s.auditTransfer(stream.Context(), auth.User, "upload_tree", root, r.n, checksumLabel(info.ChecksumAlgorithm, hex.EncodeToString(hasher.Sum(nil))), err)
+	}()
+
+	// The directory itself may be reached through a symlink, its content is not: entries are
+	// extracted below the opened directory without following any symlink
+	var dir *policy.Path
+	err = runAsUser(auth.User, func() (err error) {
+		if err := prepareTreeRoot(path, uid, gid); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+		if dir, err = path.Beneath(true); err != nil {
+			return fmt.Errorf("failed to open directory: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		klog.ErrorS(err, "Failed to create directory for tree upload", "dir", root)
+		return fileError(err, codes.Internal, "%v", err)
+	}
+	defer dir.Close()
+
+	var archive io.Reader = r
+	switch info.ArchiveCompression {
+	case pb.FileInfo_NONE:
+	case pb.FileInfo_GZIP:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid gzip archive: %v", err)
+		}
+		defer gz.Close()
+		archive = gz
+	default:
+		return status.Errorf(codes.InvalidArgument, "unsupported archive compression: %v", info.ArchiveCompression)
+	}
+
+	// Entries are written with the user's permissions
+	x := &treeExtractor{root: dir, uid: uid, gid: gid}
+	err = runAsUser(auth.User, func() error {
+		return x.extract(tar.NewReader(archive))
+	})
+	if err != nil {
+		klog.ErrorS(err, "Failed to extract tree upload", "dir", root, "entries", x.entries)
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return fileError(err, codes.Internal, "failed to extract archive: %v", err)
+	}
+
+	// Consume the archive padding and the trailing control message
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+	if r.trailer != nil && r.trailer.Info != nil && r.trailer.Info.Checksum != "" {
+		expectedChecksum = strings.ToLower(r.trailer.Info.Checksum)
+	}
+	klog.V(3).InfoS("Tree upload completed", "dir", root, "entries", x.entries, "bytes_received", r.n)
+
+	if info.FileSize > 0 && r.n != info.FileSize {
+		errMsg := fmt.Sprintf("archive size mismatch: expected %d bytes, received %d bytes", info.FileSize, r.n)
+		klog.ErrorS(nil, errMsg, "dir", root)
+		return status.Errorf(codes.DataLoss, errMsg)
+	}
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+	if expectedChecksum != "" && checksum != expectedChecksum {
+		errMsg := fmt.Sprintf("checksum mismatch: expected %s, computed %s", expectedChecksum, checksum)
+		klog.ErrorS(nil, errMsg, "dir", root, "algorithm", info.ChecksumAlgorithm)
+		return status.Errorf(codes.DataLoss, errMsg)
+	}
+
+	ackMsg := &pb.FileTransferMessage{
+		Payload: &pb.FileTransferMessage_Control{
+			Control: &pb.ControlMessage{
+				Operation: pb.ControlMessage_COMPLETE,
+				Info: &pb.FileInfo{
+					LocalPath:          info.LocalPath,
+					RemotePath:         info.RemotePath,
+					FileSize:           r.n,
+					ChecksumAlgorithm:  info.ChecksumAlgorithm,
+					Checksum:           checksum,
+					ArchiveCompression: info.ArchiveCompression,
+				},
+			},
+		},
+	}
+	if err := stream.Send(ackMsg); err != nil {
+		klog.ErrorS(err, "Failed to send acknowledgment after tree upload", "dir", root)
+		return status.Errorf(codes.Unknown, "failed to send acknowledgment: %v", err)
+	}
+	return nil
+}
+
+// prepareTreeRoot creates the directory a tree is extracted into, handing it to the user
+// when it did not exist yet
+func prepareTreeRoot(root *policy.Path, uid, gid int) error {
+	st, err := root.Stat()
+	if err == nil {
+		if !st.IsDir() {
+			return fmt.Errorf("%q is not a directory", root)
+		}
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := root.Dir().MkdirAll(0755); err != nil {
+		return err
+	}
+	if err := root.Mkdir(0755); err != nil {
+		return err
+	}
+	return root.Lchown(uid, gid)
+}
+
+// treeExtractor writes the entries of a tar archive below root without ever leaving it
+type treeExtractor struct {
+	root     *policy.Path
+	uid, gid int
+	entries  int
+	dirs     []*tar.Header
+}
+
+func (x *treeExtractor) extract(tr *tar.Reader) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid archive: %v", err)
+		}
+		target, err := x.entryPath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		klog.V(5).InfoS("Extracting archive entry", "name", hdr.Name, "type", string(hdr.Typeflag), "target", target)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = x.extractDir(target, hdr)
+		case tar.TypeReg:
+			err = x.extractFile(target, hdr, tr)
+		case tar.TypeSymlink:
+			err = x.extractSymlink(target, hdr)
+		case tar.TypeLink:
+			err = x.extractHardlink(target, hdr)
+		default:
+			klog.V(3).InfoS("Skipping unsupported archive entry", "name", hdr.Name, "type", string(hdr.Typeflag))
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to extract %q: %w", hdr.Name, err)
+		}
+		x.entries++
+	}
+
+	// Extracting entries changes the mtime of their directory and may need write access to
+	// it, so the modes and times of directories are applied last, innermost first
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		hdr := x.dirs[i]
+		target, _ := x.entryPath(hdr.Name)
+		if err := target.Chmod(unixMode(uint32(hdr.Mode))); err != nil {
+			return fmt.Errorf("failed to set mode of %q: %w", hdr.Name, err)
+		}
+		if err := setEntryTimes(target, hdr); err != nil {
+			return fmt.Errorf("failed to set times of %q: %w", hdr.Name, err)
+		}
+	}
+	return nil
+}
+
+// entryPath maps an archive entry name to its path below root. Names escaping root and
+// entries below anything but a real directory are rejected, so neither ".." nor symlinks
+// extracted earlier can redirect writes outside of root, which the kernel enforces as well.
+func (x *treeExtractor) entryPath(name string) (*policy.Path, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if clean == "." {
+		return x.root, nil
+	}
+	if !filepath.IsLocal(clean) {
+		return nil, status.Errorf(codes.InvalidArgument, "archive entry %q escapes the target directory", name)
+	}
+
+	dir := x.root
+	parts := strings.Split(clean, string(filepath.Separator))
+	for _, part := range parts[:len(parts)-1] {
+		dir = dir.Join(part)
+		st, err := dir.Lstat()
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "parent of archive entry %q is missing: %v", name, err)
+		}
+		if !st.IsDir() {
+			return nil, status.Errorf(codes.InvalidArgument, "parent of archive entry %q is not a directory", name)
+		}
+	}
+	return x.root.Join(clean), nil
+}
+
+func (x *treeExtractor) extractDir(target *policy.Path, hdr *tar.Header) error {
+	st, err := target.Lstat()
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if err := target.Mkdir(0700); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case !st.IsDir():
+		return fmt.Errorf("%q exists and is not a directory", target)
+	}
+	if err := target.Lchown(x.uid, x.gid); err != nil {
+		return err
+	}
+	// Read-only directories stay writable for their entries until the archive is extracted
+	if err := target.Chmod(unixMode(uint32(hdr.Mode)) | 0700); err != nil {
+		return err
+	}
+	x.dirs = append(x.dirs, hdr)
+	return nil
+}
+
+// extractFile writes a regular file next to target and renames it into place, which
+// replaces a symlink at target instead of writing through it
+func (x *treeExtractor) extractFile(target *policy.Path, hdr *tar.Header, r io.Reader) error {
+	if err := checkReplaceable(target); err != nil {
+		return err
+	}
+	path, f, err := createTempFile(target.Dir(), target.Base())
+	if err != nil {
+		return err
+	}
+	tmp := &atomicFile{File: f, path: path, target: target}
+	defer tmp.Cleanup()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	if err := f.Chown(x.uid, x.gid); err != nil {
+		return err
+	}
+	if err := f.Chmod(unixMode(uint32(hdr.Mode))); err != nil {
+		return err
+	}
+	if err := setEntryTimes(path, hdr); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := path.Rename(target); err != nil {
+		return err
+	}
+	tmp.committed = true
+	return nil
+}
+
+func (x *treeExtractor) extractSymlink(target *policy.Path, hdr *tar.Header) error {
+	if err := removeReplaceable(target); err != nil {
+		return err
+	}
+	if err := target.Symlink(hdr.Linkname); err != nil {
+		return err
+	}
+	if err := target.Lchown(x.uid, x.gid); err != nil {
+		return err
+	}
+	return setEntryTimes(target, hdr)
+}
+
+// extractHardlink links target to an entry extracted earlier, which has to be a regular
+// file below root
+func (x *treeExtractor) extractHardlink(target *policy.Path, hdr *tar.Header) error {
+	source, err := x.entryPath(hdr.Linkname)
+	if err != nil {
+		return err
+	}
+	st, err := source.Lstat()
+	if err != nil {
+		return err
+	}
+	if !st.Mode().IsRegular() {
+		return fmt.Errorf("hard link source %q is not a regular file", hdr.Linkname)
+	}
+	if err := removeReplaceable(target); err != nil {
+		return err
+	}
+	return source.Link(target)
+}
+
+// checkReplaceable fails when target is a directory, anything else may be replaced by an entry
+func checkReplaceable(target *policy.Path) error {
+	st, err := target.Lstat()
+	if err == nil && st.IsDir() {
+		return fmt.Errorf("%q exists and is a directory", target)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func removeReplaceable(target *policy.Path) error {
+	if err := checkReplaceable(target); err != nil {
+		return err
+	}
+	if err := target.Remove(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// setEntryTimes applies the times of an archive entry without following symlinks
+func setEntryTimes(target *policy.Path, hdr *tar.Header) error {
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(hdr.ModTime.UnixNano())}
+	return target.UtimesNano(ts)
+}
+
+// handleDownloadTree streams a directory as a tar archive. Symlinks are archived as links,
+// special files are skipped.
+func (s *Server) handleDownloadTree(stream pb.ConnectionService_TransferFileServer, info *pb.FileInfo) (err error) {
+	if info == nil {
+		errMsg := "missing FileInfo in tree download"
+		klog.ErrorS(nil, errMsg)
+		return status.Errorf(codes.InvalidArgument, errMsg)
+	}
+
+	auth, err := GetAuthInfoFromContext(stream.Context())
+	if err != nil {
+		klog.ErrorS(err, "Failed to retrieve auth info for tree download")
+		return status.Errorf(codes.Unauthenticated, "invalid auth info: %v", err)
+	}
+
+	path, err := s.resolvePath(auth.User, info.RemotePath)
+	if err != nil {
+		klog.ErrorS(err, "Failed to resolve path for tree download", "remote_path", info.RemotePath)
+		return err
+	}
+	defer path.Close()
+	root := path.String()
+	klog.V(3).InfoS("Starting tree download", "local_path", info.LocalPath, "dir", root, "compression", info.ArchiveCompression)
+
+	hasher, err := newHasher(info.ChecksumAlgorithm)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	chunkSize, err := s.chunkSize(info.ChunkSize)
+	if err != nil {
+		return err
+	}
+	limit, err := s.transferThrottle(auth.User, info)
+	if err != nil {
+		return err
+	}
+
+	w := &streamWriter{stream: stream, hasher: hasher, chunkSize: chunkSize, limit: limit}
+	defer func() {
+		err = transferFailure(err, pb.ControlMessage_DOWNLOAD_TREE, root, w.n)
+		s.auditTransfer(stream.Context(), auth.User, "download_tree", root, w.n, checksumLabel(info.ChecksumAlgorithm, hex.EncodeToString(hasher.Sum(nil))), err)
+	}()
+
+	// The directory itself may be reached through a symlink, the archive stays below it
+	var st os.FileInfo
+	var dir *policy.Path
+	err = runAsUser(auth.User, func() (err error) {
+		if st, err = path.Stat(); err != nil || !st.IsDir() {
+			return err
+		}
+		dir, err = path.Beneath(false)
+		return err
+	})
+	if err != nil {
+		klog.ErrorS(err, "Failed to stat directory for tree download", "dir", root)
+		return fileError(err, codes.NotFound, "failed to stat directory: %v", err)
+	}
+	if !st.IsDir() {
+		return status.Errorf(codes.FailedPrecondition, "%q is not a directory", info.RemotePath)
+	}
+	defer dir.Close()
+	if info.ArchiveCompression != pb.FileInfo_NONE && info.ArchiveCompression != pb.FileInfo_GZIP {
+		return status.Errorf(codes.InvalidArgument, "unsupported archive compression: %v", info.ArchiveCompression)
+	}
+
+	if info.ArchiveCompression != pb.FileInfo_NONE {
+		skipCompression(stream.Context())
+	}
+
+	controlMsg := &pb.FileTransferMessage{
+		Payload: &pb.FileTransferMessage_Control{
+			Control: &pb.ControlMessage{
+				Operation: pb.ControlMessage_DOWNLOAD_TREE,
+				Info: &pb.FileInfo{
+					LocalPath:          info.LocalPath,
+					RemotePath:         info.RemotePath,
+					ArchiveCompression: info.ArchiveCompression,
+					ChunkSize:          int32(chunkSize),
+					RateLimit:          limit.Rate(),
+				},
+			},
+		},
+	}
+	if err := stream.Send(controlMsg); err != nil {
+		klog.ErrorS(err, "Failed to send ControlMessage for tree download", "dir", root)
+		return status.Errorf(codes.Unknown, "failed to send control message: %v", err)
+	}
+
+	// The tree is read with the user's permissions
+	err = runAsUser(auth.User, func() error {
+		return writeTreeArchive(w, dir, info.ArchiveCompression, chunkSize)
+	})
+	if err != nil {
+		klog.ErrorS(err, "Failed to archive tree for download", "dir", root, "bytes_sent", w.n)
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return fileError(err, codes.Internal, "failed to archive directory: %v", err)
+	}
+	klog.V(3).InfoS("Tree download completed", "dir", root, "bytes_sent", w.n)
+
+	doneMsg := &pb.FileTransferMessage{
+		Payload: &pb.FileTransferMessage_Control{
+			Control: &pb.ControlMessage{
+				Operation: pb.ControlMessage_COMPLETE,
+				Info: &pb.FileInfo{
+					LocalPath:          info.LocalPath,
+					RemotePath:         info.RemotePath,
+					FileSize:           w.n,
+					ChecksumAlgorithm:  info.ChecksumAlgorithm,
+					Checksum:           hex.EncodeToString(hasher.Sum(nil)),
+					ArchiveCompression: info.ArchiveCompression,
+				},
+			},
+		},
+	}
+	if err := stream.Send(doneMsg); err != nil {
+		klog.ErrorS(err, "Failed to send checksum after tree download", "dir", root)
+		return status.Errorf(codes.Unknown, "failed to send checksum: %v", err)
+	}
+	return nil
+}
+
+// writeTreeArchive writes the content of root as a tar archive to w, in chunks of chunkSize
+func writeTreeArchive(w io.Writer, root *policy.Path, compression pb.FileInfo_ArchiveCompression, chunkSize int) error {
+	bw := bufio.NewWriterSize(w, chunkSize)
+	var out io.Writer = bw
+	var gz *gzip.Writer
+	if compression == pb.FileInfo_GZIP {
+		gz = gzip.NewWriter(bw)
+		out = gz
+	}
+	tw := tar.NewWriter(out)
+
+	err := walkTree(root, ".", func(path *policy.Path, rel string, fi os.FileInfo) error {
+		if !fi.Mode().IsRegular() && !fi.IsDir() && fi.Mode()&os.ModeSymlink == 0 {
+			klog.V(3).InfoS("Skipping special file in tree download", "path", path, "mode", fi.Mode())
+			return nil
+		}
+
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			var err error
+			if link, err = path.Readlink(); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := openRegularFile(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// The header already promised hdr.Size bytes, a file changing meanwhile must not break the archive
+		n, err := io.CopyN(tw, f, hdr.Size)
+		if err == io.EOF {
+			_, err = io.CopyN(tw, zeroReader{}, hdr.Size-n)
+			klog.V(2).InfoS("File shrank while archiving it", "path", path)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// walkTree calls fn for rel below root and, when it is a directory, for everything below it
+// in lexical order, like filepath.WalkDir. Symlinks are reported, not followed.
+func walkTree(root *policy.Path, rel string, fn func(path *policy.Path, rel string, fi os.FileInfo) error) error {
+	path := root.Join(rel)
+	fi, err := path.Lstat()
+	if err != nil {
+		return err
+	}
+	if err := fn(path, rel, fi); err != nil || !fi.IsDir() {
+		return err
+	}
+	names, err := readDirNames(path)
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := walkTree(root, filepath.Join(rel, name), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
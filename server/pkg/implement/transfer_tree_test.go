@@ -0,0 +1,218 @@
+package implement
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+)
+
+// tarMsgs returns a tar archive of hdrs, regular files holding their name, as a data message
+func tarMsgs(t *testing.T, hdrs ...*tar.Header) []*pb.FileTransferMessage {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range hdrs {
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(hdr.Name))
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if hdr.ModTime.IsZero() {
+			hdr.ModTime = time.Now()
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(hdr.Name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return []*pb.FileTransferMessage{dataMsg(buf.String())}
+}
+
+func TestUploadTreeConfined(t *testing.T) {
+	tests := []struct {
+		name string
+		// hdrs returns the archive entries given outside, a directory next to the extracted one
+		hdrs    func(outside string) []*tar.Header
+		wantErr bool
+		// want lists the files expected in the extracted directory with their content
+		want map[string]string
+	}{
+		{
+			name: "files and directories",
+			hdrs: func(string) []*tar.Header {
+				return []*tar.Header{
+					{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+					{Name: "dir/file", Typeflag: tar.TypeReg},
+					{Name: "./top", Typeflag: tar.TypeReg},
+				}
+			},
+			want: map[string]string{"dir/file": "dir/file", "top": "./top"},
+		},
+		{
+			name: "dot dot",
+			hdrs: func(string) []*tar.Header {
+				return []*tar.Header{{Name: "../outside/evil", Typeflag: tar.TypeReg}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "dot dot inside the name",
+			hdrs: func(string) []*tar.Header {
+				return []*tar.Header{
+					{Name: "dir/", Typeflag: tar.TypeDir},
+					{Name: "dir/../../outside/evil", Typeflag: tar.TypeReg},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "absolute name",
+			hdrs: func(outside string) []*tar.Header {
+				return []*tar.Header{{Name: filepath.Join(outside, "evil"), Typeflag: tar.TypeReg}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "file below a symlink",
+			hdrs: func(outside string) []*tar.Header {
+				return []*tar.Header{
+					{Name: "link", Typeflag: tar.TypeSymlink, Linkname: outside},
+					{Name: "link/evil", Typeflag: tar.TypeReg},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "file replacing a symlink",
+			hdrs: func(outside string) []*tar.Header {
+				return []*tar.Header{
+					{Name: "link", Typeflag: tar.TypeSymlink, Linkname: filepath.Join(outside, "evil")},
+					{Name: "link", Typeflag: tar.TypeReg},
+				}
+			},
+			want: map[string]string{"link": "link"},
+		},
+		{
+			name: "hardlink out of the directory",
+			hdrs: func(string) []*tar.Header {
+				return []*tar.Header{{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "../outside/secret"}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "hardlink to an absolute path",
+			hdrs: func(outside string) []*tar.Header {
+				return []*tar.Header{{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: filepath.Join(outside, "secret")}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "hardlink through a symlink",
+			hdrs: func(outside string) []*tar.Header {
+				return []*tar.Header{
+					{Name: "link", Typeflag: tar.TypeSymlink, Linkname: outside},
+					{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "link/secret"},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "hardlink to a symlink",
+			hdrs: func(outside string) []*tar.Header {
+				return []*tar.Header{
+					{Name: "link", Typeflag: tar.TypeSymlink, Linkname: filepath.Join(outside, "secret")},
+					{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "link"},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "hardlink inside the directory",
+			hdrs: func(string) []*tar.Header {
+				return []*tar.Header{
+					{Name: "file", Typeflag: tar.TypeReg},
+					{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "file"},
+				}
+			},
+			want: map[string]string{"file": "file", "hardlink": "file"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := t.TempDir()
+			outside := filepath.Join(base, "outside")
+			if err := os.Mkdir(outside, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			dir := filepath.Join(base, "dir")
+
+			msgs := append([]*pb.FileTransferMessage{controlMsg(pb.ControlMessage_UPLOAD_TREE, &pb.FileInfo{RemotePath: dir})}, tarMsgs(t, tt.hdrs(outside)...)...)
+			err := NewServer(nil, nil, nil).TransferFile(newTransferStream(t, msgs...))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("TransferFile error %v, want error %v", err, tt.wantErr)
+			}
+
+			// Nothing outside of the directory is touched
+			if names := dirEntries(t, outside); len(names) != 1 || names[0] != "secret" {
+				t.Errorf("outside directory holds %q, want only the secret", names)
+			}
+			if st, err := os.Stat(filepath.Join(outside, "secret")); err != nil || st.Sys().(*syscall.Stat_t).Nlink != 1 {
+				t.Errorf("secret was linked to: %v", err)
+			}
+			for name, content := range tt.want {
+				got, err := os.ReadFile(filepath.Join(dir, name))
+				if err != nil || string(got) != content {
+					t.Errorf("%s holds %q, %v, want %q", name, got, err, content)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadTreeDirectoryModes(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "dir")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	msgs := append([]*pb.FileTransferMessage{controlMsg(pb.ControlMessage_UPLOAD_TREE, &pb.FileInfo{RemotePath: dir})}, tarMsgs(t,
+		&tar.Header{Name: "ro/", Typeflag: tar.TypeDir, Mode: 0555, ModTime: mtime},
+		&tar.Header{Name: "ro/sub/", Typeflag: tar.TypeDir, Mode: 0500, ModTime: mtime},
+		&tar.Header{Name: "ro/sub/file", Typeflag: tar.TypeReg, Mode: 0400, ModTime: mtime},
+		&tar.Header{Name: "ro/file", Typeflag: tar.TypeReg, Mode: 0640, ModTime: mtime},
+	)...)
+	if err := NewServer(nil, nil, nil).TransferFile(newTransferStream(t, msgs...)); err != nil {
+		t.Fatalf("TransferFile: %v", err)
+	}
+	t.Cleanup(func() {
+		// Let the test cleanup remove the read-only directories
+		os.Chmod(filepath.Join(dir, "ro"), 0755)
+		os.Chmod(filepath.Join(dir, "ro", "sub"), 0755)
+	})
+
+	// Modes and times of directories are restored once their entries are extracted
+	for name, mode := range map[string]os.FileMode{"ro": os.ModeDir | 0555, "ro/sub": os.ModeDir | 0500, "ro/sub/file": 0400, "ro/file": 0640} {
+		st, err := os.Lstat(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if st.Mode() != mode || !st.ModTime().Equal(mtime) {
+			t.Errorf("%s has mode %v and mtime %v, want %v and %v", name, st.Mode(), st.ModTime(), mode, mtime)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package implement
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/policy"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// backupTimeFormat names backups like Ansible's backup option does, with microseconds so two
+// backups of one file within a second do not collide
+const backupTimeFormat = "2006-01-02@15:04:05.000000"
+
+// targetState describes the file an upload replaces
+type targetState struct {
+	exists   bool
+	size     int64
+	mtime    time.Time
+	checksum string
+}
+
+// hasUploadConditions reports whether an upload depends on the state of the file it replaces
+func hasUploadConditions(info *pb.FileInfo) bool {
+	return info.IfChecksum != "" || info.IfMtime != nil || info.SkipUnchanged
+}
+
+// inspectTarget looks at the file an upload to filePath replaces with the user's permissions.
+// Its content is hashed into hasher when hasher is not nil.
+func inspectTarget(username string, filePath *policy.Path, hasher hash.Hash) (*targetState, error) {
+	state := &targetState{}
+	err := runAsUser(username, func() error {
+		target, _, err := resolveTarget(filePath, 0)
+		if err != nil {
+			return err
+		}
+		if hasher == nil {
+			st, err := target.Stat()
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			state.exists, state.size, state.mtime = true, st.Size(), st.ModTime()
+			return nil
+		}
+
+		f, err := openRegularFile(target)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(hasher, f); err != nil {
+			return err
+		}
+		state.exists, state.size, state.mtime = true, st.Size(), st.ModTime()
+		state.checksum = hex.EncodeToString(hasher.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return nil, fileError(err, codes.Internal, "failed to inspect file: %v", err)
+	}
+	return state, nil
+}
+
+// checkUploadConditions fails with ABORTED unless the file an upload replaces still has the
+// checksum and mtime the client expects
+func checkUploadConditions(info *pb.FileInfo, state *targetState) error {
+	if info.IfChecksum != "" || info.IfMtime != nil {
+		if !state.exists {
+			return status.Errorf(codes.Aborted, "file %s does not exist", info.RemotePath)
+		}
+	}
+	if info.IfChecksum != "" && state.checksum != strings.ToLower(info.IfChecksum) {
+		return status.Errorf(codes.Aborted, "file %s changed: expected checksum %s, found %s", info.RemotePath, info.IfChecksum, state.checksum)
+	}
+	if info.IfMtime != nil && state.mtime.Unix() != info.IfMtime.Seconds {
+		return status.Errorf(codes.Aborted, "file %s changed: expected mtime %s, found %s",
+			info.RemotePath, info.IfMtime.AsTime().Format(time.RFC3339), state.mtime.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// backupFile keeps the current content of target as "<target>.<timestamp>~" before it is
+// replaced and returns the backup's path, or "" when there is no file to keep. The backup is
+// a hard link to the old file, keeping its owner, mode and attributes; where the user may not
+// link the file, it is copied.
+func backupFile(target *policy.Path) (string, error) {
+	st, err := target.Stat()
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	backup := target.Dir().Join(fmt.Sprintf("%s.%s~", target.Base(), time.Now().Format(backupTimeFormat)))
+	err = target.Link(backup)
+	if errors.Is(err, os.ErrPermission) {
+		// protected_hardlinks refuses links to files the user does not own
+		err = copyFile(target, backup, st)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to back up %s: %w", target, err)
+	}
+	return backup.String(), nil
+}
+
+// copyFile copies src with the mode and mtime in st to the new file dst
+func copyFile(src, dst *policy.Path, st os.FileInfo) (err error) {
+	in, err := openRegularFile(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := dst.Open(os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, st.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			dst.Remove()
+		}
+	}()
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := futimes(out, time.Time{}, st.ModTime()); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,174 @@
+package implement
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/policy"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/utils"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// userXattrs are the extended attributes outside of the user namespace that users other than
+// root may set. The others, trusted.* or security.capability among them, are guarded by
+// capabilities the daemon keeps while acting as the user, so only root may set them. So is
+// security.selinux: relabeling is checked against the daemon's SELinux domain rather than the
+// user's, files of other users get the label of the directory they are created in.
+var userXattrs = []string{"system.posix_acl_access", "system.posix_acl_default"}
+
+func xattrAllowed(name string, root bool) bool {
+	return root || strings.HasPrefix(name, "user.") || slices.Contains(userXattrs, name)
+}
+
+// checkUploadXattrs validates the extended attributes requested for an upload before any data
+// is received
+func checkUploadXattrs(username string, info *pb.FileInfo) error {
+	if len(info.Xattrs) == 0 {
+		return nil
+	}
+	if info.XattrMode != pb.FileInfo_XATTRS_TRANSFER {
+		return status.Errorf(codes.InvalidArgument, "xattrs are only applied with xattr mode %v", pb.FileInfo_XATTRS_TRANSFER)
+	}
+	uid, _, err := utils.GetUserIDs(username)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to lookup user: %v", err)
+	}
+	for _, x := range info.Xattrs {
+		if x.Name == "" || strings.IndexByte(x.Name, 0) >= 0 {
+			return status.Errorf(codes.InvalidArgument, "invalid extended attribute name %q", x.Name)
+		}
+		if !xattrAllowed(x.Name, uid == 0) {
+			return status.Errorf(codes.PermissionDenied, "only root may set extended attribute %q", x.Name)
+		}
+	}
+	return nil
+}
+
+// applyUploadXattrs gives the staged file of an upload the extended attributes sent by the
+// client or, when inheriting, those of the file it replaces. Inherited attributes only root
+// may set are dropped for other users. It must run after the file got its owner, setting ACLs
+// as the user requires owning the file.
+func applyUploadXattrs(username string, file *atomicFile, info *pb.FileInfo) error {
+	var xattrs []*pb.Xattr
+	switch info.XattrMode {
+	case pb.FileInfo_XATTRS_TRANSFER:
+		xattrs = info.Xattrs
+	case pb.FileInfo_XATTRS_INHERIT:
+		err := runAsUser(username, func() (err error) {
+			xattrs, err = pathXattrs(file.Target())
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return fileError(err, codes.Internal, "failed to read extended attributes of %s: %v", file.Target(), err)
+		}
+		uid, _, err := utils.GetUserIDs(username)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to lookup user: %v", err)
+		}
+		xattrs = slices.DeleteFunc(xattrs, func(x *pb.Xattr) bool {
+			if xattrAllowed(x.Name, uid == 0) {
+				return false
+			}
+			klog.V(4).InfoS("Not inheriting extended attribute", "file_path", file.Target(), "name", x.Name)
+			return true
+		})
+	}
+	if len(xattrs) == 0 {
+		return nil
+	}
+
+	fd := int(file.Fd())
+	err := runAsUser(username, func() error {
+		for _, x := range xattrs {
+			if err := unix.Fsetxattr(fd, x.Name, x.Value, 0); err != nil {
+				return fmt.Errorf("failed to set extended attribute %q: %w", x.Name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fileError(err, codes.Internal, "%v", err)
+	}
+	return nil
+}
+
+// fileXattrs returns the extended attributes of an open file, none on filesystems without
+// support for them
+func fileXattrs(file *os.File) ([]*pb.Xattr, error) {
+	fd := int(file.Fd())
+	return readXattrs(
+		func(buf []byte) (int, error) { return unix.Flistxattr(fd, buf) },
+		func(name string, buf []byte) (int, error) { return unix.Fgetxattr(fd, name, buf) },
+	)
+}
+
+// pathXattrs returns the extended attributes of path without following a final symlink.
+// Unlike fileXattrs it does not need read access to the file.
+func pathXattrs(path *policy.Path) ([]*pb.Xattr, error) {
+	f, err := path.Open(unix.O_PATH|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	proc := fdPath(f)
+	return readXattrs(
+		func(buf []byte) (int, error) { return unix.Listxattr(proc, buf) },
+		func(name string, buf []byte) (int, error) { return unix.Getxattr(proc, name, buf) },
+	)
+}
+
+func readXattrs(list func([]byte) (int, error), get func(string, []byte) (int, error)) ([]*pb.Xattr, error) {
+	names, err := xattrCall(list)
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list extended attributes: %w", err)
+	}
+	var xattrs []*pb.Xattr
+	for _, name := range strings.Split(string(names), "\x00") {
+		if name == "" {
+			continue
+		}
+		value, err := xattrCall(func(buf []byte) (int, error) { return get(name, buf) })
+		if errors.Is(err, unix.ENODATA) {
+			// Removed since it was listed
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read extended attribute %q: %w", name, err)
+		}
+		xattrs = append(xattrs, &pb.Xattr{Name: name, Value: value})
+	}
+	return xattrs, nil
+}
+
+// xattrCall calls fn with a buffer fitting its result, sized by a first call without buffer.
+// It retries when the result grew in between.
+func xattrCall(fn func([]byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := fn(nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := fn(buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
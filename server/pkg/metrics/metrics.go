@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const namespace = "ansible_grpc"
+
+var (
+	// RPCRequests counts finished RPCs by method and status code
+	RPCRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rpc_requests_total",
+		Help:      "Number of finished RPCs by method and status code.",
+	}, []string{"method", "code"})
+
+	// RPCDuration observes RPC latencies by method
+	RPCDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "RPC latency by method.",
+		Buckets:   []float64{.005, .01, .05, .1, .5, 1, 5, 10, 30, 60, 300},
+	}, []string{"method"})
+
+	// ActiveStreams tracks the streaming RPCs in progress
+	ActiveStreams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_streams",
+		Help:      "Number of streaming RPCs in progress by method.",
+	}, []string{"method"})
+
+	// AuthAttempts counts authentication attempts by method and result
+	AuthAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_attempts_total",
+		Help:      "Authentication attempts by auth method and result (success, failure, throttled).",
+	}, []string{"auth_method", "result"})
+
+	// TransferBytes counts the file bytes moved by TransferFile
+	TransferBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transfer_bytes_total",
+		Help:      "File bytes transferred by direction (upload, download).",
+	}, []string{"direction"})
+
+	// RunningProcesses tracks the child processes started by ExecCommand
+	RunningProcesses = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "running_processes",
+		Help:      "Number of commands currently executing.",
+	})
+
+	// AuthorizedKeysReloads counts reloads of watched authorized keys files by result
+	AuthorizedKeysReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "authorized_keys_reloads_total",
+		Help:      "Reloads of watched authorized keys files by result (success, failure).",
+	}, []string{"result"})
+)
+
+// NewRegistry returns a registry holding the server metrics along with the Go runtime and process collectors
+func NewRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		RPCRequests,
+		RPCDuration,
+		ActiveStreams,
+		AuthAttempts,
+		TransferBytes,
+		RunningProcesses,
+		AuthorizedKeysReloads,
+	)
+	return reg
+}
+
+// Serve exposes the metrics of reg on addr under /metrics until ctx is cancelled
+func Serve(ctx context.Context, addr string, reg *prometheus.Registry) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	klog.Infof("Metrics are served on %s/metrics", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		klog.Fatalf("Failed to serve metrics: %v", err)
+	}
+}
+
+// UnaryServerInterceptor records request counts and latencies of unary RPCs
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	observe(info.FullMethod, start, err)
+	return resp, err
+}
+
+// StreamServerInterceptor records request counts, latencies and active streams of streaming RPCs
+func StreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	gauge := ActiveStreams.WithLabelValues(info.FullMethod)
+	gauge.Inc()
+	defer gauge.Dec()
+
+	err := handler(srv, ss)
+	observe(info.FullMethod, start, err)
+	return err
+}
+
+func observe(method string, start time.Time, err error) {
+	RPCRequests.WithLabelValues(method, status.Code(err).String()).Inc()
+	RPCDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
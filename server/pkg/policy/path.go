@@ -0,0 +1,443 @@
+package policy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Path is a path below an allowed root. The root is held open and every operation resolves
+// the path anew below it with openat2 RESOLVE_BENEATH, so neither a symlink nor ".." leads
+// outside of the root, however the tree changes after Resolve. Operations that create,
+// remove or rename entries use the *at system calls on the parent directory opened that way
+// and never follow a symlink in the last component. An unconfined Path is used as it is.
+type Path struct {
+	root *rootDir
+	rel  string
+}
+
+// rootDir is the directory a Path is confined to, opened on first use
+type rootDir struct {
+	path    string
+	fd      int
+	resolve uint64
+}
+
+// Unconfined returns a Path for path that is not confined to any directory
+func Unconfined(path string) *Path {
+	return &Path{rel: path}
+}
+
+// String returns the path
+func (p *Path) String() string {
+	if p.root == nil {
+		return p.rel
+	}
+	return filepath.Join(p.root.path, p.rel)
+}
+
+// Join returns the path of elem below p, confined to the same root
+func (p *Path) Join(elem ...string) *Path {
+	return &Path{root: p.root, rel: filepath.Join(append([]string{p.rel}, elem...)...)}
+}
+
+// Dir returns the directory containing p, the root for the root itself
+func (p *Path) Dir() *Path {
+	return &Path{root: p.root, rel: filepath.Dir(p.rel)}
+}
+
+// Base returns the last component of p
+func (p *Path) Base() string {
+	return filepath.Base(p.String())
+}
+
+// Close releases the root of a Path returned by Resolve or Beneath. Paths joined to it must
+// not be used afterwards.
+func (p *Path) Close() error {
+	if p.root == nil || p.root.fd < 0 {
+		return nil
+	}
+	err := unix.Close(p.root.fd)
+	p.root.fd = -1
+	return err
+}
+
+// Beneath returns the directory p as the root of the paths joined to it, none of which can
+// leave the directory. With noSymlinks set they may not contain symlinks at all. The result
+// has to be closed. Without openat2 an unconfined directory is returned unchanged.
+func (p *Path) Beneath(noSymlinks bool) (*Path, error) {
+	if p.root == nil && Supported() != nil {
+		return Unconfined(p.rel), nil
+	}
+	fd, err := p.open(unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, p.error("open", err)
+	}
+	resolve := uint64(unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS)
+	if noSymlinks {
+		resolve |= unix.RESOLVE_NO_SYMLINKS
+	}
+	return &Path{root: &rootDir{path: p.String(), fd: fd, resolve: resolve}, rel: "."}, nil
+}
+
+// Open opens p like os.OpenFile. A symlink in the last component is followed unless flag
+// contains O_NOFOLLOW.
+func (p *Path) Open(flag int, perm os.FileMode) (*os.File, error) {
+	fd, err := p.open(flag, syscallMode(perm))
+	if err != nil {
+		return nil, p.error("open", err)
+	}
+	return os.NewFile(uintptr(fd), p.String()), nil
+}
+
+// Stat returns the metadata of the file p refers to
+func (p *Path) Stat() (os.FileInfo, error) {
+	return p.stat("stat", 0)
+}
+
+// Lstat returns the metadata of p without following a symlink in the last component
+func (p *Path) Lstat() (os.FileInfo, error) {
+	return p.stat("lstat", unix.O_NOFOLLOW)
+}
+
+func (p *Path) stat(op string, flag int) (os.FileInfo, error) {
+	fd, err := p.open(unix.O_PATH|flag, 0)
+	if err != nil {
+		return nil, p.error(op, err)
+	}
+	f := os.NewFile(uintptr(fd), p.String())
+	defer f.Close()
+	return f.Stat()
+}
+
+// EvalSymlinks returns the path of the file p refers to, with every symlink resolved
+func (p *Path) EvalSymlinks() (*Path, error) {
+	fd, err := p.open(unix.O_PATH, 0)
+	if err != nil {
+		return nil, p.error("open", err)
+	}
+	defer unix.Close(fd)
+	resolved, err := os.Readlink(fdPath(fd))
+	if err != nil {
+		return nil, err
+	}
+	if p.root == nil {
+		return Unconfined(resolved), nil
+	}
+
+	rootFd, err := p.root.open()
+	if err != nil {
+		return nil, err
+	}
+	realRoot, err := os.Readlink(fdPath(rootFd))
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(realRoot, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return nil, p.error("open", ErrOutside)
+	}
+	return &Path{root: p.root, rel: rel}, nil
+}
+
+// Readlink returns the target of the symlink p
+func (p *Path) Readlink() (string, error) {
+	var target string
+	err := p.at("readlink", func(dirfd int, name string) error {
+		buf := make([]byte, 256)
+		for {
+			n, err := unix.Readlinkat(dirfd, name, buf)
+			if err != nil {
+				return err
+			}
+			if n < len(buf) {
+				target = string(buf[:n])
+				return nil
+			}
+			buf = make([]byte, 2*len(buf))
+		}
+	})
+	return target, err
+}
+
+// Mkdir creates the directory p
+func (p *Path) Mkdir(perm os.FileMode) error {
+	return p.at("mkdir", func(dirfd int, name string) error {
+		return unix.Mkdirat(dirfd, name, syscallMode(perm))
+	})
+}
+
+// MkdirAll creates the directory p along with its missing parents like os.MkdirAll. A
+// missing root is created as well.
+func (p *Path) MkdirAll(perm os.FileMode) error {
+	st, err := p.Stat()
+	if err == nil {
+		if !st.IsDir() {
+			return p.error("mkdir", unix.ENOTDIR)
+		}
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if p.root == nil {
+		return os.MkdirAll(p.rel, perm)
+	}
+	if p.rel == "." {
+		return os.MkdirAll(p.root.path, perm)
+	}
+	if err := p.Dir().MkdirAll(perm); err != nil {
+		return err
+	}
+	if err := p.Mkdir(perm); err != nil {
+		// Created concurrently
+		if st, serr := p.Lstat(); serr == nil && st.IsDir() {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// Remove removes the file or empty directory p like os.Remove
+func (p *Path) Remove() error {
+	return p.at("remove", func(dirfd int, name string) error {
+		err := unix.Unlinkat(dirfd, name, 0)
+		if err == nil {
+			return nil
+		}
+		rmdirErr := unix.Unlinkat(dirfd, name, unix.AT_REMOVEDIR)
+		if rmdirErr == nil {
+			return nil
+		}
+		if rmdirErr != unix.ENOTDIR {
+			err = rmdirErr
+		}
+		return err
+	})
+}
+
+// RemoveAll removes p and everything below it like os.RemoveAll, symlinks are removed
+// rather than followed
+func (p *Path) RemoveAll() error {
+	err := p.Remove()
+	if err == nil || errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if !errors.Is(err, unix.ENOTEMPTY) && !errors.Is(err, unix.EEXIST) {
+		return err
+	}
+	dir, err := p.Open(unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := p.Join(name).RemoveAll(); err != nil {
+			return err
+		}
+	}
+	if err := p.Remove(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Rename renames p to newPath like os.Rename
+func (p *Path) Rename(newPath *Path) error {
+	return p.linkAt("rename", newPath, func(olddirfd int, oldname string, newdirfd int, newname string) error {
+		return unix.Renameat(olddirfd, oldname, newdirfd, newname)
+	})
+}
+
+// Link creates newPath as a hard link to p, a symlink p is linked itself
+func (p *Path) Link(newPath *Path) error {
+	return p.linkAt("link", newPath, func(olddirfd int, oldname string, newdirfd int, newname string) error {
+		return unix.Linkat(olddirfd, oldname, newdirfd, newname, 0)
+	})
+}
+
+// Symlink creates p as a symlink to target
+func (p *Path) Symlink(target string) error {
+	return p.at("symlink", func(dirfd int, name string) error {
+		return unix.Symlinkat(target, dirfd, name)
+	})
+}
+
+// Lchown changes the owner of p without following a symlink
+func (p *Path) Lchown(uid, gid int) error {
+	return p.node("lchown", func(fd int) error {
+		return unix.Fchownat(fd, "", uid, gid, unix.AT_EMPTY_PATH)
+	})
+}
+
+// Chmod changes the mode of p, which must not be a symlink
+func (p *Path) Chmod(mode os.FileMode) error {
+	return p.node("chmod", func(fd int) error {
+		// chmod fails with EOPNOTSUPP when the descriptor refers to a symlink
+		return unix.Fchmodat(unix.AT_FDCWD, fdPath(fd), syscallMode(mode), 0)
+	})
+}
+
+// UtimesNano sets the access and modification times of p without following a symlink
+func (p *Path) UtimesNano(ts []unix.Timespec) error {
+	return p.node("utimes", func(fd int) error {
+		return unix.UtimesNanoAt(unix.AT_FDCWD, fdPath(fd), ts, 0)
+	})
+}
+
+// open opens p below its root
+func (p *Path) open(flag int, perm uint32) (int, error) {
+	flag |= unix.O_CLOEXEC
+	if p.root == nil {
+		for {
+			fd, err := unix.Open(p.rel, flag, perm)
+			if err != unix.EINTR {
+				return fd, err
+			}
+		}
+	}
+	rootFd, err := p.root.open()
+	if err != nil {
+		return -1, err
+	}
+	how := &unix.OpenHow{Flags: uint64(flag), Resolve: p.root.resolve}
+	if flag&(unix.O_CREAT|unix.O_TMPFILE) != 0 {
+		how.Mode = uint64(perm)
+	}
+	for {
+		fd, err := unix.Openat2(rootFd, p.rel, how)
+		switch err {
+		case unix.EINTR, unix.EAGAIN:
+			// EAGAIN reports a rename racing the lookup
+			continue
+		case unix.EXDEV:
+			return -1, ErrOutside
+		case unix.ENOSYS:
+			return -1, errNoOpenat2
+		}
+		return fd, err
+	}
+}
+
+// at calls fn with the directory containing p and the last component of p
+func (p *Path) at(op string, fn func(dirfd int, name string) error) error {
+	dirfd, name, err := p.parent()
+	if err != nil {
+		return p.error(op, err)
+	}
+	if dirfd != unix.AT_FDCWD {
+		defer unix.Close(dirfd)
+	}
+	if err := ignoringEINTR(func() error { return fn(dirfd, name) }); err != nil {
+		return p.error(op, err)
+	}
+	return nil
+}
+
+// linkAt is at for operations on two paths
+func (p *Path) linkAt(op string, newPath *Path, fn func(olddirfd int, oldname string, newdirfd int, newname string) error) error {
+	linkError := func(err error) error {
+		return &os.LinkError{Op: op, Old: p.String(), New: newPath.String(), Err: err}
+	}
+	olddirfd, oldname, err := p.parent()
+	if err != nil {
+		return linkError(err)
+	}
+	if olddirfd != unix.AT_FDCWD {
+		defer unix.Close(olddirfd)
+	}
+	newdirfd, newname, err := newPath.parent()
+	if err != nil {
+		return linkError(err)
+	}
+	if newdirfd != unix.AT_FDCWD {
+		defer unix.Close(newdirfd)
+	}
+	if err := ignoringEINTR(func() error { return fn(olddirfd, oldname, newdirfd, newname) }); err != nil {
+		return linkError(err)
+	}
+	return nil
+}
+
+// node calls fn with an O_PATH descriptor of p itself, a symlink is not followed
+func (p *Path) node(op string, fn func(fd int) error) error {
+	fd, err := p.open(unix.O_PATH|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return p.error(op, err)
+	}
+	defer unix.Close(fd)
+	if err := ignoringEINTR(func() error { return fn(fd) }); err != nil {
+		return p.error(op, err)
+	}
+	return nil
+}
+
+// parent opens the directory containing p below the root and returns it with the last
+// component of p. An unconfined path is passed on as it is.
+func (p *Path) parent() (int, string, error) {
+	if p.root == nil {
+		return unix.AT_FDCWD, p.rel, nil
+	}
+	name := filepath.Base(p.rel)
+	if name == "." || name == ".." {
+		// The root itself, or what lies above it
+		return -1, "", ErrOutside
+	}
+	fd, err := p.Dir().open(unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return -1, "", err
+	}
+	return fd, name, nil
+}
+
+func (p *Path) error(op string, err error) error {
+	return &os.PathError{Op: op, Path: p.String(), Err: err}
+}
+
+func (r *rootDir) open() (int, error) {
+	if r.fd < 0 {
+		fd, err := unix.Open(r.path, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return -1, err
+		}
+		r.fd = fd
+	}
+	return r.fd, nil
+}
+
+// fdPath returns the /proc path of fd, which reaches the file it refers to itself
+func fdPath(fd int) string {
+	return "/proc/self/fd/" + strconv.Itoa(fd)
+}
+
+// syscallMode converts the permissions and special bits of mode like os.Chmod does
+func syscallMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= unix.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= unix.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= unix.S_ISVTX
+	}
+	return m
+}
+
+func ignoringEINTR(fn func() error) error {
+	for {
+		if err := fn(); err != unix.EINTR {
+			return err
+		}
+	}
+}
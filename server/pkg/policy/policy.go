@@ -0,0 +1,145 @@
+// Package policy confines the paths users may reach through file operations, and optionally
+// the filesystem view of the commands they run, according to a JSON policy file.
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ErrOutside is returned for paths outside of every allowed prefix, and for paths a symlink
+// or ".." leads out of their root
+var ErrOutside = errors.New("path is outside of the allowed paths")
+
+// Rule lists what a user, or the members of a group, may access
+type Rule struct {
+	// AllowedPaths are the directories file operations are confined to. "~" stands for the
+	// user's home directory, "/" allows everything.
+	AllowedPaths []string `json:"allowed_paths"`
+	// ExecChroot, when set, is the directory commands are chrooted into. Users whose paths are
+	// confined may only run commands with one.
+	ExecChroot string `json:"exec_chroot,omitempty"`
+}
+
+// Policy maps users and groups to rules. A user's own rule wins over the rules of its
+// groups, which are merged; users matching neither get the default rule, and without a
+// default rule no path at all.
+type Policy struct {
+	Default *Rule            `json:"default,omitempty"`
+	Users   map[string]*Rule `json:"users,omitempty"`
+	Groups  map[string]*Rule `json:"groups,omitempty"`
+}
+
+// Load reads a policy file
+func Load(path string) (*Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading path policy %q: %w", path, err)
+	}
+	defer f.Close()
+	p := &Policy{}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		return nil, fmt.Errorf("error parsing path policy %q: %w", path, err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("invalid path policy %q: %w", path, err)
+	}
+	return p, nil
+}
+
+func (p *Policy) validate() error {
+	check := func(who string, r *Rule) error {
+		if r == nil {
+			return fmt.Errorf("%s: empty rule", who)
+		}
+		for _, path := range r.AllowedPaths {
+			if path != "~" && !strings.HasPrefix(path, "~/") && !filepath.IsAbs(path) {
+				return fmt.Errorf("%s: allowed path %q is neither absolute nor below ~", who, path)
+			}
+		}
+		if r.ExecChroot != "" && !filepath.IsAbs(r.ExecChroot) {
+			return fmt.Errorf("%s: exec chroot %q is not absolute", who, r.ExecChroot)
+		}
+		return nil
+	}
+	if p.Default != nil {
+		if err := check("default", p.Default); err != nil {
+			return err
+		}
+	}
+	for name, r := range p.Users {
+		if err := check("user "+name, r); err != nil {
+			return err
+		}
+	}
+	for name, r := range p.Groups {
+		if err := check("group "+name, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// For returns the confinement of u. A nil Policy confines nobody and returns nil.
+func (p *Policy) For(u *user.User) (*Confinement, error) {
+	if p == nil {
+		return nil, nil
+	}
+
+	var rules []*Rule
+	if r, ok := p.Users[u.Username]; ok {
+		rules = append(rules, r)
+	} else if len(p.Groups) > 0 {
+		gids, err := u.GroupIds()
+		if err != nil {
+			return nil, fmt.Errorf("failed to lookup groups of %q: %w", u.Username, err)
+		}
+		var names []string
+		for _, gid := range gids {
+			if g, err := user.LookupGroupId(gid); err == nil {
+				names = append(names, g.Name)
+			}
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			if r, ok := p.Groups[name]; ok {
+				rules = append(rules, r)
+			}
+		}
+	}
+	if len(rules) == 0 && p.Default != nil {
+		rules = append(rules, p.Default)
+	}
+
+	c := &Confinement{}
+	for _, r := range rules {
+		for _, path := range r.AllowedPaths {
+			c.Roots = append(c.Roots, expandHome(path, u.HomeDir))
+		}
+		if r.ExecChroot != "" {
+			if c.ExecChroot != "" && c.ExecChroot != r.ExecChroot {
+				return nil, fmt.Errorf("conflicting exec chroots %q and %q for user %q", c.ExecChroot, r.ExecChroot, u.Username)
+			}
+			c.ExecChroot = r.ExecChroot
+		}
+	}
+	return c, nil
+}
+
+func expandHome(path, home string) string {
+	if path == "~" {
+		return filepath.Clean(home)
+	}
+	if strings.HasPrefix(path, "~/") {
+		return filepath.Join(home, path[2:])
+	}
+	return filepath.Clean(path)
+}
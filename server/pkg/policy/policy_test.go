@@ -0,0 +1,172 @@
+package policy
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func writePolicy(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// currentUser returns the user running the tests along with the sorted names of its groups
+func currentUser(t *testing.T) (*user.User, []string) {
+	t.Helper()
+	u, err := user.Current()
+	if err != nil {
+		t.Skipf("no current user: %v", err)
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		t.Skipf("no groups of the current user: %v", err)
+	}
+	var groups []string
+	for _, gid := range gids {
+		if g, err := user.LookupGroupId(gid); err == nil {
+			groups = append(groups, g.Name)
+		}
+	}
+	slices.Sort(groups)
+	return u, groups
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{name: "valid", content: `{"default": {"allowed_paths": ["~", "/srv"]}, "users": {"root": {"allowed_paths": ["/"], "exec_chroot": "/"}}}`},
+		{name: "empty", content: `{}`},
+		{name: "unknown field", content: `{"default": {"allowed": ["/"]}}`, wantErr: "error parsing"},
+		{name: "not json", content: `allowed_paths: /`, wantErr: "error parsing"},
+		{name: "relative path", content: `{"users": {"a": {"allowed_paths": ["srv"]}}}`, wantErr: `user a: allowed path "srv"`},
+		{name: "other user's home", content: `{"groups": {"g": {"allowed_paths": ["~bob"]}}}`, wantErr: `group g: allowed path "~bob"`},
+		{name: "relative chroot", content: `{"default": {"allowed_paths": ["/"], "exec_chroot": "jail"}}`, wantErr: `default: exec chroot "jail"`},
+		{name: "null rule", content: `{"users": {"a": null}}`, wantErr: "user a: empty rule"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writePolicy(t, tt.content))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Load: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Load error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("Load of a missing file succeeded")
+	}
+}
+
+func TestFor(t *testing.T) {
+	u, groups := currentUser(t)
+	if len(groups) == 0 {
+		t.Skip("current user has no named group")
+	}
+	group := groups[0]
+
+	tests := []struct {
+		name       string
+		policy     *Policy
+		wantRoots  []string
+		wantChroot string
+	}{
+		{
+			name:      "user rule wins over groups and default",
+			policy:    &Policy{Default: &Rule{AllowedPaths: []string{"/d"}}, Users: map[string]*Rule{u.Username: {AllowedPaths: []string{"~", "/u"}}}, Groups: map[string]*Rule{group: {AllowedPaths: []string{"/g"}}}},
+			wantRoots: []string{filepath.Clean(u.HomeDir), "/u"},
+		},
+		{
+			name:       "group rule wins over default",
+			policy:     &Policy{Default: &Rule{AllowedPaths: []string{"/d"}}, Groups: map[string]*Rule{group: {AllowedPaths: []string{"~/work", "/g/"}, ExecChroot: "/jail"}}},
+			wantRoots:  []string{filepath.Join(u.HomeDir, "work"), "/g"},
+			wantChroot: "/jail",
+		},
+		{
+			name:      "rules of other users and groups are ignored",
+			policy:    &Policy{Default: &Rule{AllowedPaths: []string{"/d"}}, Users: map[string]*Rule{"no such user": {AllowedPaths: []string{"/u"}}}, Groups: map[string]*Rule{"no such group": {AllowedPaths: []string{"/g"}}}},
+			wantRoots: []string{"/d"},
+		},
+		{
+			name:   "no matching rule allows nothing",
+			policy: &Policy{Users: map[string]*Rule{"no such user": {AllowedPaths: []string{"/u"}}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := tt.policy.For(u)
+			if err != nil {
+				t.Fatalf("For: %v", err)
+			}
+			if !slices.Equal(c.Roots, tt.wantRoots) || c.ExecChroot != tt.wantChroot {
+				t.Errorf("For = roots %q chroot %q, want roots %q chroot %q", c.Roots, c.ExecChroot, tt.wantRoots, tt.wantChroot)
+			}
+		})
+	}
+
+	t.Run("nil policy confines nobody", func(t *testing.T) {
+		var p *Policy
+		c, err := p.For(u)
+		if err != nil || c != nil {
+			t.Errorf("For = %v, %v, want nil", c, err)
+		}
+	})
+}
+
+func TestForMergesGroups(t *testing.T) {
+	u, groups := currentUser(t)
+	if len(groups) < 2 {
+		t.Skip("current user is in fewer than two groups")
+	}
+
+	p := &Policy{Groups: map[string]*Rule{
+		groups[1]: {AllowedPaths: []string{"/second"}, ExecChroot: "/jail"},
+		groups[0]: {AllowedPaths: []string{"/first"}, ExecChroot: "/jail"},
+	}}
+	c, err := p.For(u)
+	if err != nil {
+		t.Fatalf("For: %v", err)
+	}
+	if want := []string{"/first", "/second"}; !slices.Equal(c.Roots, want) || c.ExecChroot != "/jail" {
+		t.Errorf("For = roots %q chroot %q, want roots %q chroot /jail", c.Roots, c.ExecChroot, want)
+	}
+
+	p.Groups[groups[1]].ExecChroot = "/other"
+	if _, err := p.For(u); err == nil {
+		t.Errorf("For with conflicting exec chroots succeeded")
+	}
+}
+
+func TestExpandHome(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "~", want: "/home/u"},
+		{path: "~/", want: "/home/u"},
+		{path: "~/a/../b", want: "/home/u/b"},
+		{path: "/srv/./x/", want: "/srv/x"},
+		{path: "/", want: "/"},
+	}
+	for _, tt := range tests {
+		if got := expandHome(tt.path, "/home/u/"); got != tt.want {
+			t.Errorf("expandHome(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
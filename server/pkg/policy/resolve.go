@@ -0,0 +1,88 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// errNoOpenat2 is returned for confined paths on kernels without openat2
+var errNoOpenat2 = errors.New("confining paths requires openat2, available since Linux 5.6")
+
+// Confinement is the set of directories a user's file operations are confined to
+type Confinement struct {
+	Roots      []string
+	ExecChroot string
+}
+
+// Resolve checks that the absolute path lies below one of the allowed roots and returns it
+// as a Path confined to the longest such root. Symlinks are not resolved here but by every
+// operation on the Path, below the root, so a link inside a root cannot lead outside of it
+// whenever it is created. A nil Confinement allows every path.
+func (c *Confinement) Resolve(path string) (*Path, error) {
+	if c == nil {
+		return Unconfined(path), nil
+	}
+	if !filepath.IsAbs(path) {
+		return nil, fmt.Errorf("%w: %q is not absolute", ErrOutside, path)
+	}
+	path = filepath.Clean(path)
+
+	root, ok := c.rootFor(path)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrOutside, path)
+	}
+	if root == "/" {
+		return Unconfined(path), nil
+	}
+	if err := Supported(); err != nil {
+		return nil, err
+	}
+
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return nil, err
+	}
+	return &Path{root: &rootDir{path: root, fd: -1, resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS}, rel: rel}, nil
+}
+
+// Confined reports whether paths are confined at all, they are unless "/" is allowed
+func (c *Confinement) Confined() bool {
+	return c != nil && !slices.Contains(c.Roots, "/")
+}
+
+// rootFor returns the longest root containing path
+func (c *Confinement) rootFor(path string) (string, bool) {
+	best, found := "", false
+	for _, root := range c.Roots {
+		if root == "/" || path == root || strings.HasPrefix(path, root+"/") {
+			if !found || len(root) > len(best) {
+				best, found = root, true
+			}
+		}
+	}
+	return best, found
+}
+
+var openat2Supported = sync.OnceValue(func() error {
+	fd, err := unix.Openat2(unix.AT_FDCWD, "/", &unix.OpenHow{Flags: unix.O_PATH | unix.O_CLOEXEC})
+	if err != nil {
+		// Seccomp filters unaware of openat2 answer EPERM
+		if errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EPERM) {
+			return errNoOpenat2
+		}
+		return fmt.Errorf("openat2: %w", err)
+	}
+	unix.Close(fd)
+	return nil
+})
+
+// Supported reports whether the kernel can confine paths, which needs openat2
+func Supported() error {
+	return openat2Supported()
+}
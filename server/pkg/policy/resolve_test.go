@@ -0,0 +1,348 @@
+package policy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// testTree creates a root allowed by the returned Confinement, a second allowed root and a
+// secret outside of both, and links inside the root leading to the secret
+//
+//	base/root/dir/file       "in"
+//	base/root/rel    -> dir/file
+//	base/root/abs    -> base/outside/secret
+//	base/root/up     -> ../outside/secret
+//	base/root/updir  -> ..
+//	base/root2/
+//	base/outside/secret      "out"
+func testTree(t *testing.T) (string, *Confinement) {
+	t.Helper()
+	if err := Supported(); err != nil {
+		t.Skip(err)
+	}
+	base := t.TempDir()
+	for _, dir := range []string{"root/dir", "root2", "outside"} {
+		if err := os.MkdirAll(filepath.Join(base, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{"root/dir/file": "in", "outside/secret": "out"}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(base, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"root/rel":   "dir/file",
+		"root/abs":   filepath.Join(base, "outside/secret"),
+		"root/up":    "../outside/secret",
+		"root/updir": "..",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(base, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return base, &Confinement{Roots: []string{filepath.Join(base, "root"), filepath.Join(base, "root2")}}
+}
+
+func resolve(t *testing.T, c *Confinement, path string) *Path {
+	t.Helper()
+	p, err := c.Resolve(path)
+	if err != nil {
+		t.Fatalf("Resolve(%q): %v", path, err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestResolve(t *testing.T) {
+	base, c := testTree(t)
+
+	tests := []struct {
+		name string
+		path string
+		// resolveErr is the error of Resolve, openErr the error of opening the resolved path
+		resolveErr error
+		openErr    error
+		want       string
+	}{
+		{name: "file", path: "root/dir/file", want: "in"},
+		{name: "relative symlink inside", path: "root/rel", want: "in"},
+		{name: "dot dot inside", path: "root/dir/../dir/file", want: "in"},
+		{name: "absolute symlink", path: "root/abs", openErr: ErrOutside},
+		{name: "dot dot symlink", path: "root/up", openErr: ErrOutside},
+		{name: "symlink to parent", path: "root/updir/outside/secret", openErr: ErrOutside},
+		{name: "symlink to parent and back", path: "root/updir/root/dir/file", openErr: ErrOutside},
+		{name: "dot dot", path: "root/../outside/secret", resolveErr: ErrOutside},
+		{name: "outside", path: "outside/secret", resolveErr: ErrOutside},
+		{name: "root prefix", path: "root2x", resolveErr: ErrOutside},
+		{name: "missing file", path: "root/dir/missing", openErr: os.ErrNotExist},
+		{name: "missing dir", path: "root/missing/file", openErr: os.ErrNotExist},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := c.Resolve(base + "/" + tt.path)
+			if tt.resolveErr != nil {
+				if !errors.Is(err, tt.resolveErr) {
+					t.Fatalf("Resolve error %v, want %v", err, tt.resolveErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve: %v", err)
+			}
+			defer p.Close()
+
+			f, err := p.Open(os.O_RDONLY, 0)
+			if tt.openErr != nil {
+				if !errors.Is(err, tt.openErr) {
+					t.Fatalf("Open error %v, want %v", err, tt.openErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			defer f.Close()
+			got := make([]byte, 16)
+			n, _ := f.Read(got)
+			if string(got[:n]) != tt.want {
+				t.Errorf("read %q, want %q", got[:n], tt.want)
+			}
+		})
+	}
+
+	if _, err := c.Resolve("root/dir/file"); !errors.Is(err, ErrOutside) {
+		t.Errorf("Resolve of a relative path: %v, want %v", err, ErrOutside)
+	}
+}
+
+func TestResolveUnconfined(t *testing.T) {
+	tests := []struct {
+		name     string
+		c        *Confinement
+		confined bool
+	}{
+		{name: "no confinement", c: nil},
+		{name: "slash allowed", c: &Confinement{Roots: []string{"/srv", "/"}}},
+		{name: "confined", c: &Confinement{Roots: []string{"/srv"}}, confined: true},
+		{name: "nothing allowed", c: &Confinement{}, confined: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.c.Confined(); got != tt.confined {
+				t.Errorf("Confined() = %v, want %v", got, tt.confined)
+			}
+			if tt.confined {
+				return
+			}
+			p, err := tt.c.Resolve("/etc/hostname")
+			if err != nil {
+				t.Fatalf("Resolve: %v", err)
+			}
+			if p.root != nil || p.String() != "/etc/hostname" {
+				t.Errorf("Resolve = %q below %v, want unconfined /etc/hostname", p, p.root)
+			}
+		})
+	}
+}
+
+func TestPathEscapes(t *testing.T) {
+	base, c := testTree(t)
+	root := resolve(t, c, base+"/root")
+	secret := filepath.Join(base, "outside/secret")
+
+	tests := []struct {
+		name string
+		op   func() error
+	}{
+		{name: "open joined dot dot", op: func() error {
+			_, err := root.Join("..", "outside", "secret").Open(os.O_RDONLY, 0)
+			return err
+		}},
+		{name: "stat through symlink", op: func() error { _, err := root.Join("abs").Stat(); return err }},
+		{name: "eval symlinks", op: func() error { _, err := root.Join("up").EvalSymlinks(); return err }},
+		{name: "create through symlinked dir", op: func() error {
+			_, err := root.Join("updir", "outside", "new").Open(os.O_WRONLY|os.O_CREATE, 0644)
+			return err
+		}},
+		{name: "mkdir through symlinked dir", op: func() error { return root.Join("updir", "outside", "newdir").Mkdir(0755) }},
+		{name: "mkdir all through symlinked dir", op: func() error { return root.Join("updir", "outside", "a", "b").MkdirAll(0755) }},
+		{name: "remove through symlinked dir", op: func() error { return root.Join("updir", "outside", "secret").Remove() }},
+		{name: "remove all through symlinked dir", op: func() error { return root.Join("updir", "outside").RemoveAll() }},
+		{name: "remove root", op: func() error { return root.Remove() }},
+		{name: "rename to symlinked dir", op: func() error {
+			return root.Join("dir", "file").Rename(root.Join("updir", "outside", "secret"))
+		}},
+		{name: "rename from symlinked dir", op: func() error {
+			return root.Join("updir", "outside", "secret").Rename(root.Join("stolen"))
+		}},
+		{name: "link from symlinked dir", op: func() error {
+			return root.Join("updir", "outside", "secret").Link(root.Join("stolen"))
+		}},
+		{name: "symlink in symlinked dir", op: func() error { return root.Join("updir", "outside", "link").Symlink("x") }},
+		{name: "chmod through symlinked dir", op: func() error { return root.Join("updir", "outside", "secret").Chmod(0777) }},
+		{name: "utimes through symlinked dir", op: func() error {
+			return root.Join("updir", "outside", "secret").UtimesNano([]unix.Timespec{{}, {}})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.op(); !errors.Is(err, ErrOutside) {
+				t.Fatalf("got error %v, want %v", err, ErrOutside)
+			}
+		})
+	}
+
+	// None of them touched anything outside of the root
+	entries, err := os.ReadDir(filepath.Join(base, "outside"))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("outside holds %v, %v, want only the secret", entries, err)
+	}
+	st, err := os.Stat(secret)
+	if err != nil || st.Mode().Perm() != 0644 || st.ModTime().Unix() == 0 {
+		t.Errorf("secret changed: %v, %v", st, err)
+	}
+	if _, err := os.Lstat(filepath.Join(base, "root/stolen")); !os.IsNotExist(err) {
+		t.Errorf("secret was moved or linked into the root: %v", err)
+	}
+}
+
+func TestPathSymlinksInLastComponent(t *testing.T) {
+	base, c := testTree(t)
+	root := resolve(t, c, base+"/root")
+	secret := filepath.Join(base, "outside/secret")
+	var before unix.Stat_t
+	if err := unix.Stat(secret, &before); err != nil {
+		t.Fatal(err)
+	}
+
+	// Operations on the link itself stay within the root
+	if st, err := root.Join("abs").Lstat(); err != nil || st.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Lstat of a symlink = %v, %v", st, err)
+	}
+	if target, err := root.Join("abs").Readlink(); err != nil || target != secret {
+		t.Errorf("Readlink = %q, %v, want %q", target, err, secret)
+	}
+	if err := root.Join("abs").Lchown(1, 1); err != nil {
+		t.Errorf("Lchown of a symlink: %v", err)
+	}
+	if err := root.Join("abs").Chmod(0777); err == nil {
+		t.Errorf("Chmod of a symlink succeeded")
+	}
+	if f, err := root.Join("abs").Open(os.O_WRONLY|os.O_TRUNC|unix.O_NOFOLLOW, 0); err == nil {
+		f.Close()
+		t.Errorf("Open with O_NOFOLLOW of a symlink succeeded")
+	}
+	if err := root.Join("abs").Link(root.Join("abs2")); err != nil {
+		t.Errorf("Link of a symlink: %v", err)
+	}
+	if err := root.Join("abs2").Remove(); err != nil {
+		t.Errorf("Remove of a symlink: %v", err)
+	}
+
+	// A tree holding a link to a directory outside is removed without following it
+	if err := root.Join("tree").Mkdir(0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Join("tree", "out").Symlink(filepath.Join(base, "outside")); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Join("tree").RemoveAll(); err != nil {
+		t.Errorf("RemoveAll: %v", err)
+	}
+
+	var after unix.Stat_t
+	if err := unix.Stat(secret, &after); err != nil || after.Mode != before.Mode || after.Uid != before.Uid {
+		t.Errorf("secret changed from mode %o uid %d to mode %o uid %d: %v", before.Mode, before.Uid, after.Mode, after.Uid, err)
+	}
+	if resolved, err := root.Join("rel").EvalSymlinks(); err != nil || resolved.String() != filepath.Join(base, "root/dir/file") {
+		t.Errorf("EvalSymlinks = %v, %v", resolved, err)
+	}
+}
+
+func TestPathOperations(t *testing.T) {
+	base, c := testTree(t)
+	c.Roots = append(c.Roots, filepath.Join(base, "missing"))
+	root := resolve(t, c, base+"/root")
+
+	if err := resolve(t, c, base+"/missing/a/b").MkdirAll(0755); err != nil {
+		t.Errorf("MkdirAll below a missing root: %v", err)
+	}
+	if st, err := os.Stat(filepath.Join(base, "missing/a/b")); err != nil || !st.IsDir() {
+		t.Errorf("MkdirAll created %v, %v", st, err)
+	}
+	if err := root.Join("dir", "file", "sub").MkdirAll(0755); !errors.Is(err, unix.ENOTDIR) {
+		t.Errorf("MkdirAll below a file: %v, want %v", err, unix.ENOTDIR)
+	}
+
+	// Renames and links between roots
+	other := resolve(t, c, base+"/root2/file")
+	if err := root.Join("dir", "file").Rename(other); err != nil {
+		t.Fatalf("Rename across roots: %v", err)
+	}
+	if err := other.Link(root.Join("dir", "file")); err != nil {
+		t.Fatalf("Link across roots: %v", err)
+	}
+	for _, p := range []*Path{other, root.Join("dir", "file")} {
+		if data, err := os.ReadFile(p.String()); err != nil || string(data) != "in" {
+			t.Errorf("%s holds %q, %v", p, data, err)
+		}
+	}
+
+	if err := root.Join("dir").Remove(); !errors.Is(err, unix.ENOTEMPTY) {
+		t.Errorf("Remove of a non-empty dir: %v, want %v", err, unix.ENOTEMPTY)
+	}
+	if err := root.Join("dir").RemoveAll(); err != nil {
+		t.Errorf("RemoveAll: %v", err)
+	}
+	if _, err := root.Join("dir").Lstat(); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Lstat after RemoveAll: %v", err)
+	}
+	if err := root.Join("dir").RemoveAll(); err != nil {
+		t.Errorf("RemoveAll of a missing path: %v", err)
+	}
+}
+
+func TestBeneath(t *testing.T) {
+	base, c := testTree(t)
+
+	for _, noSymlinks := range []bool{false, true} {
+		dir, err := resolve(t, c, base+"/root").Beneath(noSymlinks)
+		if err != nil {
+			t.Fatalf("Beneath(%v): %v", noSymlinks, err)
+		}
+		defer dir.Close()
+
+		if dir.String() != filepath.Join(base, "root") {
+			t.Errorf("Beneath(%v) = %q", noSymlinks, dir)
+		}
+		if _, err := dir.Join("dir", "file").Stat(); err != nil {
+			t.Errorf("Beneath(%v): Stat of a file: %v", noSymlinks, err)
+		}
+		_, err = dir.Join("rel").Stat()
+		if noSymlinks && !errors.Is(err, unix.ELOOP) {
+			t.Errorf("Beneath(true): Stat through a symlink: %v, want %v", err, unix.ELOOP)
+		} else if !noSymlinks && err != nil {
+			t.Errorf("Beneath(false): Stat through a symlink: %v", err)
+		}
+		if _, err := dir.Join("updir", "outside", "secret").Stat(); err == nil {
+			t.Errorf("Beneath(%v): Stat outside succeeded", noSymlinks)
+		}
+	}
+
+	// Confined to the directory rather than to the allowed root
+	dir, err := resolve(t, c, base+"/root/dir").Beneath(false)
+	if err != nil {
+		t.Fatalf("Beneath: %v", err)
+	}
+	defer dir.Close()
+	if _, err := dir.Join("..", "rel").Stat(); !errors.Is(err, ErrOutside) {
+		t.Errorf("Stat of the parent: %v, want %v", err, ErrOutside)
+	}
+}
@@ -0,0 +1,143 @@
+// Package throttle limits the bandwidth of file transfers with token buckets shared by all
+// transfers, by the transfers of one user, and owned by a single transfer.
+package throttle
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// minBurst keeps the buckets of slow rates from splitting chunks into tiny waits
+const minBurst = 64 << 10
+
+// Config holds the rates in bytes per second, 0 means unlimited
+type Config struct {
+	// Global is shared by all transfers
+	Global int64
+	// PerUser is shared by the transfers of each user without an entry in Users
+	PerUser int64
+	// Users overrides PerUser for single users
+	Users map[string]int64
+}
+
+// Limiter hands out the buckets a transfer has to pass
+type Limiter struct {
+	cfg    Config
+	global *rate.Limiter
+	mu     sync.Mutex
+	users  map[string]*rate.Limiter
+}
+
+// NewLimiter creates a Limiter for cfg
+func NewLimiter(cfg Config) *Limiter {
+	return &Limiter{
+		cfg:    cfg,
+		global: newBucket(cfg.Global),
+		users:  make(map[string]*rate.Limiter),
+	}
+}
+
+// UserRate returns the rate of username's transfers, 0 if unlimited
+func (l *Limiter) UserRate(username string) int64 {
+	if l == nil {
+		return 0
+	}
+	if r, ok := l.cfg.Users[username]; ok {
+		return r
+	}
+	return l.cfg.PerUser
+}
+
+// Transfer returns the throttle of one transfer by username. requested is the rate the client
+// asked for, capped by the server's limits; 0 leaves the transfer to the server's limits only.
+// A nil Limiter only applies the requested rate.
+func (l *Limiter) Transfer(username string, requested int64) *Transfer {
+	t := &Transfer{rate: l.effectiveRate(username)}
+	if l != nil {
+		if l.global != nil {
+			t.buckets = append(t.buckets, l.global)
+		}
+		if b := l.userBucket(username); b != nil {
+			t.buckets = append(t.buckets, b)
+		}
+	}
+	// The requested rate only needs a bucket of its own when it is below the server's limits
+	if requested > 0 && (t.rate == 0 || requested < t.rate) {
+		// Start empty, a full bucket would let short transfers pass unthrottled
+		b := newBucket(requested)
+		b.AllowN(time.Now(), b.Burst())
+		t.buckets = append(t.buckets, b)
+		t.rate = requested
+	}
+	return t
+}
+
+// effectiveRate returns the lowest of the global and the user's rate, 0 if both are unlimited
+func (l *Limiter) effectiveRate(username string) int64 {
+	if l == nil {
+		return 0
+	}
+	r := l.cfg.Global
+	if u := l.UserRate(username); u > 0 && (r == 0 || u < r) {
+		r = u
+	}
+	return r
+}
+
+func (l *Limiter) userBucket(username string) *rate.Limiter {
+	r := l.UserRate(username)
+	if r <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.users[username]
+	if !ok {
+		b = newBucket(r)
+		l.users[username] = b
+	}
+	return b
+}
+
+// Transfer throttles the bytes of a single transfer
+type Transfer struct {
+	buckets []*rate.Limiter
+	rate    int64
+}
+
+// Rate returns the rate the transfer is limited to in bytes per second, 0 if unlimited
+func (t *Transfer) Rate() int64 {
+	if t == nil {
+		return 0
+	}
+	return t.rate
+}
+
+// WaitN blocks until n bytes may pass every bucket of the transfer or ctx is done
+func (t *Transfer) WaitN(ctx context.Context, n int) error {
+	if t == nil {
+		return nil
+	}
+	for _, b := range t.buckets {
+		// WaitN refuses requests above the burst, larger chunks are taken in pieces
+		for left := n; left > 0; {
+			take := min(left, b.Burst())
+			if err := b.WaitN(ctx, take); err != nil {
+				return err
+			}
+			left -= take
+		}
+	}
+	return nil
+}
+
+func newBucket(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	// Allow a second worth of data at once, but at least minBurst
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(max(bytesPerSecond, minBurst)))
+}
@@ -0,0 +1,106 @@
+package throttle
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestUserRate(t *testing.T) {
+	l := NewLimiter(Config{Global: 1000, PerUser: 100, Users: map[string]int64{"fast": 500, "free": 0}})
+	tests := []struct {
+		username string
+		want     int64
+	}{
+		{username: "alice", want: 100},
+		{username: "fast", want: 500},
+		{username: "free", want: 0},
+	}
+	for _, tt := range tests {
+		if got := l.UserRate(tt.username); got != tt.want {
+			t.Errorf("UserRate(%q) = %d, want %d", tt.username, got, tt.want)
+		}
+	}
+
+	var nilLimiter *Limiter
+	if got := nilLimiter.UserRate("alice"); got != 0 {
+		t.Errorf("UserRate of a nil Limiter = %d, want 0", got)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       *Config
+		username  string
+		requested int64
+		wantRate  int64
+		// wantBuckets counts the global, the user's and the transfer's own bucket
+		wantBuckets int
+	}{
+		{name: "unlimited", cfg: &Config{}, wantRate: 0, wantBuckets: 0},
+		{name: "nil limiter", cfg: nil, wantRate: 0, wantBuckets: 0},
+		{name: "nil limiter requested", cfg: nil, requested: 10, wantRate: 10, wantBuckets: 1},
+		{name: "global only", cfg: &Config{Global: 1000}, wantRate: 1000, wantBuckets: 1},
+		{name: "user below global", cfg: &Config{Global: 1000, PerUser: 100}, wantRate: 100, wantBuckets: 2},
+		{name: "user above global", cfg: &Config{Global: 100, PerUser: 1000}, wantRate: 100, wantBuckets: 2},
+		{name: "user override", cfg: &Config{PerUser: 100, Users: map[string]int64{"alice": 50}}, username: "alice", wantRate: 50, wantBuckets: 1},
+		{name: "user override unlimited", cfg: &Config{PerUser: 100, Users: map[string]int64{"alice": 0}}, username: "alice", wantRate: 0, wantBuckets: 0},
+		{name: "requested below limits", cfg: &Config{Global: 1000, PerUser: 100}, requested: 10, wantRate: 10, wantBuckets: 3},
+		{name: "requested above limits", cfg: &Config{Global: 1000, PerUser: 100}, requested: 500, wantRate: 100, wantBuckets: 2},
+		{name: "requested without limits", cfg: &Config{}, requested: 500, wantRate: 500, wantBuckets: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var l *Limiter
+			if tt.cfg != nil {
+				l = NewLimiter(*tt.cfg)
+			}
+			username := tt.username
+			if username == "" {
+				username = "bob"
+			}
+			tr := l.Transfer(username, tt.requested)
+			if tr.Rate() != tt.wantRate || len(tr.buckets) != tt.wantBuckets {
+				t.Errorf("Transfer = rate %d with %d buckets, want rate %d with %d buckets", tr.Rate(), len(tr.buckets), tt.wantRate, tt.wantBuckets)
+			}
+		})
+	}
+}
+
+func TestTransferSharesBuckets(t *testing.T) {
+	l := NewLimiter(Config{Global: 1000, PerUser: 100})
+	a1, a2, b := l.Transfer("alice", 0), l.Transfer("alice", 0), l.Transfer("bob", 0)
+	if a1.buckets[0] != b.buckets[0] {
+		t.Errorf("transfers of different users do not share the global bucket")
+	}
+	if a1.buckets[1] != a2.buckets[1] {
+		t.Errorf("transfers of one user do not share the user's bucket")
+	}
+	if a1.buckets[1] == b.buckets[1] {
+		t.Errorf("transfers of different users share a user bucket")
+	}
+}
+
+func TestWaitN(t *testing.T) {
+	// A chunk above the burst passes a full bucket in pieces rather than failing
+	tr := NewLimiter(Config{Global: minBurst}).Transfer("alice", 0)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := tr.WaitN(ctx, minBurst+1); err != nil {
+		t.Errorf("WaitN above the burst: %v", err)
+	}
+
+	// The bucket of a requested rate starts empty
+	tr = (*Limiter)(nil).Transfer("alice", minBurst)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := tr.WaitN(ctx, minBurst/2); err == nil {
+		t.Errorf("WaitN passed half a second worth of data at once")
+	}
+
+	var unlimited *Transfer
+	if err := unlimited.WaitN(context.Background(), 1<<30); err != nil || unlimited.Rate() != 0 {
+		t.Errorf("nil Transfer: WaitN %v, rate %d", err, unlimited.Rate())
+	}
+}
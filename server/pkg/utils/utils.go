@@ -67,3 +67,45 @@ func GetUserIDs(username string) (int, int, error) {
 
 	return uid, gid, nil
 }
+
+// LookupUID resolves a user name or numeric uid
+func LookupUID(owner string) (int, error) {
+	if uid, err := strconv.Atoi(owner); err == nil {
+		return uid, nil
+	}
+	usr, err := LookupUser(owner)
+	if err != nil {
+		return 0, fmt.Errorf("user lookup failed: %v", err)
+	}
+	return strconv.Atoi(usr.Uid)
+}
+
+// LookupGID resolves a group name or numeric gid
+func LookupGID(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	grp, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, fmt.Errorf("group lookup failed: %v", err)
+	}
+	return strconv.Atoi(grp.Gid)
+}
+
+// UserName returns the name of uid, or the uid itself when it has no passwd entry
+func UserName(uid uint32) string {
+	id := strconv.FormatUint(uint64(uid), 10)
+	if usr, err := user.LookupId(id); err == nil {
+		return usr.Username
+	}
+	return id
+}
+
+// GroupName returns the name of gid, or the gid itself when it has no group entry
+func GroupName(gid uint32) string {
+	id := strconv.FormatUint(uint64(gid), 10)
+	if grp, err := user.LookupGroupId(id); err == nil {
+		return grp.Name
+	}
+	return id
+}
@@ -0,0 +1,292 @@
+// Command transferbench measures the throughput of TransferFile uploads and downloads for
+// combinations of file and chunk sizes. It runs the server in process on a loopback listener,
+// without authentication, and transfers files as the current user into a temporary directory.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	pb "github.com/HZ89/simple-ansible-connection-plugin/server/pkg/connection"
+	"github.com/HZ89/simple-ansible-connection-plugin/server/pkg/implement"
+	"github.com/spf13/pflag"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+func main() {
+	sizes := pflag.IntSlice("sizes", []int{4 << 10, 1 << 20, 64 << 20}, "File sizes in bytes to transfer")
+	chunkSizes := pflag.IntSlice("chunk-sizes", []int{32 << 10, 256 << 10, 1 << 20}, "Chunk sizes in bytes to request")
+	duration := pflag.Duration("duration", 2*time.Second, "Minimum time spent on every combination")
+	rateLimit := pflag.Int64("rate-limit", 0, "Bytes per second every transfer asks to be throttled to, 0 means unlimited")
+	batch := pflag.Int("batch", 100, "Files uploaded per stream in batch mode, 0 skips batch uploads")
+	dir := pflag.String("dir", "", "Directory to transfer files into, a temporary directory by default")
+	pflag.Parse()
+
+	if err := run(*sizes, *chunkSizes, *rateLimit, *batch, *duration, *dir); err != nil {
+		fmt.Fprintf(os.Stderr, "transferbench: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(sizes, chunkSizes []int, rateLimit int64, batch int, duration time.Duration, dir string) error {
+	if len(sizes) == 0 || len(chunkSizes) == 0 {
+		return fmt.Errorf("at least one file size and chunk size are required")
+	}
+	if dir == "" {
+		tmp, err := os.MkdirTemp("", "transferbench")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		dir = tmp
+	}
+
+	current, err := user.Current()
+	if err != nil {
+		return err
+	}
+
+	limits := implement.ChunkSizes{
+		Min:     slices.Min(chunkSizes),
+		Max:     slices.Max(chunkSizes),
+		Default: slices.Min(chunkSizes),
+	}
+	msgSize := max(implement.DefaultMaxRecvMsgSize, 2*limits.Max)
+	if err := limits.Validate(msgSize); err != nil {
+		return err
+	}
+
+	// The handlers only read the user from the metadata, authentication is left out
+	s := implement.NewServer(nil, nil, nil)
+	s.ChunkSizes = limits
+	s.MaxRecvMsgSize = msgSize
+	s.MaxSendMsgSize = msgSize
+	grpcServer := grpc.NewServer(grpc.MaxRecvMsgSize(msgSize), grpc.MaxSendMsgSize(msgSize))
+	pb.RegisterConnectionServiceServer(grpcServer, s)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	conn, err := grpc.NewClient(lis.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(msgSize), grpc.MaxCallSendMsgSize(msgSize)),
+	)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := pb.NewConnectionServiceClient(conn)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "user", current.Username)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "operation\tfile size\tchunk size\tfiles\tfiles/s\tMiB/s\t")
+	for _, size := range sizes {
+		data := make([]byte, size)
+		if _, err := rand.Read(data); err != nil {
+			return err
+		}
+		path := filepath.Join(dir, fmt.Sprintf("bench-%d", size))
+		for _, chunkSize := range chunkSizes {
+			ops := []struct {
+				name string
+				fn   func() (int, error)
+			}{
+				{"upload", func() (int, error) { return 1, upload(ctx, client, path, data, chunkSize, rateLimit) }},
+				{"download", func() (int, error) { return 1, download(ctx, client, path, size, chunkSize, rateLimit) }},
+			}
+			if batch > 0 {
+				ops = append(ops, struct {
+					name string
+					fn   func() (int, error)
+				}{"upload batch", func() (int, error) { return batch, uploadBatch(ctx, client, path, data, chunkSize, rateLimit, batch) }})
+			}
+			for _, op := range ops {
+				files, elapsed, err := repeat(op.fn, duration)
+				if err != nil {
+					return fmt.Errorf("%s of %d bytes in chunks of %d: %w", op.name, size, chunkSize, err)
+				}
+				seconds := elapsed.Seconds()
+				fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.1f\t%.1f\t\n", op.name, size, chunkSize, files,
+					float64(files)/seconds, float64(files)*float64(size)/seconds/(1<<20))
+			}
+		}
+	}
+	return tw.Flush()
+}
+
+// repeat calls fn until duration has passed, at least once, and sums the files it transferred
+func repeat(fn func() (int, error), duration time.Duration) (int, time.Duration, error) {
+	start := time.Now()
+	files := 0
+	for files == 0 || time.Since(start) < duration {
+		n, err := fn()
+		if err != nil {
+			return files, 0, err
+		}
+		files += n
+	}
+	return files, time.Since(start), nil
+}
+
+func uploadInfo(path string, size, chunkSize int, rateLimit int64) *pb.FileInfo {
+	return &pb.FileInfo{
+		RemotePath:        path,
+		FileSize:          int64(size),
+		ChecksumAlgorithm: pb.FileInfo_SHA256,
+		ChunkSize:         int32(chunkSize),
+		RateLimit:         rateLimit,
+	}
+}
+
+// sendData sends data in chunks of chunkSize
+func sendData(stream pb.ConnectionService_TransferFileClient, data []byte, chunkSize int) error {
+	for off := 0; off < len(data); off += chunkSize {
+		chunk := data[off:min(off+chunkSize, len(data))]
+		if err := stream.Send(&pb.FileTransferMessage{
+			Payload: &pb.FileTransferMessage_Data{Data: &pb.FileData{Data: chunk}},
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func upload(ctx context.Context, client pb.ConnectionServiceClient, path string, data []byte, chunkSize int, rateLimit int64) error {
+	stream, err := client.TransferFile(ctx)
+	if err != nil {
+		return err
+	}
+	err = stream.Send(&pb.FileTransferMessage{
+		Payload: &pb.FileTransferMessage_Control{
+			Control: &pb.ControlMessage{
+				Operation: pb.ControlMessage_UPLOAD,
+				Info:      uploadInfo(path, len(data), chunkSize, rateLimit),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := sendData(stream, data, chunkSize); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	for {
+		if _, err := stream.Recv(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// uploadBatch uploads data to n files next to path on a single stream
+func uploadBatch(ctx context.Context, client pb.ConnectionServiceClient, path string, data []byte, chunkSize int, rateLimit int64, n int) error {
+	stream, err := client.TransferFile(ctx)
+	if err != nil {
+		return err
+	}
+	sendErr := make(chan error, 1)
+	go func() {
+		for i := range n {
+			info := uploadInfo(fmt.Sprintf("%s.%d", path, i), len(data), chunkSize, rateLimit)
+			start := &pb.ControlMessage{Operation: pb.ControlMessage_UPLOAD, Info: info, Batch: i == 0}
+			end := &pb.ControlMessage{Operation: pb.ControlMessage_UPLOAD}
+			if err := stream.Send(&pb.FileTransferMessage{Payload: &pb.FileTransferMessage_Control{Control: start}}); err != nil {
+				sendErr <- err
+				return
+			}
+			if err := sendData(stream, data, chunkSize); err != nil {
+				sendErr <- err
+				return
+			}
+			if err := stream.Send(&pb.FileTransferMessage{Payload: &pb.FileTransferMessage_Control{Control: end}}); err != nil {
+				sendErr <- err
+				return
+			}
+		}
+		sendErr <- stream.CloseSend()
+	}()
+
+	acks := 0
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if st := msg.GetControl().GetStatus(); st != nil {
+			return fmt.Errorf("upload failed: %s", st.Message)
+		}
+		acks++
+	}
+	if err := <-sendErr; err != nil {
+		return err
+	}
+	if acks != n {
+		return fmt.Errorf("received %d of %d acknowledgements", acks, n)
+	}
+	return nil
+}
+
+func download(ctx context.Context, client pb.ConnectionServiceClient, path string, size, chunkSize int, rateLimit int64) error {
+	stream, err := client.TransferFile(ctx)
+	if err != nil {
+		return err
+	}
+	err = stream.Send(&pb.FileTransferMessage{
+		Payload: &pb.FileTransferMessage_Control{
+			Control: &pb.ControlMessage{
+				Operation: pb.ControlMessage_DOWNLOAD,
+				Info: &pb.FileInfo{
+					RemotePath:        path,
+					ChecksumAlgorithm: pb.FileInfo_SHA256,
+					ChunkSize:         int32(chunkSize),
+					RateLimit:         rateLimit,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	received := 0
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if data := msg.GetData(); data != nil {
+			received += len(data.Data)
+		}
+	}
+	if received != size {
+		return fmt.Errorf("received %d of %d bytes", received, size)
+	}
+	return nil
+}